@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// keyAccess is when an api key, identified by keyID, was last used.
+type keyAccess struct {
+	Dir        directory `json:"dir"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+// accessTimes tracks when each api key was last used.
+type accessTimes struct {
+	mu    sync.Mutex
+	times map[string]keyAccess // keyID -> last access
+}
+
+// newAccessTimes creates an empty accessTimes.
+func newAccessTimes() *accessTimes {
+	return &accessTimes{times: make(map[string]keyAccess)}
+}
+
+// Touch records that the api key for dir was used at t.
+func (a *accessTimes) Touch(key string, dir directory, t time.Time) {
+	if key == "" {
+		return // public access
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.times[keyID(key)] = keyAccess{Dir: dir, LastAccess: t.UTC()}
+}
+
+// Snapshot gives a copy of the access times.
+func (a *accessTimes) Snapshot() map[string]keyAccess {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	times := make(map[string]keyAccess, len(a.times))
+	for id, access := range a.times {
+		times[id] = access
+	}
+	return times
+}
+
+// Load reads access times saved by Save to the file at path, if it exists.
+func (a *accessTimes) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading access times '%s': %w", path, err)
+	}
+	var times map[string]keyAccess
+	if err := json.Unmarshal(data, &times); err != nil {
+		return fmt.Errorf("error parsing access times '%s': %w", path, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, access := range times {
+		if access.LastAccess.After(a.times[id].LastAccess) {
+			a.times[id] = access
+		}
+	}
+	return nil
+}
+
+// Save writes the access times to the file at path as JSON.
+func (a *accessTimes) Save(path string) error {
+	data, err := json.MarshalIndent(a.Snapshot(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding access times: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("error writing access times '%s': %w", path, err)
+	}
+	return nil
+}
+
+// accessReport replies with a JSON object mapping the keyID of every api key
+// used to its directory and the time it was last used.
+func (fs *httpfsServer) accessReport(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fs.access.Snapshot())
+}
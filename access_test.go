@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// accessTimesReport gets the access times from the admin endpoint of fs.
+func accessTimesReport(t *testing.T, fs *httpfsServer) map[string]keyAccess {
+	t.Helper()
+	resp := do(fs, http.MethodGet, adminPrefix+"access", "admin-key", "")
+	expectStatus(t, resp, http.StatusOK)
+	var times map[string]keyAccess
+	if err := json.NewDecoder(resp.Body).Decode(&times); err != nil {
+		t.Fatalf("access times aren't JSON: %s", err)
+	}
+	return times
+}
+
+func TestAccessTimes(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AdminKeys = []apikey{"admin-key"}
+	cfg.APIKeys["other-key"] = keyConfig{Dir: "other", Perms: permRead}
+	cfg.AccessTimesFile = filepath.Join(t.TempDir(), "access.json")
+	fs := newTestServer(t, cfg)
+
+	before := time.Now().UTC()
+	expectStatus(t, do(fs, http.MethodGet, "/", testKey, ""), http.StatusOK)
+	time.Sleep(10 * time.Millisecond)
+	middle := time.Now().UTC()
+	expectStatus(t, do(fs, http.MethodGet, "/", "other-key", ""), http.StatusOK)
+	after := time.Now().UTC()
+	expectStatus(t, do(fs, http.MethodGet, "/", "wrong-key", ""), http.StatusUnauthorized)
+
+	times := accessTimesReport(t, fs)
+	if len(times) != 2 {
+		t.Fatalf("got access times of %d keys, want 2: %v", len(times), times)
+	}
+	first, second := times[keyID(testKey)], times[keyID("other-key")]
+	if first.Dir != "sandbox" || first.LastAccess.Before(before) || first.LastAccess.After(middle) {
+		t.Errorf("got access %+v of the first key, want sandbox between %s and %s", first, before, middle)
+	}
+	if second.Dir != "other" || second.LastAccess.Before(middle) || second.LastAccess.After(after) {
+		t.Errorf("got access %+v of the second key, want other between %s and %s", second, middle, after)
+	}
+
+	// saved on shutdown and loaded by the next server
+	if err := fs.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(cfg.AccessTimesFile) {
+		t.Fatal("access times weren't saved on shutdown")
+	}
+	loaded := accessTimesReport(t, newTestServer(t, cfg))
+	if len(loaded) != 2 || !loaded[keyID(testKey)].LastAccess.Equal(first.LastAccess) ||
+		!loaded[keyID("other-key")].LastAccess.Equal(second.LastAccess) {
+		t.Errorf("loaded access times %v, want %v", loaded, times)
+	}
+}
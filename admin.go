@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+
+	"github.com/quillaja/sysdlog"
+)
+
+// prefix of paths reserved for admin requests
+const adminPrefix = "/_admin/"
+
+// adminHandler serves requests for admin information. Requests must use
+// one of the configured admin keys.
+func (fs *httpfsServer) adminHandler(w http.ResponseWriter, req *http.Request) {
+	settings := fs.configFor(req)
+
+	w.Header().Add("Cache-Control", "no-cache")
+
+	_, key, _ := req.BasicAuth()
+	if !settings.isAdminKey(key) {
+		if _, _, found := settings.findKey(key); found {
+			writeJSONError(w, http.StatusForbidden, "admin key required")
+			return
+		}
+		writeJSONError(w, http.StatusUnauthorized, "unrecognized api key")
+		return
+	}
+
+	switch req.URL.Path {
+	case adminPrefix + "usage":
+		fs.usageReport(w, settings)
+	case adminPrefix + "access":
+		fs.accessReport(w)
+	case adminPrefix + "maintenance":
+		fs.maintenanceReport(w, req)
+	default:
+		writeJSONError(w, http.StatusNotFound, "unknown admin request")
+	}
+}
+
+// usageReport replies with a JSON object mapping every sandbox directory to
+// the bytes stored in it.
+func (fs *httpfsServer) usageReport(w http.ResponseWriter, settings Config) {
+	usage := make(map[directory]int64)
+	for _, keycfg := range settings.APIKeys {
+		if _, done := usage[keycfg.Dir]; done {
+			continue
+		}
+		size, err := dirSize(fs.storage, filepath.Join(settings.FileRoot, string(keycfg.Dir)))
+		if err != nil {
+			fs.logf(sysdlog.Err, "error reporting usage:%s\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error calculating usage")
+			return
+		}
+		usage[keycfg.Dir] = size
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
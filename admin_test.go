@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestAdminUsage(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AdminKeys = []apikey{"admin-key"}
+	cfg.APIKeys["other-key"] = keyConfig{Dir: "other", Perms: permAll}
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "a.txt", "12345")
+	writeSandboxFile(t, cfg, "dir/b.txt", "123")
+
+	resp := do(fs, http.MethodGet, adminPrefix+"usage", "admin-key", "")
+	expectStatus(t, resp, http.StatusOK)
+	var usage map[directory]int64
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		t.Fatalf("usage isn't JSON: %s", err)
+	}
+	if len(usage) != 2 || usage["sandbox"] != 8 || usage["other"] != 0 {
+		t.Errorf("got usage %v, want 8 bytes in sandbox and none in other", usage)
+	}
+
+	expectJSONError(t, do(fs, http.MethodGet, adminPrefix+"usage", testKey, ""), http.StatusForbidden)
+	expectJSONError(t, do(fs, http.MethodGet, adminPrefix+"usage", "wrong-key", ""), http.StatusUnauthorized)
+	expectJSONError(t, do(fs, http.MethodGet, adminPrefix+"usage", "", ""), http.StatusUnauthorized)
+}
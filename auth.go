@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// prefix of hashed api keys in the config. Hashed keys have the form
+// "sha256$<salt hex>$<hash hex>" where the hash is SHA-256 of salt+key.
+const hashedKeyPrefix = "sha256$"
+
+// length in bytes of the salt used when hashing api keys
+const keySaltLen = 16
+
+// hashAPIKey creates the salted hash of key for use in the config.
+func hashAPIKey(key string) (apikey, error) {
+	salt := make([]byte, keySaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("error generating salt: %w", err)
+	}
+	return apikey(hashedKeyPrefix + hex.EncodeToString(salt) + "$" + hex.EncodeToString(saltedHash(salt, key))), nil
+}
+
+// saltedHash computes SHA-256 of salt+key.
+func saltedHash(salt []byte, key string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(key))
+	return h.Sum(nil)
+}
+
+// isHashedKey reports if the config key is a hashed api key.
+func isHashedKey(stored apikey) bool {
+	return strings.HasPrefix(string(stored), hashedKeyPrefix)
+}
+
+// parseHashedKey splits a hashed api key into its salt and hash.
+func parseHashedKey(stored apikey) (salt, sum []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(string(stored), hashedKeyPrefix), "$")
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("hashed key '%s' is not of the form %s<salt>$<hash>", stored, hashedKeyPrefix)
+	}
+	if salt, err = hex.DecodeString(parts[0]); err != nil {
+		return nil, nil, fmt.Errorf("hashed key '%s' has an invalid salt: %w", stored, err)
+	}
+	if sum, err = hex.DecodeString(parts[1]); err != nil || len(sum) != sha256.Size {
+		return nil, nil, fmt.Errorf("hashed key '%s' has an invalid hash", stored)
+	}
+	return salt, sum, nil
+}
+
+// keyMatches reports if key is the api key stored in the config, either as
+// plaintext or hashed.
+func keyMatches(stored apikey, key string) bool {
+	if !isHashedKey(stored) {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(key)) == 1
+	}
+	salt, sum, err := parseHashedKey(stored)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(saltedHash(salt, key), sum) == 1
+}
+
+// findKey gets the api key as stored in the config, either as plaintext or
+// hashed, and its settings. Every stored key is compared in constant time,
+// so the time taken doesn't reveal how much of key matched. A plaintext
+// match is preferred over a hashed one.
+func (s Config) findKey(key string) (apikey, keyConfig, bool) {
+	var match apikey
+	var matchcfg keyConfig
+	found, plain := false, false
+	for stored, keycfg := range s.APIKeys {
+		if keyMatches(stored, key) && !plain {
+			match, matchcfg, found, plain = stored, keycfg, true, !isHashedKey(stored)
+		}
+	}
+	return match, matchcfg, found
+}
+
+// isAdminKey reports if key is one of the admin keys.
+func (s Config) isAdminKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, stored := range s.AdminKeys {
+		if keyMatches(stored, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashAPIKey(t *testing.T) {
+	hashed, err := hashAPIKey("plaintext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isHashedKey(hashed) {
+		t.Fatalf("hash %q doesn't have the prefix %q", hashed, hashedKeyPrefix)
+	}
+	if _, _, err := parseHashedKey(hashed); err != nil {
+		t.Fatalf("hash %q doesn't parse: %s", hashed, err)
+	}
+	if !keyMatches(hashed, "plaintext") {
+		t.Error("hash doesn't match its key")
+	}
+	if keyMatches(hashed, "other") || keyMatches(hashed, "") {
+		t.Error("hash matches another key")
+	}
+	if again, _ := hashAPIKey("plaintext"); again == hashed {
+		t.Error("hashes of the same key aren't salted differently")
+	}
+
+	for _, bad := range []apikey{"sha256$", "sha256$zz$00", "sha256$00$abcd", "sha256$00$00$00"} {
+		if keyMatches(bad, "") {
+			t.Errorf("invalid hash %q matches", bad)
+		}
+	}
+	if !keyMatches("plain", "plain") || keyMatches("plain", "plai") {
+		t.Error("plaintext keys don't match exactly")
+	}
+}
+
+func TestHashedKeyAuthorized(t *testing.T) {
+	hashed, err := hashAPIKey("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t)
+	cfg.APIKeys = map[apikey]keyConfig{hashed: {Dir: "sandbox", Perms: permAll}}
+	fs := newTestServer(t, cfg)
+
+	expectStatus(t, do(fs, http.MethodPut, "/file.txt", "secret", "hashed"), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "hashed" {
+		t.Errorf("file has %q", got)
+	}
+	expectStatus(t, do(fs, http.MethodGet, "/file.txt", "wrong", ""), http.StatusUnauthorized)
+	expectStatus(t, do(fs, http.MethodGet, "/file.txt", string(hashed), ""), http.StatusUnauthorized)
+}
+
+func TestFindKeyPrefersPlaintext(t *testing.T) {
+	hashed, _ := hashAPIKey("key")
+	cfg := Config{APIKeys: map[apikey]keyConfig{
+		hashed: {Dir: "hashed"},
+		"key":  {Dir: "plain"},
+	}}
+	for i := 0; i < 10; i++ { // map order varies
+		if _, keycfg, found := cfg.findKey("key"); !found || keycfg.Dir != "plain" {
+			t.Fatalf("found %+v, want the plaintext key's settings", keycfg)
+		}
+	}
+}
+
+func TestKeyPrefixRejected(t *testing.T) {
+	cfg := Config{APIKeys: map[apikey]keyConfig{"long-secret-key": {Dir: "sandbox"}}}
+	for _, key := range []string{"long-secret", "long-secret-key2", "LONG-SECRET-KEY", ""} {
+		if _, _, found := cfg.findKey(key); found {
+			t.Errorf("key %q matched %q", key, "long-secret-key")
+		}
+	}
+	if _, _, found := cfg.findKey("long-secret-key"); !found {
+		t.Error("key didn't match itself")
+	}
+}
+
+func TestKeysNotLogged(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.LogLevel = "debug"
+	cfg.AdminKeys = []apikey{"admin-secret"}
+	cfg.APIKeys["read-secret"] = keyConfig{Dir: "sandbox", Perms: permRead}
+	fs := newTestServer(t, cfg)
+
+	expectStatus(t, do(fs, http.MethodPut, "/file.txt", testKey, "content"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodGet, "/missing.txt", testKey, ""), http.StatusNotFound)
+	expectStatus(t, do(fs, http.MethodPut, "/file.txt", "read-secret", "changed"), http.StatusForbidden)
+	expectStatus(t, do(fs, http.MethodGet, "/file.txt", "wrong-secret", ""), http.StatusUnauthorized)
+	expectStatus(t, do(fs, http.MethodGet, adminPrefix+"usage", "admin-secret", ""), http.StatusOK)
+
+	log := strings.Join(readLog(t, cfg), "\n")
+	for _, key := range []string{testKey, "read-secret", "wrong-secret", "admin-secret"} {
+		if strings.Contains(log, key) {
+			t.Errorf("log contains the api key %q:\n%s", key, log)
+		}
+	}
+	for _, key := range []string{testKey, "read-secret", "wrong-secret"} {
+		if !strings.Contains(log, keyID(key)) {
+			t.Errorf("log doesn't identify the api key %q by %s:\n%s", key, keyID(key), log)
+		}
+	}
+}
+
+func TestHashedKeyIDs(t *testing.T) {
+	hashed, err := hashAPIKey("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t)
+	cfg.LogFormat = logFormatJSON
+	cfg.AdminKeys = []apikey{"admin-key"}
+	cfg.APIKeys = map[apikey]keyConfig{hashed: {Dir: "sandbox", Perms: permAll, SigningSecret: "signing"}}
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+
+	expectStatus(t, do(fs, http.MethodGet, "/file.txt", "secret", ""), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodGet, signedTarget("signing", http.MethodGet, "/file.txt", time.Now().Add(time.Hour)), "", ""), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodGet, "/file.txt", "wrong", ""), http.StatusUnauthorized)
+
+	// the key is identified the same way in the access report and the log,
+	// whether used directly or through a url it signed
+	want := keyID(string(hashed))
+	if _, found := accessTimesReport(t, fs)[want]; !found {
+		t.Errorf("access report doesn't identify the key by %s", want)
+	}
+	var ids []string
+	for _, rec := range accessRecords(t, cfg) {
+		ids = append(ids, rec.Key)
+	}
+	if len(ids) != 3 || ids[0] != want || ids[1] != want || ids[2] != keyID("wrong") {
+		t.Errorf("access records identify the keys as %v, want %s twice then %s", ids, want, keyID("wrong"))
+	}
+}
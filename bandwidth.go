@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// bandwidthLimiters holds a token bucket over bytes for each api key,
+// shared by all the key's uploads and downloads.
+type bandwidthLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter // api key -> limiter
+}
+
+// newBandwidthLimiters creates an empty bandwidthLimiters.
+func newBandwidthLimiters() *bandwidthLimiters {
+	return &bandwidthLimiters{limiters: make(map[string]*rate.Limiter)}
+}
+
+// Limiter gets the limiter of the api key, allowing perSecond bytes a second
+// with bursts of up to a second's worth.
+func (b *bandwidthLimiters) Limiter(key string, perSecond int64) *rate.Limiter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lim, found := b.limiters[key]
+	if !found {
+		lim = rate.NewLimiter(rate.Limit(perSecond), int(perSecond))
+		b.limiters[key] = lim
+	}
+
+	// settings may have been reloaded
+	if lim.Limit() != rate.Limit(perSecond) {
+		lim.SetLimit(rate.Limit(perSecond))
+		lim.SetBurst(int(perSecond))
+	}
+	return lim
+}
+
+// throttledReader reads no faster than its limiter allows. Reads fail once
+// ctx is done.
+type throttledReader struct {
+	io.ReadCloser
+	ctx context.Context
+	lim *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.lim.Burst() {
+		p = p[:t.lim.Burst()]
+	}
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := t.lim.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// throttledWriter writes a response no faster than its limiter allows.
+// Writes fail once ctx is done.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+	lim *rate.Limiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > t.lim.Burst() {
+			chunk = chunk[:t.lim.Burst()]
+		}
+		if err := t.lim.WaitN(t.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := t.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Flush sends any buffered data to the client, if the wrapped ResponseWriter
+// supports it.
+func (t *throttledWriter) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimit(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys["slow-key"] = keyConfig{Dir: "sandbox", Perms: permAll, BandwidthBytesPerSec: 1000}
+	fs := newTestServer(t, cfg)
+	content := strings.Repeat("x", 2500)
+	writeSandboxFile(t, cfg, "big.txt", content)
+
+	// a burst of a second's worth goes at once, the remaining 1500 bytes
+	// take at least 1.5s
+	const want = 1500 * time.Millisecond
+
+	start := time.Now()
+	resp := do(fs, http.MethodGet, "/big.txt", "slow-key", "")
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); body != content {
+		t.Fatalf("got %d bytes, want %d", len(body), len(content))
+	}
+	if took := time.Since(start); took < want {
+		t.Errorf("download took %s, want at least %s", took, want)
+	}
+
+	start = time.Now()
+	expectStatus(t, do(fs, http.MethodPut, "/up.txt", "slow-key", content), http.StatusOK)
+	if took := time.Since(start); took < want {
+		t.Errorf("upload took %s, want at least %s", took, want)
+	}
+	if got := readSandboxFile(t, cfg, "up.txt"); got != content {
+		t.Errorf("uploaded %d bytes, want %d", len(got), len(content))
+	}
+
+	// keys without a limit aren't slowed
+	start = time.Now()
+	expectStatus(t, do(fs, http.MethodGet, "/big.txt", testKey, ""), http.StatusOK)
+	if took := time.Since(start); took >= time.Second {
+		t.Errorf("unlimited download took %s", took)
+	}
+}
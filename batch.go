@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/quillaja/sysdlog"
+)
+
+// path of the endpoint deleting many files in one request
+const batchDeletePath = "/_batch/delete"
+
+// maximum size of the list of paths sent to batchDeletePath
+const maxBatchBytes = mebibyte
+
+// batchResult is the outcome of deleting a single path in a batch.
+type batchResult struct {
+	Path  string `json:"path"`
+	Code  int    `json:"code"` // as if the path were deleted alone
+	Error string `json:"error,omitempty"`
+}
+
+// batchDeleteHandler deletes each path in the JSON array in the request body
+// as DELETE would, accepting the same "recursive", "purge" and "prune" query
+// parameters, and replies with a JSON array of the result for each path. A
+// path failing to be deleted doesn't stop the others.
+func (fs *httpfsServer) batchDeleteHandler(w http.ResponseWriter, req *http.Request) {
+	settings := fs.configFor(req)
+	id := requestID(req)
+
+	w.Header().Add("Cache-Control", "no-cache")
+
+	if req.Method == http.MethodOptions {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusNoContent) // with cors headers
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if status, ok := settings.checkUserAgent(req.UserAgent()); !ok {
+		fs.logf(sysdlog.Warning, "[%s] rejected user agent %q\n", id, req.UserAgent())
+		writeJSONError(w, status, "user agent not allowed")
+		return
+	}
+
+	username, key, _ := req.BasicAuth()
+	stored, keycfg, found := settings.findKey(key)
+	release, admitted := fs.authorize(w, req, settings, username, key, stored, keycfg, found, permDelete)
+	if !admitted {
+		return
+	}
+	defer release()
+
+	var paths []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBatchBytes)).Decode(&paths); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "body must be a JSON array of paths")
+		return
+	}
+
+	sandbox := filepath.Join(settings.FileRoot, string(keycfg.Dir))
+	opts := deleteOptionsOf(req, settings)
+
+	results := make([]batchResult, 0, len(paths))
+	for _, resource := range paths {
+		result := batchResult{Path: resource, Code: http.StatusOK}
+		if err := fs.deleteOne(settings, sandbox, resource, opts); err != nil {
+			fs.logf(sysdlog.Err, "[%s] error batch deleting '%s':%s\n", id, resource, err)
+			result.Code, result.Error = deleteErrorStatus(err)
+		} else if settings.WebhookURL != "" {
+			fs.notifyWebhook(settings.WebhookURL, changeEvent{
+				Time:    time.Now().UTC(),
+				Method:  http.MethodDelete,
+				Sandbox: keycfg.Dir,
+				Path:    resource,
+			})
+		}
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// deleteOne deletes the file at the resource path in sandbox as DELETE
+// would, as given by opts.
+func (fs *httpfsServer) deleteOne(settings Config, sandbox, resource string, opts deleteOptions) error {
+	if resource == "" || resource == "/" {
+		return errInvalidPath
+	}
+	localpath, err := sandboxResource(fs.storage, settings, sandbox, resource)
+	if err != nil {
+		return err
+	}
+
+	defer fs.locks.Lock(localpath)()
+	if !fs.beginWrite() {
+		return errShuttingDown
+	}
+	defer fs.writes.Done()
+	return fs.deletePath(settings, sandbox, localpath, opts)
+}
+
+// deleteErrorStatus gives the status and message replied for an error
+// deleting a file.
+func deleteErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, errInvalidPath):
+		return http.StatusBadRequest, errInvalidPath.Error()
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound, "file not found"
+	case errors.Is(err, errDirNotEmpty):
+		return http.StatusConflict, errDirNotEmpty.Error()
+	case errors.Is(err, errSymlink):
+		return http.StatusForbidden, errSymlink.Error()
+	case errors.Is(err, errShuttingDown):
+		return http.StatusServiceUnavailable, errShuttingDown.Error()
+	}
+	return http.StatusInternalServerError, "error deleting file"
+}
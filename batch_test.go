@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// batchDelete POSTs the paths to the batch delete endpoint.
+func batchDelete(fs *httpfsServer, target, key string, paths ...string) *http.Response {
+	body, _ := json.Marshal(paths)
+	return serve(fs, newRequest(http.MethodPost, batchDeletePath+target, key, strings.NewReader(string(body))))
+}
+
+// batchResults decodes the results of a batch delete.
+func batchResults(t *testing.T, resp *http.Response) []batchResult {
+	t.Helper()
+	expectStatus(t, resp, http.StatusOK)
+	var results []batchResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatalf("results aren't JSON: %s", err)
+	}
+	return results
+}
+
+func TestBatchDelete(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "a.txt", "a")
+	writeSandboxFile(t, cfg, "dir/b.txt", "b")
+	writeSandboxFile(t, cfg, "full/c.txt", "c")
+	if err := os.WriteFile(filepath.Join(cfg.FileRoot, "outside.txt"), []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	results := batchResults(t, batchDelete(fs, "", testKey, "/a.txt", "/missing.txt", "/dir/b.txt", "/full", "/../outside.txt", "/"))
+	want := []int{http.StatusOK, http.StatusNotFound, http.StatusOK, http.StatusConflict, http.StatusBadRequest, http.StatusBadRequest}
+	if len(results) != len(want) {
+		t.Fatalf("got results %+v", results)
+	}
+	for i, result := range results {
+		if result.Code != want[i] || (result.Code == http.StatusOK) != (result.Error == "") {
+			t.Errorf("got result %+v, want code %d", result, want[i])
+		}
+	}
+
+	if exists(sandboxFile(cfg, "a.txt")) || exists(sandboxFile(cfg, "dir/b.txt")) {
+		t.Error("files weren't deleted")
+	}
+	if !exists(sandboxFile(cfg, "full/c.txt")) {
+		t.Error("directory was deleted without recursive")
+	}
+	if !exists(filepath.Join(cfg.FileRoot, "outside.txt")) {
+		t.Error("batch delete escaped the sandbox")
+	}
+
+	results = batchResults(t, batchDelete(fs, "?recursive=true", testKey, "/full"))
+	if len(results) != 1 || results[0].Code != http.StatusOK || exists(sandboxFile(cfg, "full")) {
+		t.Errorf("recursive batch delete gave %+v", results)
+	}
+}
+
+func TestBatchDeleteRefused(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys["reader"] = keyConfig{Dir: "sandbox", Perms: permRead}
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "a.txt", "a")
+
+	expectJSONError(t, batchDelete(fs, "", "wrong-key", "/a.txt"), http.StatusUnauthorized)
+	expectJSONError(t, batchDelete(fs, "", "reader", "/a.txt"), http.StatusForbidden)
+	expectJSONError(t, do(fs, http.MethodGet, batchDeletePath, testKey, ""), http.StatusMethodNotAllowed)
+	expectJSONError(t, do(fs, http.MethodPost, batchDeletePath, testKey, `{"not":"a list"}`), http.StatusBadRequest)
+	if !exists(sandboxFile(cfg, "a.txt")) {
+		t.Error("refused batch deleted a file")
+	}
+}
+
+func TestBatchDeleteGated(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.BlockedUserAgents = []string{"badbot"}
+	cfg.MaxConcurrentPerKey = 1
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "a.txt", "a")
+
+	req := newRequest(http.MethodPost, batchDeletePath, testKey, strings.NewReader(`["/a.txt"]`))
+	req.Header.Set("User-Agent", "BadBot/1.0")
+	if resp := serve(fs, req); resp.StatusCode == http.StatusOK {
+		t.Error("batch delete from a blocked user agent allowed")
+	}
+
+	// a request in progress counts toward the key's limit
+	body := &blockingReader{
+		content: strings.NewReader("content"),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	done := make(chan *http.Response)
+	go func() {
+		done <- serve(fs, newRequest(http.MethodPut, "/slow.txt", testKey, body))
+	}()
+	<-body.started
+	expectJSONError(t, batchDelete(fs, "", testKey, "/a.txt"), http.StatusTooManyRequests)
+	close(body.release)
+	expectStatus(t, <-done, http.StatusOK)
+
+	if !exists(sandboxFile(cfg, "a.txt")) {
+		t.Error("gated batch deleted a file")
+	}
+	batchResults(t, batchDelete(fs, "", testKey, "/a.txt"))
+	if exists(sandboxFile(cfg, "a.txt")) {
+		t.Error("batch delete after the limit cleared didn't delete")
+	}
+}
+
+func TestBatchDeleteVirtualHost(t *testing.T) {
+	cfg := testConfig(t)
+	vroot := t.TempDir()
+	cfg.VirtualHosts = map[string]virtualHost{
+		"files.example.com": {FileRoot: vroot, APIKeys: map[apikey]keyConfig{testKey: {Dir: "sandbox", Perms: permAll}}},
+	}
+	cfg.TrashEnabled = true
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "a.txt", "main host")
+	vfile := filepath.Join(vroot, "sandbox", "a.txt")
+	if err := os.MkdirAll(filepath.Dir(vfile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(vfile, []byte("virtual host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req := newRequest(http.MethodPost, batchDeletePath, testKey, strings.NewReader(`["/a.txt"]`))
+	req.Host = "files.example.com"
+	results := batchResults(t, serve(fs, req))
+	if len(results) != 1 || results[0].Code != http.StatusOK {
+		t.Fatalf("got results %+v", results)
+	}
+	if exists(vfile) {
+		t.Error("virtual host's file wasn't deleted")
+	}
+	if !exists(sandboxFile(cfg, "a.txt")) {
+		t.Error("main host's file was deleted")
+	}
+	if entries, _ := os.ReadDir(filepath.Join(vroot, "sandbox", trashDir)); len(entries) != 1 {
+		t.Errorf("virtual host's trash has %d entries", len(entries))
+	}
+}
+
+func TestBatchDeleteHandledLikeDelete(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MetricsEnabled = true
+	cfg.LogFormat = logFormatJSON
+	cfg.CORSAllowedOrigins = []string{"https://app.example"}
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "a.txt", "12345")
+	writeSandboxFile(t, cfg, "b.txt", "123")
+	sandbox := filepath.Join(cfg.FileRoot, "sandbox")
+	if used, err := fs.usage.Used(sandbox); err != nil || used != 8 {
+		t.Fatalf("sandbox uses %d bytes, %v", used, err)
+	}
+
+	req := newRequest(http.MethodPost, batchDeletePath, testKey, strings.NewReader(`["/a.txt"]`))
+	req.Header.Set("Origin", "https://app.example")
+	resp := serve(fs, req)
+	if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "https://app.example" {
+		t.Errorf("batch delete allowed origin %q", origin)
+	}
+	batchResults(t, resp)
+	if used, _ := fs.usage.Used(sandbox); used != 3 {
+		t.Errorf("sandbox uses %d bytes after the batch delete, want 3", used)
+	}
+	preflight := newRequest(http.MethodOptions, batchDeletePath, "", nil)
+	preflight.Header.Set("Origin", "https://app.example")
+	expectStatus(t, serve(fs, preflight), http.StatusNoContent)
+
+	var logged bool
+	for _, rec := range accessRecords(t, cfg) {
+		logged = logged || (rec.Method == http.MethodPost && rec.Path == batchDeletePath && rec.Status == http.StatusOK)
+	}
+	if !logged {
+		t.Error("batch delete wasn't in the access log")
+	}
+
+	resp = serve(fs, newRequest(http.MethodGet, "/metrics", "", nil))
+	if body := readBody(t, resp); !strings.Contains(body, `httpfs_requests_total{method="POST",status="200"} 1`) {
+		t.Errorf("metrics lack the batch delete:\n%s", body)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fraction of the cache which a single file may use. larger files are read
+// from disk so that they don't evict everything else.
+const cacheFileFraction = 16
+
+// fileCache holds the plaintext of recently read files in memory, evicting
+// the least recently used files once it holds more than max bytes. A nil
+// fileCache caches nothing.
+type fileCache struct {
+	mu      sync.Mutex
+	max     int64
+	size    int64
+	order   *list.List               // of *cacheEntry, most recently used first
+	entries map[string]*list.Element // path -> element in order
+}
+
+// cacheEntry is the content of a file as it was when cached.
+type cacheEntry struct {
+	path    string
+	modtime time.Time
+	size    int64 // of the file on disk
+	data    []byte
+}
+
+// newFileCache creates a fileCache holding up to max bytes, or nil if max
+// is not positive.
+func newFileCache(max int64) *fileCache {
+	if max <= 0 {
+		return nil
+	}
+	return &fileCache{
+		max:     max,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// content gives a reader of the plaintext of file, which is at path and was
+// stated as info, from the cache if it holds the file as it is now. Files
+// small enough are read into the cache.
+func (c *fileCache) content(path string, file File, info os.FileInfo, aead cipher.AEAD) (io.ReadSeeker, error) {
+	if data, found := c.get(path, info); found {
+		return bytes.NewReader(data), nil
+	}
+
+	content, size, err := plaintext(file, aead)
+	if err != nil || c == nil || size > c.max/cacheFileFraction {
+		return content, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(content, data); err != nil {
+		return nil, fmt.Errorf("error reading file '%s' into cache: %w", path, err)
+	}
+	c.put(path, info, data)
+	return bytes.NewReader(data), nil
+}
+
+// get finds the cached content of the file at path if it hasn't changed
+// since being cached.
+func (c *fileCache) get(path string, info os.FileInfo) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[path]
+	if !found {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !entry.modtime.Equal(info.ModTime()) || entry.size != info.Size() {
+		c.remove(elem)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.data, true
+}
+
+// put caches data as the content of the file at path, evicting the least
+// recently used files to make room.
+func (c *fileCache) put(path string, info os.FileInfo, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[path]; found {
+		c.remove(elem)
+	}
+	entry := &cacheEntry{path: path, modtime: info.ModTime(), size: info.Size(), data: data}
+	c.entries[path] = c.order.PushFront(entry)
+	c.size += int64(len(data))
+
+	for c.size > c.max {
+		c.remove(c.order.Back())
+	}
+}
+
+// Invalidate discards the cached content of the file at path or, if path is
+// a directory, of every file within it.
+func (c *fileCache) Invalidate(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prefix := path + string(filepath.Separator)
+	for p, elem := range c.entries {
+		if p == path || strings.HasPrefix(p, prefix) {
+			c.remove(elem)
+		}
+	}
+}
+
+// remove discards the cache entry at elem. c.mu must be held.
+func (c *fileCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.path)
+	c.size -= int64(len(entry.data))
+}
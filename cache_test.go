@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// cached reports whether the server's cache holds the file at resource.
+func cached(fs *httpfsServer, cfg Config, resource string) bool {
+	fs.cache.mu.Lock()
+	defer fs.cache.mu.Unlock()
+	_, found := fs.cache.entries[sandboxFile(cfg, resource)]
+	return found
+}
+
+func TestCacheHit(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.CacheBytes = 1 << 20
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "original")
+
+	if body := readBody(t, do(fs, http.MethodGet, "/file.txt", testKey, "")); body != "original" {
+		t.Fatalf("GET gave %q", body)
+	}
+	if !cached(fs, cfg, "file.txt") {
+		t.Fatal("file wasn't cached")
+	}
+
+	// change the file on disk behind the cache's back, keeping its size and
+	// modification time, so only a cache hit gives the old content
+	path := sandboxFile(cfg, "file.txt")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("changed!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, time.Now(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, do(fs, http.MethodGet, "/file.txt", testKey, "")); body != "original" {
+		t.Errorf("second GET gave %q, not the cached content", body)
+	}
+
+	// but a change in modification time misses
+	if err := os.Chtimes(path, time.Now(), info.ModTime().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, do(fs, http.MethodGet, "/file.txt", testKey, "")); body != "changed!" {
+		t.Errorf("GET after a change gave %q", body)
+	}
+}
+
+func TestCacheInvalidatedByWrites(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.CacheBytes = 1 << 20
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "original")
+
+	do(fs, http.MethodGet, "/file.txt", testKey, "")
+	expectStatus(t, do(fs, http.MethodPut, "/file.txt", testKey, "replaced"), http.StatusOK)
+	if cached(fs, cfg, "file.txt") {
+		t.Error("PUT didn't invalidate the cache")
+	}
+	if body := readBody(t, do(fs, http.MethodGet, "/file.txt", testKey, "")); body != "replaced" {
+		t.Errorf("GET after PUT gave %q", body)
+	}
+
+	expectStatus(t, do(fs, http.MethodDelete, "/file.txt", testKey, ""), http.StatusOK)
+	if cached(fs, cfg, "file.txt") {
+		t.Error("DELETE didn't invalidate the cache")
+	}
+	expectStatus(t, do(fs, http.MethodGet, "/file.txt", testKey, ""), http.StatusNotFound)
+}
+
+func TestCacheEviction(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.CacheBytes = 16 * 4 // files of up to 4 bytes are cached
+	fs := newTestServer(t, cfg)
+	names := make([]string, 17)
+	for i := range names {
+		names[i] = "file" + string(rune('a'+i)) + ".txt"
+		writeSandboxFile(t, cfg, names[i], "1234")
+	}
+	writeSandboxFile(t, cfg, "big.txt", "12345")
+
+	for _, name := range names {
+		expectStatus(t, do(fs, http.MethodGet, "/"+name, testKey, ""), http.StatusOK)
+	}
+	if cached(fs, cfg, names[0]) {
+		t.Error("least recently used file wasn't evicted")
+	}
+	for _, name := range names[1:] {
+		if !cached(fs, cfg, name) {
+			t.Errorf("%s was evicted", name)
+		}
+	}
+	if fs.cache.size > cfg.CacheBytes {
+		t.Errorf("cache holds %d bytes, more than its %d", fs.cache.size, cfg.CacheBytes)
+	}
+
+	if body := readBody(t, do(fs, http.MethodGet, "/big.txt", testKey, "")); body != "12345" {
+		t.Errorf("GET of a large file gave %q", body)
+	}
+	if cached(fs, cfg, "big.txt") {
+		t.Error("file over the size threshold was cached")
+	}
+	if !cached(fs, cfg, names[1]) {
+		t.Error("large file evicted others")
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	if c := newFileCache(0); c != nil {
+		t.Error("cache created with no size")
+	}
+	var c *fileCache
+	c.Invalidate("path") // mustn't panic
+	if _, found := c.get("path", nil); found {
+		t.Error("nil cache found content")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// path of the endpoint describing the features the server has enabled
+const capabilitiesPath = "/_capabilities"
+
+// capabilities describes the features of the server, so clients may adapt
+// to its settings.
+type capabilities struct {
+	Methods        []string `json:"methods"`
+	MaxUploadBytes int64    `json:"max_upload_bytes"` // 0 is unlimited
+	Quotas         bool     `json:"quotas"`           // if any key has a quota
+	ListingFormats []string `json:"listing_formats"`
+	IndexFiles     []string `json:"index_files"`
+	Compression    []string `json:"compression"` // of uploads and responses
+	Checksums      []string `json:"checksums"`   // headers uploads are verified against
+	Encryption     bool     `json:"encryption"`
+	Trash          bool     `json:"trash"`
+	Dotfiles       bool     `json:"dotfiles"`
+	CaseSensitive  bool     `json:"case_sensitive"`
+	MaxPathDepth   int      `json:"max_path_depth"`  // 0 is unlimited
+	MaxNameLength  int      `json:"max_name_length"` // 0 is unlimited
+	PublicFiles    bool     `json:"public_files"`
+	Maintenance    bool     `json:"maintenance"`
+}
+
+// capabilitiesHandler replies with the capabilities given by the current
+// settings as JSON. It does not require an api key.
+func (fs *httpfsServer) capabilitiesHandler(w http.ResponseWriter, req *http.Request) {
+	settings := fs.configFor(req)
+
+	quotas := false
+	for _, keycfg := range settings.APIKeys {
+		quotas = quotas || keycfg.QuotaBytes > 0
+	}
+
+	w.Header().Add("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(capabilities{
+		Methods:        strings.Split(supportedMethods, ", "),
+		MaxUploadBytes: settings.MaxUploadBytes,
+		Quotas:         quotas,
+		ListingFormats: []string{listJSON, listPlain, listHTML},
+		IndexFiles:     settings.IndexFiles,
+		Compression:    []string{"gzip"},
+		Checksums:      []string{"Content-MD5", "X-Checksum-SHA256"},
+		Encryption:     settings.EncryptionKey != "",
+		Trash:          settings.TrashEnabled,
+		Dotfiles:       settings.AllowDotfiles,
+		CaseSensitive:  settings.CaseSensitivePaths,
+		MaxPathDepth:   settings.MaxPathDepth,
+		MaxNameLength:  settings.MaxNameLength,
+		PublicFiles:    settings.PublicDir != "",
+		Maintenance:    fs.inMaintenance(),
+	})
+}
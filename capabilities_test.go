@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxUploadBytes = 1000
+	cfg.IndexFiles = []string{"index.html", "index.htm"}
+	cfg.TrashEnabled = true
+	cfg.AllowDotfiles = false
+	cfg.MaxPathDepth = 5
+	cfg.APIKeys["quota-key"] = keyConfig{Dir: "other", Perms: permAll, QuotaBytes: 100}
+	fs := newTestServer(t, cfg)
+
+	get := func() capabilities {
+		t.Helper()
+		resp := do(fs, http.MethodGet, capabilitiesPath, "", "")
+		expectStatus(t, resp, http.StatusOK)
+		var caps capabilities
+		if err := json.NewDecoder(resp.Body).Decode(&caps); err != nil {
+			t.Fatalf("capabilities aren't JSON: %s", err)
+		}
+		return caps
+	}
+
+	want := capabilities{
+		Methods:        strings.Split(supportedMethods, ", "),
+		MaxUploadBytes: 1000,
+		Quotas:         true,
+		ListingFormats: []string{"json", "plain", "html"},
+		IndexFiles:     []string{"index.html", "index.htm"},
+		Compression:    []string{"gzip"},
+		Checksums:      []string{"Content-MD5", "X-Checksum-SHA256"},
+		Trash:          true,
+		CaseSensitive:  true,
+		MaxPathDepth:   5,
+	}
+	if caps := get(); !reflect.DeepEqual(caps, want) {
+		t.Errorf("got capabilities %+v, want %+v", caps, want)
+	}
+
+	fs.setMaintenance(true)
+	if caps := get(); !caps.Maintenance {
+		t.Error("capabilities don't show maintenance mode")
+	}
+}
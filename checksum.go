@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+)
+
+// errChecksumMismatch is returned when an uploaded body doesn't match the
+// checksum given in the request.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumReader hashes everything read through it, and returns
+// errChecksumMismatch instead of io.EOF if the hash isn't the wanted sum.
+type checksumReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(c.h.Sum(nil), c.want) {
+		return n, errChecksumMismatch
+	}
+	return n, err
+}
+
+// checksumBody wraps body to verify it against the checksums in the
+// Content-MD5 (base64) and X-Checksum-SHA256 (hex) headers, if present.
+func checksumBody(header http.Header, body io.Reader) (io.Reader, error) {
+	if sum := header.Get("Content-MD5"); sum != "" {
+		want, err := base64.StdEncoding.DecodeString(sum)
+		if err != nil || len(want) != md5.Size {
+			return nil, fmt.Errorf("invalid Content-MD5 '%s'", sum)
+		}
+		body = &checksumReader{r: body, h: md5.New(), want: want}
+	}
+
+	if sum := header.Get("X-Checksum-SHA256"); sum != "" {
+		want, err := hex.DecodeString(sum)
+		if err != nil || len(want) != sha256.Size {
+			return nil, fmt.Errorf("invalid X-Checksum-SHA256 '%s'", sum)
+		}
+		body = &checksumReader{r: body, h: sha256.New(), want: want}
+	}
+
+	return body, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestChecksums(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "original")
+
+	md5sum := md5.Sum([]byte("new content"))
+	shasum := sha256.Sum256([]byte("new content"))
+	wrong := md5.Sum([]byte("other content"))
+	tests := []struct {
+		name   string
+		header string
+		sum    string
+		status int
+	}{
+		{"wrong md5", "Content-MD5", base64.StdEncoding.EncodeToString(wrong[:]), http.StatusBadRequest},
+		{"invalid md5", "Content-MD5", "not base64", http.StatusBadRequest},
+		{"wrong sha256", "X-Checksum-SHA256", strings.Repeat("00", sha256.Size), http.StatusBadRequest},
+		{"invalid sha256", "X-Checksum-SHA256", "abc", http.StatusBadRequest},
+		{"md5", "Content-MD5", base64.StdEncoding.EncodeToString(md5sum[:]), http.StatusOK},
+		{"sha256", "X-Checksum-SHA256", hex.EncodeToString(shasum[:]), http.StatusOK},
+	}
+	for _, test := range tests {
+		for _, method := range []string{http.MethodPut, http.MethodPost} {
+			writeSandboxFile(t, cfg, "file.txt", "original")
+			req := newRequest(method, "/file.txt", testKey, strings.NewReader("new content"))
+			req.Header.Set(test.header, test.sum)
+			resp := serve(fs, req)
+			if resp.StatusCode != test.status {
+				t.Errorf("%s %s gave %d, want %d", method, test.name, resp.StatusCode, test.status)
+			}
+
+			want := "original"
+			if test.status == http.StatusOK && method == http.MethodPut {
+				want = "new content"
+			} else if test.status == http.StatusOK {
+				want = "originalnew content"
+			}
+			if got := readSandboxFile(t, cfg, "file.txt"); got != want {
+				t.Errorf("%s %s left %q, want %q", method, test.name, got, want)
+			}
+		}
+	}
+
+	req := newRequest(http.MethodPut, "/new.txt", testKey, strings.NewReader("new content"))
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(wrong[:]))
+	expectStatus(t, serve(fs, req), http.StatusBadRequest)
+	if exists(sandboxFile(cfg, "new.txt")) {
+		t.Error("upload with a wrong checksum created the file")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// number of bytes used by http.DetectContentType
+const sniffLen = 512
+
+// detectContentType gets the MIME type of content from the extension of
+// name or, if the extension is unknown, from the first bytes of content.
+// content is left positioned at its start.
+func detectContentType(content io.ReadSeeker, name string) (string, error) {
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype, nil
+	}
+
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(content, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// isCompressible reports if content of the MIME type is likely to be made
+// smaller by compression.
+func isCompressible(ctype string) bool {
+	mediatype, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediatype, "text/"),
+		strings.HasSuffix(mediatype, "+json"),
+		strings.HasSuffix(mediatype, "+xml"):
+		return true
+	}
+	switch mediatype {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// acceptsGzip reports if the request's Accept-Encoding header allows a gzip
+// encoded response.
+func acceptsGzip(req *http.Request) bool {
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipETag makes the ETag for the gzip encoded form of the representation
+// with the given ETag.
+func gzipETag(etag string) string {
+	return strings.TrimSuffix(etag, `"`) + `-gzip"`
+}
+
+// gzipSidecar gives the path of the precompressed file which may be served
+// in place of the file at path within sandbox in store: "<path>.gz", or "" if
+// that is reached through a symlink and FollowSymlinks is false.
+func gzipSidecar(store Storage, settings Config, sandbox, path string) string {
+	sidecar := path + ".gz"
+	if !settings.FollowSymlinks && hasSymlink(store, sandbox, sidecar) {
+		return ""
+	}
+	return sidecar
+}
+
+// serveGzipSidecar serves the precompressed file at sidecar, if there is
+// one, with a Content-Encoding of gzip and the Content-Type already set for
+// the original file. It reports false, serving nothing, if there is no such
+// file or it is older than the original, so may be stale.
+func serveGzipSidecar(store Storage, sidecar string, original os.FileInfo, w http.ResponseWriter, req *http.Request, bufSize int) bool {
+	if sidecar == "" {
+		return false
+	}
+	file, err := store.Open(sidecar)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() || info.ModTime().Before(original.ModTime()) {
+		return false
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("ETag", gzipETag(fileETag(info)))
+	http.ServeContent(w, req, info.Name(), info.ModTime(), contentReader(req.Context(), file, bufSize))
+	return true
+}
+
+// gzipResponseWriter compresses 200 responses written through it. Other
+// responses, such as 304 or errors, are passed through unchanged.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+
+	if code == http.StatusOK {
+		g.Header().Set("Content-Encoding", "gzip")
+		g.Header().Del("Content-Length") // length of uncompressed content
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+// Close flushes any compressed data remaining.
+func (g *gzipResponseWriter) Close() error {
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
+// errInvalidGzip is returned when a gzipped upload can't be decompressed.
+var errInvalidGzip = errors.New("invalid gzip body")
+
+// isGzipEncoded reports if the body described by header has a
+// Content-Encoding of gzip.
+func isGzipEncoded(header http.Header) bool {
+	return strings.EqualFold(strings.TrimSpace(header.Get("Content-Encoding")), "gzip")
+}
+
+// gunzipReader decompresses a gzipped request body. Errors in the gzip
+// stream are reported as errInvalidGzip. Nothing is read from body until the
+// first Read, so that a client expecting 100-continue isn't told to send the
+// body before the request has been checked.
+type gunzipReader struct {
+	gz   *gzip.Reader
+	body io.ReadCloser
+}
+
+// newGunzipReader creates a gunzipReader of body.
+func newGunzipReader(body io.ReadCloser) *gunzipReader {
+	return &gunzipReader{body: body}
+}
+
+func (g *gunzipReader) Read(p []byte) (int, error) {
+	if g.gz == nil {
+		gz, err := gzip.NewReader(g.body)
+		if err != nil {
+			return 0, invalidGzip(err)
+		}
+		g.gz = gz
+	}
+	n, err := g.gz.Read(p)
+	if err != nil && err != io.EOF {
+		err = invalidGzip(err)
+	}
+	return n, err
+}
+
+// invalidGzip reports err reading a gzipped body as errInvalidGzip, unless
+// it's from the limits on the body.
+func invalidGzip(err error) error {
+	if isBodyTooLarge(err) || errors.Is(err, errQuotaExceeded) {
+		return err
+	}
+	return fmt.Errorf("%w: %s", errInvalidGzip, err)
+}
+
+// Close closes the request body.
+func (g *gunzipReader) Close() error {
+	return g.body.Close()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGzipResponse(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	content := strings.Repeat("compress me please ", 1000)
+	writeSandboxFile(t, cfg, "file.txt", content)
+
+	req := newRequest(http.MethodGet, "/file.txt", testKey, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := serve(fs, req)
+	expectStatus(t, resp, http.StatusOK)
+	if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want gzip", enc)
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("decompressed %d bytes, want the %d stored", len(got), len(content))
+	}
+	gzipped := resp.Header.Get("ETag")
+
+	// the identity encoding has a different ETag
+	resp = do(fs, http.MethodGet, "/file.txt", testKey, "")
+	if resp.Header.Get("Content-Encoding") != "" || readBody(t, resp) != content {
+		t.Error("GET without Accept-Encoding wasn't sent as stored")
+	}
+	if resp.Header.Get("ETag") == gzipped {
+		t.Error("gzip and identity encodings have the same ETag")
+	}
+}
+
+func TestGzipNotUsed(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", strings.Repeat("text ", 1000))
+	writeSandboxFile(t, cfg, "image.png", strings.Repeat("\x89PNG", 1000))
+
+	tests := []struct {
+		name     string
+		resource string
+		header   string
+		value    string
+	}{
+		{"range", "/file.txt", "Range", "bytes=0-9"},
+		{"incompressible", "/image.png", "", ""},
+		{"refused", "/file.txt", "Accept-Encoding", "gzip;q=0, identity"},
+	}
+	for _, test := range tests {
+		req := newRequest(http.MethodGet, test.resource, testKey, nil)
+		if test.header != "Accept-Encoding" {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		resp := serve(fs, req)
+		if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+			t.Errorf("%s: got Content-Encoding %q", test.name, enc)
+		}
+	}
+
+	req := newRequest(http.MethodGet, "/file.txt", testKey, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-9")
+	resp := serve(fs, req)
+	expectStatus(t, resp, http.StatusPartialContent)
+	if body := readBody(t, resp); body != "text text " {
+		t.Errorf("range gave %q", body)
+	}
+}
+
+// gzipped compresses content.
+func gzipped(t *testing.T, content string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGzipUpload(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	content := strings.Repeat("compressed upload ", 1000)
+
+	for _, method := range []string{http.MethodPut, http.MethodPost} {
+		resource := "/" + method + ".txt"
+		req := newRequest(method, resource, testKey, bytes.NewReader(gzipped(t, content)))
+		req.Header.Set("Content-Encoding", "gzip")
+		expectStatus(t, serve(fs, req), http.StatusOK)
+		if got := readSandboxFile(t, cfg, resource); got != content {
+			t.Errorf("%s stored %d bytes, want the %d decompressed", method, len(got), len(content))
+		}
+	}
+}
+
+func TestInvalidGzipUpload(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "original")
+	truncated := gzipped(t, strings.Repeat("compressed upload ", 1000))
+	truncated = truncated[:len(truncated)/2]
+
+	for _, body := range [][]byte{[]byte("not gzip at all"), truncated} {
+		for _, method := range []string{http.MethodPut, http.MethodPost} {
+			req := newRequest(method, "/file.txt", testKey, bytes.NewReader(body))
+			req.Header.Set("Content-Encoding", "gzip")
+			expectJSONError(t, serve(fs, req), http.StatusBadRequest)
+			if got := readSandboxFile(t, cfg, "file.txt"); got != "original" {
+				t.Errorf("%s of invalid gzip left %q", method, got)
+			}
+		}
+	}
+}
+
+func TestGzipUploadSizeLimit(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxUploadBytes = 1000
+	fs := newTestServer(t, cfg)
+
+	// small on the wire, but too large once decompressed
+	req := newRequest(http.MethodPut, "/bomb.txt", testKey, bytes.NewReader(gzipped(t, strings.Repeat("x", 100000))))
+	req.Header.Set("Content-Encoding", "gzip")
+	expectStatus(t, serve(fs, req), http.StatusRequestEntityTooLarge)
+	if exists(sandboxFile(cfg, "bomb.txt")) {
+		t.Error("oversized decompressed upload was stored")
+	}
+}
+
+func TestGzipSidecar(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	original := strings.Repeat("original ", 100)
+	writeSandboxFile(t, cfg, "file.txt", original)
+	writeSandboxFile(t, cfg, "file.txt.gz", string(gzipped(t, "precompressed")))
+	writeSandboxFile(t, cfg, "other.txt", original)
+
+	// get gives the decompressed content of resource requested accepting gzip,
+	// or as sent if not gzipped
+	get := func(resource string) string {
+		t.Helper()
+		req := newRequest(http.MethodGet, resource, testKey, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := serve(fs, req)
+		expectStatus(t, resp, http.StatusOK)
+		if ctype := resp.Header.Get("Content-Type"); ctype != "text/plain; charset=utf-8" {
+			t.Errorf("%s got Content-Type %q", resource, ctype)
+		}
+		if resp.Header.Get("Content-Encoding") != "gzip" {
+			return readBody(t, resp)
+		}
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if got := get("/file.txt"); got != "precompressed" {
+		t.Errorf("present sidecar not served, got %q", got)
+	}
+	if got := readBody(t, do(fs, http.MethodGet, "/file.txt", testKey, "")); got != original {
+		t.Errorf("sidecar served to a client not accepting gzip: %q", got)
+	}
+	if got := get("/other.txt"); got != original {
+		t.Errorf("file without a sidecar gave %q", got)
+	}
+
+	// a sidecar older than the file may be stale
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(sandboxFile(cfg, "file.txt.gz"), past, past); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("/file.txt"); got != original {
+		t.Errorf("stale sidecar served, got %q", got)
+	}
+
+	// sidecars reached through symlinks are only served if they are followed
+	writeSandboxFile(t, cfg, "outside/other.txt.gz", string(gzipped(t, "linked")))
+	if err := os.Symlink(sandboxFile(cfg, "outside/other.txt.gz"), sandboxFile(cfg, "other.txt.gz")); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("/other.txt"); got != original {
+		t.Errorf("symlinked sidecar served, got %q", got)
+	}
+	cfg.FollowSymlinks = true
+	fs = newTestServer(t, cfg)
+	if got := get("/other.txt"); got != "linked" {
+		t.Errorf("followed symlinked sidecar not served, got %q", got)
+	}
+}
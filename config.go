@@ -1,11 +1,31 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// config path which reads the config from environment variables
+const envConfigPath = "env"
+
+// 1 mebibyte
+const mebibyte = 1 << 20
+
+// server timeout used when not configured
+const defaultTimeout = 30 * time.Second
+
+// time allowed for requests to finish on shutdown when not configured
+const defaultShutdownTimeout = 1 * time.Minute
+
 // common http ports
 const (
 	httpPort  = 80
@@ -15,6 +35,200 @@ const (
 type apikey string
 type directory string
 
+// permission is a set of operations an api key may perform.
+type permission uint8
+
+// permissions which can be granted to an api key. In config files they are
+// written as a string containing any of the letters 'r', 'w', and 'd'.
+const (
+	permRead   permission = 1 << iota // GET, HEAD, PROPFIND, and COPY with permWrite
+	permWrite                         // POST, PUT, PATCH, and MOVE with permDelete
+	permDelete                        // DELETE
+
+	permAll = permRead | permWrite | permDelete
+)
+
+// letters used to represent each permission in config files
+var permLetters = []struct {
+	perm   permission
+	letter rune
+}{
+	{permRead, 'r'},
+	{permWrite, 'w'},
+	{permDelete, 'd'},
+}
+
+// Has reports if p includes all of the permissions in q.
+func (p permission) Has(q permission) bool {
+	return p&q == q
+}
+
+// String returns the permissions in the config file form, eg "rw".
+func (p permission) String() string {
+	var b strings.Builder
+	for _, pl := range permLetters {
+		if p.Has(pl.perm) {
+			b.WriteRune(pl.letter)
+		}
+	}
+	return b.String()
+}
+
+// MarshalJSON writes the permissions as a string.
+func (p permission) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// UnmarshalJSON reads permissions from a string such as "rwd".
+func (p *permission) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+
+	*p = 0
+	for _, r := range str {
+		found := false
+		for _, pl := range permLetters {
+			if r == pl.letter {
+				*p |= pl.perm
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown permission '%c' in '%s'", r, str)
+		}
+	}
+	return nil
+}
+
+// fileMode is a unix permission mode, written in config files as an octal
+// string such as "0644". The setuid, setgid and sticky bits may be given as
+// in "2775".
+type fileMode os.FileMode
+
+// special unix mode bits and the os.FileMode bits which hold them
+var specialModes = []struct {
+	unix uint32
+	mode os.FileMode
+}{
+	{04000, os.ModeSetuid},
+	{02000, os.ModeSetgid},
+	{01000, os.ModeSticky},
+}
+
+// MarshalJSON writes the mode as an octal string.
+func (m fileMode) MarshalJSON() ([]byte, error) {
+	unix := uint32(os.FileMode(m).Perm())
+	for _, special := range specialModes {
+		if os.FileMode(m)&special.mode != 0 {
+			unix |= special.unix
+		}
+	}
+	return json.Marshal(fmt.Sprintf("%04o", unix))
+}
+
+// UnmarshalJSON reads a mode from an octal string such as "0664".
+func (m *fileMode) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	unix, err := strconv.ParseUint(str, 8, 32)
+	if err != nil || unix > 07777 {
+		return fmt.Errorf("invalid file mode '%s'", str)
+	}
+	mode := os.FileMode(unix).Perm()
+	for _, special := range specialModes {
+		if uint32(unix)&special.unix != 0 {
+			mode |= special.mode
+		}
+	}
+	*m = fileMode(mode)
+	return nil
+}
+
+// rootResponse is the configured reply to requests for "/" without an api
+// key: a redirect to Redirect if given, or else Body.
+type rootResponse struct {
+	Redirect    string
+	Body        string
+	ContentType string // of Body, text/plain if empty
+}
+
+// virtualHost holds the settings which differ for requests to a host.
+type virtualHost struct {
+	FileRoot     string
+	APIKeys      map[apikey]keyConfig
+	PublicDir    directory
+	RootResponse *rootResponse
+}
+
+// keyConfig holds the settings for a single api key.
+type keyConfig struct {
+	// "sandbox" subdirectory of FileRoot
+	Dir directory `json:"dir"`
+
+	// operations the key may perform
+	Perms permission `json:"perms"`
+
+	// maximum bytes of storage the key may use in its directory. 0 is unlimited.
+	QuotaBytes int64 `json:"quota"`
+
+	// maximum number of files the key may store in its directory. 0 is unlimited.
+	MaxFiles int64 `json:"max_files"`
+
+	// secret used to sign urls granting access without the key. signed
+	// urls can't be made if empty.
+	SigningSecret string `json:"signing_secret"`
+
+	// extensions, eg ".txt", of the files the key may write. any extension
+	// is allowed if empty. files with a denied extension are never allowed.
+	AllowedExtensions []string `json:"allowed_extensions"`
+	DeniedExtensions  []string `json:"denied_extensions"`
+
+	// bytes a second the key may upload and download, in total over all its
+	// requests. 0 is unlimited.
+	BandwidthBytesPerSec int64 `json:"bandwidth_bytes_per_sec"`
+}
+
+// allowsName reports if the key may write a file with the name, judged by
+// its extension ignoring case.
+func (k keyConfig) allowsName(name string) bool {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	matches := func(exts []string) bool {
+		for _, e := range exts {
+			if strings.ToLower(strings.TrimPrefix(e, ".")) == ext {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(k.DeniedExtensions) {
+		return false
+	}
+	return len(k.AllowedExtensions) == 0 || matches(k.AllowedExtensions)
+}
+
+// UnmarshalJSON reads a keyConfig from either an object or, for
+// compatibility with older config files, a bare directory string. A bare
+// string or an object without "perms" is given all permissions.
+func (k *keyConfig) UnmarshalJSON(data []byte) error {
+	var dir directory
+	if err := json.Unmarshal(data, &dir); err == nil {
+		*k = keyConfig{Dir: dir, Perms: permAll}
+		return nil
+	}
+
+	type plain keyConfig // avoids recursing into this method
+	v := plain{Perms: permAll}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*k = keyConfig(v)
+	return nil
+}
+
 // Config for the application.
 type Config struct {
 	// Address:Port on which to listen
@@ -27,8 +241,186 @@ type Config struct {
 	TLSCertPath string
 	TLSKeyPath  string
 
-	// api key -> directory map
-	APIKeys map[apikey]directory
+	// oldest TLS version accepted, one of "1.0", "1.1", "1.2" or "1.3".
+	// defaults to "1.2". changes require a restart.
+	TLSMinVersion string
+
+	// names of the cipher suites accepted for TLS 1.2 and earlier, eg
+	// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". defaults to Go's choice if
+	// not given. changes require a restart.
+	TLSCipherSuites []string
+
+	// domains for which certificates are obtained and renewed automatically
+	// from Let's Encrypt, if the TLS certificate paths aren't given. the
+	// certificates are kept in ACMECacheDir. changes require a restart.
+	ACMEDomains  []string
+	ACMECacheDir string
+
+	// serve HTTP/2 to clients supporting it over TLS. defaults to true if
+	// not given. changes require a restart.
+	HTTP2Enabled bool
+
+	// also serve HTTP/2 without TLS (h2c), for clients on trusted networks
+	// which know the server supports it. only used with HTTP2Enabled and
+	// without TLS. changes require a restart.
+	H2CEnabled bool
+
+	// Address:Port on which to redirect http requests to https. only used
+	// with TLS. changes require a restart.
+	HTTPRedirectAddress string
+
+	// server timeouts in seconds. 0 uses the default of 30 seconds.
+	ReadTimeoutSeconds  int
+	WriteTimeoutSeconds int
+	IdleTimeoutSeconds  int
+
+	// seconds allowed for requests in progress to finish when shutting
+	// down. 0 uses the default of 60 seconds.
+	ShutdownTimeoutSeconds int
+
+	// maximum size in bytes of an uploaded file. 0 is unlimited.
+	MaxUploadBytes int64
+
+	// size in bytes of the buffer used to copy uploads into files and files
+	// to clients. 32 KiB, as for io.Copy, if not given.
+	CopyBufferBytes int
+
+	// permissions of created files and directories, as octal strings.
+	// 0644 and 0755 are used if not given. DirPerm may include the setgid
+	// bit, eg 2775, so files created in shared directories keep their group.
+	FilePerm fileMode
+	DirPerm  fileMode
+
+	// bytes of memory used to cache the content of frequently read files.
+	// files larger than 1/16 of this aren't cached. 0 disables the cache.
+	// changes require a restart.
+	CacheBytes int64
+
+	// names of files served in place of a listing when a directory holding
+	// one is requested. defaults to index.html if not given.
+	IndexFiles []string
+
+	// move deleted files to a trash directory in the sandbox rather than
+	// removing them. removed permanently with DELETE ?purge=true, and
+	// counted toward the quota until then.
+	TrashEnabled bool
+
+	// hours after which files in the trash are removed permanently, checked
+	// hourly. kept forever if 0.
+	TrashRetentionHours int
+
+	// after DELETE, remove the parent directories left empty, up to but not
+	// including the sandbox, as if ?prune=true were given.
+	PruneEmptyDirs bool
+
+	// allow writing files or directories whose names start with '.'.
+	// defaults to true if not given.
+	AllowDotfiles bool
+
+	// serve, write and delete files through symlinks within FileRoot, which
+	// may lead outside the sandboxes. requests for paths through symlinks
+	// are refused if false.
+	FollowSymlinks bool
+
+	// refuse POST and PUT requests with an empty body, which would write an
+	// empty file
+	RejectEmptyUploads bool
+
+	// refuse requests without a User-Agent header, and those whose
+	// User-Agent contains any of BlockedUserAgents, ignoring case.
+	RequireUserAgent  bool
+	BlockedUserAgents []string
+
+	// create the directories of all api keys, and PublicDir, at startup
+	// rather than when first written to.
+	EnsureSandboxes bool
+
+	// treat paths differing only in case as different files. if false,
+	// writes are refused to paths differing only in case from an existing
+	// file, avoiding collisions on case-insensitive filesystems. defaults to
+	// true if not given.
+	CaseSensitivePaths bool
+
+	// maximum depth, in names separated by '/', of the paths which may be
+	// written, and length in bytes of each name. 0 is unlimited.
+	MaxPathDepth  int
+	MaxNameLength int
+
+	// secret from which the key used to encrypt files on disk is derived.
+	// files are not encrypted if empty.
+	EncryptionKey string
+
+	// origins allowed to make cross-origin requests. any origin is allowed
+	// if empty.
+	CORSAllowedOrigins []string
+
+	// value of the Server header of all responses. omitted if empty.
+	ServerHeader string
+
+	// requests per second allowed for each api key, with bursts of up to
+	// RateLimitBurst requests. 0 is unlimited.
+	RateLimitPerSecond float64
+	RateLimitBurst     int
+
+	// requests which may be in progress at once for each api key. 0 is
+	// unlimited.
+	MaxConcurrentPerKey int
+
+	// connections which may be open at once. further connections wait to be
+	// accepted until others close. 0 is unlimited. changes require a restart.
+	MaxConnections int
+
+	// on shutdown, wait for in-flight writes to finish even after the
+	// shutdown timeout has passed
+	DrainWrites bool
+
+	// format of the per-request access log, "text" or "json"
+	LogFormat string
+
+	// log only 1 in LogSampleRate successful requests. errors and refused
+	// requests are always logged. 0 or 1 logs every request.
+	LogSampleRate int
+
+	// file to which the log is appended, stdout if empty, and the least
+	// severe level logged: one of emerg, alert, crit, err, warning, notice,
+	// info (the default), or debug. changes require a restart.
+	LogFile  string
+	LogLevel string
+
+	// serve prometheus metrics at /metrics, on MetricsAddress if given or
+	// otherwise on Address. changes require a restart.
+	MetricsEnabled bool
+	MetricsAddress string
+
+	// url to which a JSON event is posted after each change to a file
+	WebhookURL string
+
+	// subdirectory of FileRoot which may be read with GET and HEAD without
+	// an api key. nothing is public if empty.
+	PublicDir directory
+
+	// reply to GET and HEAD of "/" without an api key, in place of asking
+	// for one or listing PublicDir. unset if nil.
+	RootResponse *rootResponse
+
+	// settings replacing FileRoot, APIKeys, PublicDir and RootResponse for
+	// requests to each host name, ignoring case and any port. requests to
+	// other hosts use the settings above.
+	VirtualHosts map[string]virtualHost
+
+	// api key -> directory and permissions map
+	APIKeys map[apikey]keyConfig
+
+	// file holding more api keys in the same form as APIKeys. keys in it
+	// replace those of the same name in APIKeys.
+	APIKeysFile string
+
+	// file in which the time each api key was last used is kept across
+	// restarts, written on shutdown. not kept if empty.
+	AccessTimesFile string
+
+	// keys allowed to make requests under /_admin/, plaintext or hashed
+	AdminKeys []apikey
 }
 
 // OpenConfig file at the given path.
@@ -37,22 +429,395 @@ func OpenConfig(path string) (s Config, err error) {
 	if err != nil {
 		return Config{}, err
 	}
+	s.AllowDotfiles = true
+	s.IndexFiles = defaultIndexFiles()
+	s.HTTP2Enabled = true
+	s.CaseSensitivePaths = true
 	err = json.Unmarshal(data, &s)
 	if err != nil {
 		return Config{}, err
 	}
+	err = s.loadAPIKeysFile()
+	if err != nil {
+		return Config{}, err
+	}
+	err = s.applyEnv()
+	if err != nil {
+		return Config{}, err
+	}
+	err = s.Validate()
+	if err != nil {
+		return Config{}, err
+	}
+	return
+}
+
+// ConfigFromEnv creates a Config using only environment variables.
+func ConfigFromEnv() (s Config, err error) {
+	s.AllowDotfiles = true
+	s.IndexFiles = defaultIndexFiles()
+	s.HTTP2Enabled = true
+	s.CaseSensitivePaths = true
+	err = s.applyEnv()
+	if err != nil {
+		return Config{}, err
+	}
+	err = s.Validate()
+	if err != nil {
+		return Config{}, err
+	}
 	return
 }
 
+// loadConfig gets the Config from the file at path, or from the environment
+// if path is "env".
+func loadConfig(path string) (Config, error) {
+	if path == envConfigPath {
+		return ConfigFromEnv()
+	}
+	return OpenConfig(path)
+}
+
+// loadAPIKeysFile adds the keys in APIKeysFile, if given, to APIKeys.
+func (s *Config) loadAPIKeysFile() error {
+	if s.APIKeysFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.APIKeysFile)
+	if err != nil {
+		return fmt.Errorf("error reading api keys file '%s': %w", s.APIKeysFile, err)
+	}
+	var keys map[apikey]keyConfig
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("error parsing api keys file '%s': %w", s.APIKeysFile, err)
+	}
+
+	if s.APIKeys == nil {
+		s.APIKeys = make(map[apikey]keyConfig, len(keys))
+	}
+	for key, keycfg := range keys {
+		s.APIKeys[key] = keycfg
+	}
+	return nil
+}
+
+// applyEnv overrides settings with those given in environment variables.
+// Keys in HTTPFS_API_KEYS, a comma separated list of key=dir, are added to
+// APIKeys with all permissions.
+func (s *Config) applyEnv() error {
+	for env, field := range map[string]*string{
+		"HTTPFS_ADDRESS":  &s.Address,
+		"HTTPFS_FILEROOT": &s.FileRoot,
+		"HTTPFS_TLS_CERT": &s.TLSCertPath,
+		"HTTPFS_TLS_KEY":  &s.TLSKeyPath,
+	} {
+		if value, found := os.LookupEnv(env); found {
+			*field = value
+		}
+	}
+
+	list := os.Getenv("HTTPFS_API_KEYS")
+	if list == "" {
+		return nil
+	}
+	if s.APIKeys == nil {
+		s.APIKeys = make(map[apikey]keyConfig)
+	}
+	for _, entry := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("HTTPFS_API_KEYS entry '%s' is not of the form key=dir", entry)
+		}
+		s.APIKeys[apikey(parts[0])] = keyConfig{Dir: directory(parts[1]), Perms: permAll}
+	}
+	return nil
+}
+
+// Validate checks the Config for problems, returning an error describing
+// all of them. FileRoot is created if it doesn't exist.
+func (s Config) Validate() error {
+	var problems []string
+
+	if s.Address == "" {
+		problems = append(problems, "Address is empty")
+	}
+
+	problems = append(problems, s.sandboxProblems()...)
+	hosts := make([]string, 0, len(s.VirtualHosts))
+	for host := range s.VirtualHosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		for _, problem := range s.forHost(host).sandboxProblems() {
+			problems = append(problems, fmt.Sprintf("virtual host '%s': %s", host, problem))
+		}
+	}
+
+	if os.FileMode(s.FilePerm)&^os.ModePerm != 0 {
+		problems = append(problems, "FilePerm may not include the setuid, setgid or sticky bits")
+	}
+
+	for _, key := range s.AdminKeys {
+		if isHashedKey(key) {
+			if _, _, err := parseHashedKey(key); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+
+	for _, path := range []string{s.TLSCertPath, s.TLSKeyPath} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Sprintf("TLS file '%s' is not accessible: %s", path, err))
+		}
+	}
+
+	if _, err := s.tlsConfig(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if s.usesACME() && s.ACMECacheDir == "" {
+		problems = append(problems, "ACMECacheDir is empty")
+	}
+
+	for _, name := range s.IndexFiles {
+		if name == "" || name != filepath.Base(name) || name == ".." {
+			problems = append(problems, fmt.Sprintf("index file '%s' is not a file name", name))
+		}
+	}
+
+	if _, err := parseLogLevel(s.LogLevel); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ensureSandboxes creates the sandbox directories of all api keys, and
+// PublicDir if given, that don't already exist in store, for every virtual
+// host too.
+func (s Config) ensureSandboxes(store Storage) error {
+	for _, sandbox := range s.sandboxes() {
+		if err := store.MakeDirs(sandbox, s.perms()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sandboxes gives the paths of the sandbox directories of all api keys, and
+// PublicDir if given, for every virtual host too.
+func (s Config) sandboxes() []string {
+	dirs := make([]string, 0, len(s.APIKeys)+1)
+	for _, keycfg := range s.APIKeys {
+		dirs = append(dirs, filepath.Join(s.FileRoot, string(keycfg.Dir)))
+	}
+	if s.PublicDir != "" {
+		dirs = append(dirs, filepath.Join(s.FileRoot, string(s.PublicDir)))
+	}
+	for host := range s.VirtualHosts {
+		vhost := s.forHost(host)
+		vhost.VirtualHosts = nil
+		dirs = append(dirs, vhost.sandboxes()...)
+	}
+	return dirs
+}
+
+// fileRoots gives FileRoot and that of every virtual host.
+func (s Config) fileRoots() []string {
+	roots := []string{s.FileRoot}
+	for host := range s.VirtualHosts {
+		roots = append(roots, s.forHost(host).FileRoot)
+	}
+	return roots
+}
+
+// sandboxProblems checks FileRoot, which is created by the server if
+// missing, and the api keys for directories within it, giving any problems
+// found. Nothing is changed on disk.
+func (s Config) sandboxProblems() []string {
+	var problems []string
+
+	if s.FileRoot == "" {
+		problems = append(problems, "FileRoot is empty")
+	} else if info, err := os.Stat(s.FileRoot); err == nil && !info.IsDir() {
+		problems = append(problems, fmt.Sprintf("FileRoot '%s' is not a directory", s.FileRoot))
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		problems = append(problems, fmt.Sprintf("FileRoot '%s' can't be used: %s", s.FileRoot, err))
+	}
+
+	if s.PublicDir != "" && outsideRoot(s.FileRoot, s.PublicDir) {
+		problems = append(problems, fmt.Sprintf("PublicDir '%s' is outside FileRoot", s.PublicDir))
+	}
+
+	keys := make([]string, 0, len(s.APIKeys))
+	for key := range s.APIKeys {
+		keys = append(keys, string(key))
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "" {
+			problems = append(problems, fmt.Sprintf("api key for directory '%s' is empty", s.APIKeys[""].Dir))
+		}
+		if dir := s.APIKeys[apikey(key)].Dir; dir == "" {
+			problems = append(problems, fmt.Sprintf("api key '%s' has an empty directory", key))
+		} else if isRootDir(dir) {
+			problems = append(problems, fmt.Sprintf("api key '%s' has directory '%s', which is FileRoot itself", key, dir))
+		} else if outsideRoot(s.FileRoot, dir) {
+			problems = append(problems, fmt.Sprintf("api key '%s' has directory '%s', which is outside FileRoot", key, dir))
+		}
+		if isHashedKey(apikey(key)) {
+			if _, _, err := parseHashedKey(apikey(key)); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+
+	return problems
+}
+
+// forHost gives the settings for requests to host, which are those of the
+// matching VirtualHosts entry in place of the top level ones, if any.
+func (s Config) forHost(host string) Config {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	for name, vhost := range s.VirtualHosts {
+		if strings.EqualFold(name, host) {
+			s.FileRoot = vhost.FileRoot
+			s.APIKeys = vhost.APIKeys
+			s.PublicDir = vhost.PublicDir
+			s.RootResponse = vhost.RootResponse
+			break
+		}
+	}
+	return s
+}
+
+// isRootDir reports if the directory is FileRoot itself, such as "." or "/".
+func isRootDir(dir directory) bool {
+	clean := filepath.Clean(string(dir))
+	return clean == "." || clean == string(filepath.Separator)
+}
+
+// outsideRoot reports if dir is absolute or, joined to root, resolves to a
+// directory outside of root.
+func outsideRoot(root string, dir directory) bool {
+	if filepath.IsAbs(string(dir)) {
+		return true
+	}
+	rel, err := filepath.Rel(root, filepath.Join(root, string(dir)))
+	return err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Check goes further than Validate, verifying that the TLS certificate and
+// key can be loaded, that FileRoot is writable, and that the log can be
+// opened, without leaving anything behind.
+func (s Config) Check() error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+
+	if s.TLSCertPath != "" && s.TLSKeyPath != "" {
+		if _, err := tls.LoadX509KeyPair(s.TLSCertPath, s.TLSKeyPath); err != nil {
+			return fmt.Errorf("error loading TLS certificate: %w", err)
+		}
+	}
+
+	// a missing FileRoot is created in the nearest directory which exists
+	dir := s.FileRoot
+	for _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) && filepath.Dir(dir) != dir; _, err = os.Stat(dir) {
+		dir = filepath.Dir(dir)
+	}
+	probe, err := os.CreateTemp(dir, ".httpfs-check-*")
+	if err != nil {
+		return fmt.Errorf("FileRoot '%s' is not writable: %w", s.FileRoot, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	// the log is opened as the server would, but left as it was found
+	if _, err := parseLogLevel(s.LogLevel); err != nil {
+		return err
+	}
+	if s.LogFile != "" {
+		_, statErr := os.Stat(s.LogFile)
+		file, err := os.OpenFile(s.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, filePerm)
+		if err != nil {
+			return fmt.Errorf("error opening log file '%s': %w", s.LogFile, err)
+		}
+		file.Close()
+		if errors.Is(statErr, os.ErrNotExist) {
+			os.Remove(s.LogFile)
+		}
+	}
+
+	return nil
+}
+
 // DefaultConfig returns a populated 'default'.
 func DefaultConfig() Config {
 	return Config{
-		Address:     fmt.Sprintf(":%d", httpsPort),
-		FileRoot:    "files",
-		TLSCertPath: "path/to/certificate",
-		TLSKeyPath:  "path/to/key",
-		APIKeys:     map[apikey]directory{"api_key": "dir_for_this_key"},
+		Address:             fmt.Sprintf(":%d", httpsPort),
+		FileRoot:            "files",
+		TLSCertPath:         "path/to/certificate",
+		TLSKeyPath:          "path/to/key",
+		ReadTimeoutSeconds:  int(defaultTimeout / time.Second),
+		WriteTimeoutSeconds: int(defaultTimeout / time.Second),
+		IdleTimeoutSeconds:  int(defaultTimeout / time.Second),
+		MaxUploadBytes:      100 * mebibyte,
+		AllowDotfiles:       true,
+		IndexFiles:          defaultIndexFiles(),
+		HTTP2Enabled:        true,
+		CaseSensitivePaths:  true,
+		LogFormat:           logFormatText,
+
+		ShutdownTimeoutSeconds: int(defaultShutdownTimeout / time.Second),
+		APIKeys: map[apikey]keyConfig{
+			"api_key": {Dir: "dir_for_this_key", Perms: permAll},
+		},
+	}
+}
+
+// perms gets the permissions for created files and directories, using
+// filePerm and dirPerm if unset.
+func (s Config) perms() filePerms {
+	perms := filePerms{File: filePerm, Dir: dirPerm}
+	if s.FilePerm != 0 {
+		perms.File = os.FileMode(s.FilePerm)
+	}
+	if s.DirPerm != 0 {
+		perms.Dir = os.FileMode(s.DirPerm)
+	}
+	return perms
+}
+
+// defaultIndexFiles gives the IndexFiles used when none are configured.
+func defaultIndexFiles() []string {
+	return []string{"index.html"}
+}
+
+// timeout converts a timeout setting in seconds to a duration, using
+// defaultTimeout if unset.
+func (s Config) timeout(seconds int) time.Duration {
+	if seconds <= 0 {
+		return defaultTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// shutdownTimeout gives the time allowed for requests to finish on
+// shutdown, using defaultShutdownTimeout if unset.
+func (s Config) shutdownTimeout() time.Duration {
+	if s.ShutdownTimeoutSeconds <= 0 {
+		return defaultShutdownTimeout
 	}
+	return time.Duration(s.ShutdownTimeoutSeconds) * time.Second
 }
 
 // Save Config to the given file.
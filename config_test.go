@@ -0,0 +1,486 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeConfigFile saves cfg as JSON in a temporary file, giving its path.
+func writeConfigFile(t *testing.T, cfg Config) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, filePerm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReloadConfig(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys = map[apikey]keyConfig{"old": {Dir: "sandbox", Perms: permAll}}
+	path := writeConfigFile(t, cfg)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+
+	// keep requests coming while the keys are swapped
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				resp := do(fs, http.MethodGet, "/file.txt", "old", "")
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+					t.Errorf("got status %d during reload", resp.StatusCode)
+					return
+				}
+			}
+		}()
+	}
+
+	cfg.APIKeys = map[apikey]keyConfig{"new": {Dir: "sandbox", Perms: permAll}}
+	data, _ := json.Marshal(cfg)
+	if err := os.WriteFile(path, data, filePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.ReloadConfig(path); err != nil {
+		t.Fatalf("error reloading: %s", err)
+	}
+	close(stop)
+	wg.Wait()
+
+	resp := do(fs, http.MethodGet, "/file.txt", "new", "")
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); body != "content" {
+		t.Errorf("GET with added key gave %q", body)
+	}
+	expectStatus(t, do(fs, http.MethodGet, "/file.txt", "old", ""), http.StatusUnauthorized)
+}
+
+func TestReloadKeepsAddress(t *testing.T) {
+	cfg := testConfig(t)
+	path := writeConfigFile(t, cfg)
+	fs := newTestServer(t, cfg)
+
+	changed := cfg
+	changed.Address = "127.0.0.1:1"
+	changed.FileRoot = filepath.Join(t.TempDir(), "other")
+	data, _ := json.Marshal(changed)
+	if err := os.WriteFile(path, data, filePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.ReloadConfig(path); err != nil {
+		t.Fatalf("error reloading: %s", err)
+	}
+
+	settings := fs.config()
+	if settings.Address != cfg.Address {
+		t.Errorf("Address changed to %q on reload", settings.Address)
+	}
+	if settings.FileRoot != changed.FileRoot {
+		t.Errorf("FileRoot is %q after reload, want %q", settings.FileRoot, changed.FileRoot)
+	}
+}
+
+func TestReloadInvalidConfigKeepsSettings(t *testing.T) {
+	cfg := testConfig(t)
+	path := writeConfigFile(t, cfg)
+	fs := newTestServer(t, cfg)
+
+	if err := os.WriteFile(path, []byte("{not json"), filePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.ReloadConfig(path); err == nil {
+		t.Fatal("reloaded an invalid config")
+	}
+	expectStatus(t, do(fs, http.MethodPut, "/file.txt", testKey, "still served"), http.StatusOK)
+}
+
+func TestKeyConfigUnmarshal(t *testing.T) {
+	var keys map[apikey]keyConfig
+	data := `{
+		"bare": "hamburger",
+		"object": {"dir": "hotdog", "perms": "r"},
+		"noperms": {"dir": "hotdog", "quota": 10}
+	}`
+	if err := json.Unmarshal([]byte(data), &keys); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys["bare"]; got.Dir != "hamburger" || got.Perms != permAll {
+		t.Errorf("bare directory gave %+v, want all permissions on hamburger", got)
+	}
+	if got := keys["object"]; got.Dir != "hotdog" || got.Perms != permRead {
+		t.Errorf("object gave %+v, want read on hotdog", got)
+	}
+	if got := keys["noperms"]; got.Perms != permAll || got.QuotaBytes != 10 {
+		t.Errorf("object without perms gave %+v, want all permissions", got)
+	}
+
+	if err := json.Unmarshal([]byte(`{"bad": {"dir": "x", "perms": "rx"}}`), &keys); err == nil {
+		t.Error("unknown permission letter was accepted")
+	}
+}
+
+func TestPermissionString(t *testing.T) {
+	for _, p := range []string{"", "r", "w", "d", "rw", "rwd"} {
+		var perm permission
+		if err := perm.UnmarshalJSON([]byte(`"` + p + `"`)); err != nil {
+			t.Fatal(err)
+		}
+		if perm.String() != p {
+			t.Errorf("permissions %q are written as %q", p, perm.String())
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := testConfig(t)
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid config failed: %s", err)
+	}
+
+	notDir := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(notDir, nil, filePerm)
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		problem string
+	}{
+		{"no address", func(c *Config) { c.Address = "" }, "Address is empty"},
+		{"no file root", func(c *Config) { c.FileRoot = "" }, "FileRoot is empty"},
+		{"file root is a file", func(c *Config) { c.FileRoot = notDir }, "is not a directory"},
+		{"empty directory", func(c *Config) { c.APIKeys["k"] = keyConfig{Perms: permAll} }, "api key 'k' has an empty directory"},
+		{"empty key", func(c *Config) { c.APIKeys[""] = keyConfig{Dir: "d"} }, "api key for directory 'd' is empty"},
+		{"root directory", func(c *Config) { c.APIKeys["k"] = keyConfig{Dir: "."} }, "which is FileRoot itself"},
+		{"directory outside root", func(c *Config) { c.APIKeys["k"] = keyConfig{Dir: "../other"} }, "api key 'k' has directory '../other', which is outside FileRoot"},
+		{"directory escaping root", func(c *Config) { c.APIKeys["k"] = keyConfig{Dir: "a/../../other"} }, "which is outside FileRoot"},
+		{"absolute directory", func(c *Config) { c.APIKeys["k"] = keyConfig{Dir: "/etc"} }, "api key 'k' has directory '/etc', which is outside FileRoot"},
+		{"public directory outside root", func(c *Config) { c.PublicDir = "../public" }, "PublicDir '../public' is outside FileRoot"},
+		{"missing certificate", func(c *Config) { c.TLSCertPath = filepath.Join(t.TempDir(), "cert.pem") }, "is not accessible"},
+		{"missing key", func(c *Config) { c.TLSKeyPath = filepath.Join(t.TempDir(), "key.pem") }, "is not accessible"},
+		{"bad log level", func(c *Config) { c.LogLevel = "loud" }, "unknown log level 'loud'"},
+		{"bad index file", func(c *Config) { c.IndexFiles = []string{"a/b.html"} }, "is not a file name"},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t)
+		test.change(&cfg)
+		err := cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.problem)
+		}
+	}
+
+	// every problem is reported at once
+	cfg := testConfig(t)
+	cfg.Address = ""
+	cfg.APIKeys["k"] = keyConfig{}
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "Address is empty") || !strings.Contains(err.Error(), "empty directory") {
+		t.Errorf("got error %v, want both problems", err)
+	}
+
+	// directories need only resolve within FileRoot, for virtual hosts too
+	cfg = testConfig(t)
+	cfg.APIKeys["k"] = keyConfig{Dir: "a/../b", Perms: permAll}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("directory within FileRoot gave %v", err)
+	}
+	cfg.VirtualHosts = map[string]virtualHost{
+		"files.example.com": {FileRoot: t.TempDir(), APIKeys: map[apikey]keyConfig{"v": {Dir: "../other", Perms: permAll}}},
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "files.example.com") || !strings.Contains(err.Error(), "outside FileRoot") {
+		t.Errorf("got error %v for a virtual host directory outside its FileRoot", err)
+	}
+}
+
+func TestServerCreatesFileRoot(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.FileRoot = filepath.Join(t.TempDir(), "new", "root")
+	vroot := filepath.Join(t.TempDir(), "new", "vroot")
+	cfg.VirtualHosts = map[string]virtualHost{
+		"files.example.com": {FileRoot: vroot, APIKeys: map[apikey]keyConfig{"vkey": {Dir: "d", Perms: permAll}}},
+	}
+
+	// validating changes nothing
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if exists(cfg.FileRoot) || exists(vroot) {
+		t.Fatal("Validate created FileRoot")
+	}
+
+	newTestServer(t, cfg)
+	for _, root := range []string{cfg.FileRoot, vroot} {
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			t.Errorf("%s wasn't created: %v", root, err)
+		}
+	}
+}
+
+func TestOpenConfigValidates(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys["k"] = keyConfig{}
+	if _, err := OpenConfig(writeConfigFile(t, cfg)); err == nil {
+		t.Error("opened an invalid config")
+	}
+	if _, err := OpenConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("opened a missing config")
+	}
+}
+
+// setenv sets the environment variable until the test ends.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	old, found := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if found {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "files")
+	setenv(t, "HTTPFS_ADDRESS", "127.0.0.1:9000")
+	setenv(t, "HTTPFS_FILEROOT", root)
+	setenv(t, "HTTPFS_API_KEYS", "one=first, two=second")
+
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Address != "127.0.0.1:9000" || cfg.FileRoot != root {
+		t.Errorf("got Address %q and FileRoot %q", cfg.Address, cfg.FileRoot)
+	}
+	if cfg.APIKeys["one"].Dir != "first" || cfg.APIKeys["two"].Dir != "second" || cfg.APIKeys["two"].Perms != permAll {
+		t.Errorf("got keys %+v", cfg.APIKeys)
+	}
+
+	setenv(t, "HTTPFS_API_KEYS", "one=first,broken")
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Error("malformed HTTPFS_API_KEYS accepted")
+	}
+}
+
+func TestEnvOverridesConfigFile(t *testing.T) {
+	cfg := testConfig(t)
+	path := writeConfigFile(t, cfg)
+	setenv(t, "HTTPFS_ADDRESS", "127.0.0.1:9001")
+	setenv(t, "HTTPFS_API_KEYS", "env-key=envdir")
+
+	opened, err := OpenConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Address != "127.0.0.1:9001" {
+		t.Errorf("got Address %q, want the one from the environment", opened.Address)
+	}
+	if opened.FileRoot != cfg.FileRoot {
+		t.Errorf("got FileRoot %q, want the one from the file", opened.FileRoot)
+	}
+	if opened.APIKeys[testKey].Dir != "sandbox" || opened.APIKeys["env-key"].Dir != "envdir" {
+		t.Errorf("got keys %+v, want those of both", opened.APIKeys)
+	}
+}
+
+func TestAPIKeysFile(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys.json")
+	keys := `{"file-key": "fromfile", "both-key": {"dir": "fromfile", "perms": "r"}}`
+	if err := os.WriteFile(keysFile, []byte(keys), filePerm); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t)
+	cfg.APIKeysFile = keysFile
+	cfg.APIKeys["both-key"] = keyConfig{Dir: "inline", Perms: permAll}
+
+	opened, err := OpenConfig(writeConfigFile(t, cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := opened.APIKeys[testKey]; got.Dir != "sandbox" {
+		t.Errorf("inline key has %+v", got)
+	}
+	if got := opened.APIKeys["file-key"]; got.Dir != "fromfile" || got.Perms != permAll {
+		t.Errorf("key from the file has %+v", got)
+	}
+	if got := opened.APIKeys["both-key"]; got.Dir != "fromfile" || got.Perms != permRead {
+		t.Errorf("key in both has %+v, want that from the file", got)
+	}
+
+	// the file is read again on reload
+	fs := newTestServer(t, opened)
+	path := writeConfigFile(t, cfg)
+	if err := os.WriteFile(keysFile, []byte(`{"rotated-key": "fromfile"}`), filePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.ReloadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, found := fs.config().findKey("rotated-key"); !found {
+		t.Error("rotated key wasn't loaded on reload")
+	}
+	if _, _, found := fs.config().findKey("file-key"); found {
+		t.Error("key removed from the file is still accepted")
+	}
+
+	cfg.APIKeysFile = filepath.Join(t.TempDir(), "missing.json")
+	if _, err := OpenConfig(writeConfigFile(t, cfg)); err == nil {
+		t.Error("opened a config with a missing api keys file")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.TLSCertPath, cfg.TLSKeyPath = writeTestCert(t)
+	if err := cfg.Check(); err != nil {
+		t.Fatalf("good config failed: %s", err)
+	}
+	if probes, _ := filepath.Glob(filepath.Join(cfg.FileRoot, ".httpfs-check-*")); len(probes) != 0 {
+		t.Errorf("check left %v in FileRoot", probes)
+	}
+
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	os.WriteFile(garbage, []byte("not a certificate"), filePerm)
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		problem string
+	}{
+		{"invalid config", func(c *Config) { c.Address = "" }, "Address is empty"},
+		{"bad certificate", func(c *Config) { c.TLSCertPath = garbage }, "error loading TLS certificate"},
+		{"bad key", func(c *Config) { c.TLSKeyPath = garbage }, "error loading TLS certificate"},
+		{"log can't be opened", func(c *Config) { c.LogFile = filepath.Join(t.TempDir(), "missing", "log") }, "error opening log file"},
+	}
+	for _, test := range tests {
+		bad := cfg
+		test.change(&bad)
+		err := bad.Check()
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.problem)
+		}
+	}
+
+	if os.Geteuid() != 0 { // root may write anywhere
+		readOnly := cfg
+		readOnly.FileRoot = filepath.Join(t.TempDir(), "readonly")
+		os.Mkdir(readOnly.FileRoot, 0555)
+		if err := readOnly.Check(); err == nil || !strings.Contains(err.Error(), "is not writable") {
+			t.Errorf("read only FileRoot gave %v", err)
+		}
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	tests := []struct {
+		seconds int
+		want    time.Duration
+	}{
+		{0, time.Minute},
+		{-5, time.Minute},
+		{30, 30 * time.Second},
+		{300, 5 * time.Minute},
+	}
+	for _, test := range tests {
+		cfg := Config{ShutdownTimeoutSeconds: test.seconds}
+		if got := cfg.shutdownTimeout(); got != test.want {
+			t.Errorf("%d seconds gave %s, want %s", test.seconds, got, test.want)
+		}
+	}
+
+	cfg := testConfig(t)
+	cfg.ShutdownTimeoutSeconds = 30
+	loaded, err := OpenConfig(writeConfigFile(t, cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.shutdownTimeout(); got != 30*time.Second {
+		t.Errorf("config file gave a timeout of %s", got)
+	}
+}
+
+func TestEmptyKeysRejected(t *testing.T) {
+	root := t.TempDir()
+	tests := []struct {
+		name    string
+		keys    string
+		problem string
+	}{
+		{"empty key", `{"": {"Dir": "d", "Perms": "rwd"}}`, "api key for directory 'd' is empty"},
+		{"empty directory", `{"k": {"Dir": "", "Perms": "rwd"}}`, "api key 'k' has an empty directory"},
+		{"directory only", `{"k": ""}`, "api key 'k' has an empty directory"},
+	}
+	for _, test := range tests {
+		data := `{"Address": "127.0.0.1:0", "FileRoot": ` + strconv.Quote(root) + `, "APIKeys": ` + test.keys + `}`
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(data), filePerm); err != nil {
+			t.Fatal(err)
+		}
+		_, err := OpenConfig(path)
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.problem)
+		}
+	}
+
+	// nor may a virtual host's keys be empty
+	cfg := testConfig(t)
+	cfg.VirtualHosts = map[string]virtualHost{
+		"files.example.com": {FileRoot: root, APIKeys: map[apikey]keyConfig{"": {Dir: "d", Perms: permAll}}},
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "files.example.com") {
+		t.Errorf("got error %v for an empty virtual host key", err)
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	cfg := testConfig(t)
+	rootA, rootB := t.TempDir(), t.TempDir()
+	cfg.VirtualHosts = map[string]virtualHost{
+		"a.example.com": {FileRoot: rootA, APIKeys: map[apikey]keyConfig{"key-a": {Dir: "files", Perms: permAll}}},
+		"B.example.com": {FileRoot: rootB, APIKeys: map[apikey]keyConfig{"key-b": {Dir: "files", Perms: permAll}}},
+	}
+	fs := newTestServer(t, cfg)
+
+	expectStatus(t, do(fs, http.MethodPut, "http://a.example.com/file.txt", "key-a", "a"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPut, "http://b.example.com:8080/file.txt", "key-b", "b"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPut, "http://other.example.com/file.txt", testKey, "default"), http.StatusOK)
+	for path, want := range map[string]string{
+		filepath.Join(rootA, "files", "file.txt"): "a",
+		filepath.Join(rootB, "files", "file.txt"): "b",
+		sandboxFile(cfg, "file.txt"):              "default",
+	} {
+		if data, err := os.ReadFile(path); err != nil || string(data) != want {
+			t.Errorf("%s has %q, %v, want %q", path, data, err, want)
+		}
+	}
+
+	// keys only work for their own host
+	expectStatus(t, do(fs, http.MethodGet, "http://a.example.com/file.txt", "key-b", ""), http.StatusUnauthorized)
+	expectStatus(t, do(fs, http.MethodGet, "http://a.example.com/file.txt", testKey, ""), http.StatusUnauthorized)
+	expectStatus(t, do(fs, http.MethodGet, "http://other.example.com/file.txt", "key-a", ""), http.StatusUnauthorized)
+	resp := do(fs, http.MethodGet, "http://A.EXAMPLE.COM/file.txt", "key-a", "")
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); body != "a" {
+		t.Errorf("host a gave %q", body)
+	}
+}
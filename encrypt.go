@@ -0,0 +1,356 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Encrypted files begin with encryptMagic and a random file ID, followed by
+// a sequence of chunks, each holding up to encryptChunkSize bytes of
+// plaintext:
+//
+//		[4 byte plaintext length][nonce][ciphertext and tag]
+//
+// Each chunk is sealed with AES-GCM using the file ID, its index in the file
+// and whether it's the last chunk as additional data, so chunks can't be
+// reordered, moved between files or dropped from the end. Every file has at
+// least one chunk, which is empty for an empty file. Appending re-seals the
+// last chunk and writes more after it.
+
+// magic bytes at the start of encrypted files
+const encryptMagic = "HTTPFSE2"
+
+// size of the random ID following encryptMagic
+const fileIDSize = 16
+
+// maximum bytes of plaintext in each chunk
+const encryptChunkSize = 64 * 1024
+
+// size of the plaintext length at the start of each chunk
+const chunkLenSize = 4
+
+// errNotEncrypted is returned when reading a file without encryptMagic.
+var errNotEncrypted = errors.New("file is not encrypted")
+
+// newFileCipher derives an AES-256 key from secret and creates the AEAD
+// used to encrypt files.
+func newFileCipher(secret string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("httpfs file encryption\x00" + secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkAAD gives the additional data for the chunk at index in the file with
+// the given ID.
+func chunkAAD(id []byte, index uint64, last bool) []byte {
+	aad := make([]byte, len(id)+9)
+	copy(aad, id)
+	binary.BigEndian.PutUint64(aad[len(id):], index)
+	if last {
+		aad[len(aad)-1] = 1
+	}
+	return aad
+}
+
+// writeEncryptHeader writes encryptMagic and a new file ID to w, giving the
+// ID.
+func writeEncryptHeader(w io.Writer) ([]byte, error) {
+	id := make([]byte, fileIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("error generating file id: %w", err)
+	}
+	if _, err := w.Write(append([]byte(encryptMagic), id...)); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// encryptWriter encrypts data written to it into chunks written to w.
+// Close must be called to write the last chunk.
+type encryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	id    []byte
+	index uint64 // of the next chunk
+	buf   []byte
+}
+
+// newEncryptWriter creates an encryptWriter for the file with the given ID
+// whose first chunk has the given index. It does not write the header.
+func newEncryptWriter(w io.Writer, aead cipher.AEAD, id []byte, index uint64) *encryptWriter {
+	return &encryptWriter{
+		w:     w,
+		aead:  aead,
+		id:    id,
+		index: index,
+		buf:   make([]byte, 0, encryptChunkSize),
+	}
+}
+
+func (e *encryptWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		// a full chunk is only written once more follows, since it's
+		// sealed differently if it's the last
+		if len(e.buf) == cap(e.buf) {
+			if err := e.flush(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+// flush seals and writes the buffered plaintext as a chunk.
+func (e *encryptWriter) flush(last bool) error {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %w", err)
+	}
+	chunk := make([]byte, chunkLenSize, chunkLenSize+len(nonce)+len(e.buf)+e.aead.Overhead())
+	binary.BigEndian.PutUint32(chunk, uint32(len(e.buf)))
+	chunk = append(chunk, nonce...)
+	chunk = e.aead.Seal(chunk, nonce, e.buf, chunkAAD(e.id, e.index, last))
+
+	e.index++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(chunk)
+	return err
+}
+
+// Close writes the last chunk. It does not close the underlying writer.
+func (e *encryptWriter) Close() error {
+	return e.flush(true)
+}
+
+// newAppendWriter prepares file, opened for appending from the path in store,
+// to have plaintext encrypted onto its end. An empty file is given a header.
+// Otherwise the last chunk is removed from file, to be written again with
+// what's appended, and restore puts it back as it was.
+func newAppendWriter(store Storage, path string, file File, aead cipher.AEAD) (ew *encryptWriter, restore func() error, err error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size() == 0 {
+		id, err := writeEncryptHeader(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newEncryptWriter(file, aead, id, 0), nil, nil
+	}
+
+	existing, err := store.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer existing.Close()
+	d, err := newDecryptReader(existing, aead)
+	if err != nil {
+		return nil, nil, err
+	}
+	last := d.chunks[len(d.chunks)-1]
+	if _, err := existing.Seek(last.offset, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	sealed, err := io.ReadAll(existing)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := file.Truncate(last.offset); err != nil {
+		return nil, nil, err
+	}
+	if _, err := file.Seek(last.offset, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	restore = func() error {
+		if err := file.Truncate(last.offset); err != nil {
+			return err
+		}
+		_, err := file.Write(sealed)
+		return err
+	}
+	ew = newEncryptWriter(file, aead, d.id, uint64(len(d.chunks)-1))
+	ew.buf = append(ew.buf, d.plain...)
+	return ew, restore, nil
+}
+
+// encChunk locates a chunk within an encrypted file.
+type encChunk struct {
+	offset int64 // of the chunk in the file
+	start  int64 // of the chunk's plaintext in the decrypted file
+	size   int64 // of the chunk's plaintext
+}
+
+// scanChunks gives the file ID and lists the chunks of the encrypted data in
+// r, with the total plaintext size. errNotEncrypted is returned if r does
+// not start with encryptMagic.
+func scanChunks(r io.ReadSeeker, aead cipher.AEAD) (id []byte, chunks []encChunk, size int64, err error) {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, 0, err
+	}
+
+	magic := make([]byte, len(encryptMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != encryptMagic {
+		return nil, nil, 0, errNotEncrypted
+	}
+	id = make([]byte, fileIDSize)
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, nil, 0, fmt.Errorf("error reading file id: %w", err)
+	}
+
+	offset := int64(len(encryptMagic) + fileIDSize)
+	for offset < end {
+		var length [chunkLenSize]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, nil, 0, fmt.Errorf("error reading chunk %d: %w", len(chunks), err)
+		}
+		n := int64(binary.BigEndian.Uint32(length[:]))
+		chunks = append(chunks, encChunk{offset: offset, start: size, size: n})
+		size += n
+
+		offset, err = r.Seek(int64(aead.NonceSize()+aead.Overhead())+n, io.SeekCurrent)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	if offset != end || len(chunks) == 0 {
+		return nil, nil, 0, fmt.Errorf("encrypted data is truncated")
+	}
+
+	return id, chunks, size, nil
+}
+
+// decryptReader decrypts encrypted data, allowing seeking within the
+// plaintext.
+type decryptReader struct {
+	r      io.ReadSeeker
+	aead   cipher.AEAD
+	id     []byte
+	chunks []encChunk
+	size   int64 // of plaintext
+	pos    int64 // in plaintext
+
+	cur   int    // index of the chunk in plain, or -1
+	plain []byte // decrypted chunk
+}
+
+// newDecryptReader creates a decryptReader for the encrypted data in r. The
+// last chunk is decrypted right away so that truncated data is found before
+// any of it is read. errNotEncrypted is returned if r does not start with
+// encryptMagic.
+func newDecryptReader(r io.ReadSeeker, aead cipher.AEAD) (*decryptReader, error) {
+	id, chunks, size, err := scanChunks(r, aead)
+	if err != nil {
+		return nil, err
+	}
+	d := &decryptReader{r: r, aead: aead, id: id, chunks: chunks, size: size, cur: -1}
+	if err := d.load(len(chunks) - 1); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Size gets the size of the plaintext.
+func (d *decryptReader) Size() int64 {
+	return d.size
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+
+	i := sort.Search(len(d.chunks), func(i int) bool {
+		return d.chunks[i].start+d.chunks[i].size > d.pos
+	})
+	if i != d.cur {
+		if err := d.load(i); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain[d.pos-d.chunks[i].start:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+// load decrypts chunk i into plain.
+func (d *decryptReader) load(i int) error {
+	c := d.chunks[i]
+	if _, err := d.r.Seek(c.offset+chunkLenSize, io.SeekStart); err != nil {
+		return err
+	}
+
+	sealed := make([]byte, int64(d.aead.NonceSize()+d.aead.Overhead())+c.size)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return fmt.Errorf("error reading chunk %d: %w", i, err)
+	}
+	nonce, ciphertext := sealed[:d.aead.NonceSize()], sealed[d.aead.NonceSize():]
+
+	plain, err := d.aead.Open(d.plain[:0], nonce, ciphertext, chunkAAD(d.id, uint64(i), i == len(d.chunks)-1))
+	if err != nil {
+		d.cur = -1
+		return fmt.Errorf("error decrypting chunk %d: %w", i, err)
+	}
+	d.plain = plain
+	d.cur = i
+	return nil
+}
+
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+// plaintext gives a reader of the plaintext of file and the plaintext's
+// size. If aead is nil or file is not encrypted, file is its own plaintext.
+func plaintext(file File, aead cipher.AEAD) (io.ReadSeeker, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if aead == nil {
+		return file, info.Size(), nil
+	}
+
+	dr, err := newDecryptReader(file, aead)
+	if errors.Is(err, errNotEncrypted) {
+		_, err = file.Seek(0, io.SeekStart)
+		return file, info.Size(), err
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return dr, dr.Size(), nil
+}
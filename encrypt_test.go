@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// testCipher creates the AEAD for a fixed secret.
+func testCipher(t *testing.T) cipher.AEAD {
+	t.Helper()
+	aead, err := newFileCipher("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+// encrypt gives the encrypted file holding plaintext.
+func encrypt(t *testing.T, aead cipher.AEAD, plaintext []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	id, err := writeEncryptHeader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ew := newEncryptWriter(&buf, aead, id, 0)
+	if _, err := ew.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decrypt gives the plaintext of the encrypted file.
+func decrypt(aead cipher.AEAD, encrypted []byte) ([]byte, error) {
+	d, err := newDecryptReader(bytes.NewReader(encrypted), aead)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(d)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	aead := testCipher(t)
+	for _, size := range []int{0, 1, encryptChunkSize - 1, encryptChunkSize, encryptChunkSize + 1, 3 * encryptChunkSize} {
+		plaintext := bytes.Repeat([]byte("x"), size)
+		got, err := decrypt(aead, encrypt(t, aead, plaintext))
+		if err != nil {
+			t.Errorf("%d bytes: error decrypting: %s", size, err)
+			continue
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("%d bytes: decrypted %d bytes", size, len(got))
+		}
+	}
+}
+
+func TestEncryptedFileServed(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.EncryptionKey = "secret"
+	fs := newTestServer(t, cfg)
+	content := strings.Repeat("sensitive data ", 10000)
+
+	expectStatus(t, do(fs, http.MethodPut, "/file.txt", testKey, content), http.StatusOK)
+	stored := readSandboxFile(t, cfg, "file.txt")
+	if !strings.HasPrefix(stored, encryptMagic) || strings.Contains(stored, "sensitive") {
+		t.Error("file is stored as plaintext")
+	}
+	resp := do(fs, http.MethodGet, "/file.txt", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); body != content {
+		t.Errorf("GET gave %d bytes, want the %d written", len(body), len(content))
+	}
+
+	// appends re-seal the last chunk and carry on after it
+	expectStatus(t, do(fs, http.MethodPost, "/file.txt", testKey, "appended"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPost, "/file.txt", testKey, strings.Repeat("y", encryptChunkSize)), http.StatusOK)
+	want := content + "appended" + strings.Repeat("y", encryptChunkSize)
+	if body := readBody(t, do(fs, http.MethodGet, "/file.txt", testKey, "")); body != want {
+		t.Errorf("GET after appending gave %d bytes, want %d", len(body), len(want))
+	}
+
+	// a failed append leaves the file as it was
+	req := newRequest(http.MethodPost, "/file.txt", testKey, &failingReader{content: strings.NewReader("partial"), err: io.ErrUnexpectedEOF})
+	serve(fs, req)
+	if body := readBody(t, do(fs, http.MethodGet, "/file.txt", testKey, "")); body != want {
+		t.Errorf("GET after a failed append gave %d bytes, want %d", len(body), len(want))
+	}
+}
+
+func TestEncryptTamperingDetected(t *testing.T) {
+	aead := testCipher(t)
+	plaintext := bytes.Repeat([]byte("abcd"), encryptChunkSize) // 4 chunks
+	encrypted := encrypt(t, aead, plaintext)
+	chunk := chunkLenSize + aead.NonceSize() + encryptChunkSize + aead.Overhead()
+	header := len(encryptMagic) + fileIDSize
+
+	other := encrypt(t, aead, plaintext)
+	spliced := append([]byte{}, encrypted...)
+	copy(spliced[header+chunk:], other[header+chunk:header+2*chunk])
+
+	swapped := append([]byte{}, encrypted[:header]...)
+	swapped = append(swapped, encrypted[header+chunk:header+2*chunk]...)
+	swapped = append(swapped, encrypted[header:header+chunk]...)
+	swapped = append(swapped, encrypted[header+2*chunk:]...)
+
+	tests := map[string][]byte{
+		"truncated at a chunk":  encrypted[:header+3*chunk],
+		"truncated to a header": encrypted[:header],
+		"truncated in a chunk":  encrypted[:header+3*chunk+10],
+		"spliced from another":  spliced,
+		"reordered":             swapped,
+	}
+	for name, data := range tests {
+		if _, err := decrypt(aead, data); err == nil {
+			t.Errorf("%s: decrypted without error", name)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// time between checks for bytes appended to a followed file
+const followPollInterval = 500 * time.Millisecond
+
+// connKey is the context key of the connection a request was received on.
+type connKey struct{}
+
+// withConn keeps the connection in the context of requests received on it,
+// so that handlers may change its deadlines.
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// followFile writes the file at path into w and then keeps writing any bytes
+// appended to it until the client disconnects, stop is closed, or the file
+// is truncated. The write timeout doesn't apply.
+func followFile(store Storage, path string, w http.ResponseWriter, req *http.Request, stop <-chan struct{}, bufSize int) error {
+	file, err := store.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening file '%s': %w", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error stating file '%s': %w", path, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("error reading '%s': %w", path, errIsDir)
+	}
+
+	ctype, err := detectContentType(file, info.Name())
+	if err != nil {
+		return fmt.Errorf("error reading file '%s': %w", path, err)
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if conn, ok := req.Context().Value(connKey{}).(net.Conn); ok {
+		conn.SetWriteDeadline(time.Time{})
+	}
+	flusher, _ := w.(http.Flusher)
+
+	ticker := time.NewTicker(followPollInterval)
+	defer ticker.Stop()
+	var offset int64
+	for {
+		n, err := copyContext(req.Context(), w, file, bufSize)
+		offset += n
+		if err != nil {
+			return nil // the response has begun, so can't report errors
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		if info, err := file.Stat(); err != nil || info.Size() < offset {
+			return nil // truncated, so the rest can't be followed
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startFollowServer serves fs as the server would, with its connection
+// context and a write timeout shorter than the poll interval.
+func startFollowServer(t *testing.T, fs *httpfsServer) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(fs.server.Handler)
+	server.Config.ConnContext = withConn
+	server.Config.WriteTimeout = followPollInterval / 4
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// readN reads n bytes from r, failing the test if they don't arrive in time.
+func readN(t *testing.T, r io.Reader, n int, timeout time.Duration) string {
+	t.Helper()
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, n)
+		read, _ := io.ReadFull(r, buf)
+		got <- string(buf[:read])
+	}()
+	select {
+	case s := <-got:
+		return s
+	case <-time.After(timeout):
+		t.Fatalf("%d bytes didn't arrive within %s", n, timeout)
+		return ""
+	}
+}
+
+func TestFollow(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "log.txt", "first line\n")
+	server := startFollowServer(t, fs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/log.txt?follow=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("", testKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	expectStatus(t, resp, http.StatusOK)
+	body := bufio.NewReader(resp.Body)
+
+	if got := readN(t, body, len("first line\n"), time.Second); got != "first line\n" {
+		t.Fatalf("follow began with %q", got)
+	}
+
+	// appended after the write timeout would have passed
+	time.Sleep(2 * server.Config.WriteTimeout)
+	file, err := os.OpenFile(sandboxFile(cfg, "log.txt"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("appended\n")
+	file.Close()
+	if got := readN(t, body, len("appended\n"), 4*followPollInterval); got != "appended\n" {
+		t.Errorf("follow gave %q after appending", got)
+	}
+
+	// ranged writes are made in place, so are followed too
+	offset := len("first line\nappended\n")
+	expectStatus(t, do(fs, http.MethodPatch, "/log.txt?offset="+strconv.Itoa(offset), testKey, "patched\n"), http.StatusOK)
+	if got := readN(t, body, len("patched\n"), 4*followPollInterval); got != "patched\n" {
+		t.Errorf("follow gave %q after patching", got)
+	}
+}
+
+func TestFollowEnds(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "log.txt", "some content\n")
+	server := startFollowServer(t, fs)
+
+	follow := func() *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/log.txt?follow=1", nil)
+		req.SetBasicAuth("", testKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readN(t, resp.Body, len("some content\n"), time.Second)
+		return resp
+	}
+	ended := func(resp *http.Response) {
+		t.Helper()
+		done := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, resp.Body)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(4 * followPollInterval):
+			t.Error("follow didn't end")
+		}
+		resp.Body.Close()
+	}
+
+	// truncating the file ends the follow
+	resp := follow()
+	if err := os.Truncate(sandboxFile(cfg, "log.txt"), 0); err != nil {
+		t.Fatal(err)
+	}
+	ended(resp)
+
+	// as does shutting down
+	writeSandboxFile(t, cfg, "log.txt", "some content\n")
+	resp = follow()
+	fs.stop()
+	ended(resp)
+
+	expectStatus(t, do(fs, http.MethodGet, "/missing.txt?follow=1", testKey, ""), http.StatusNotFound)
+}
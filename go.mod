@@ -2,4 +2,10 @@ module github.com/quillaja/httpfs
 
 go 1.16
 
-require github.com/quillaja/sysdlog v0.1.3
+require (
+	github.com/prometheus/client_golang v1.11.0
+	github.com/quillaja/sysdlog v0.1.3
+	golang.org/x/crypto v0.0.0-20210616213533-5ff15b29337e
+	golang.org/x/net v0.0.0-20210614182718-04defd469f4e
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
+)
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dirEntry describes a single file or directory in a directory listing.
+// Only names are given, never host paths.
+type dirEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+	IsDir   bool      `json:"dir"`
+}
+
+// serverFileName matches the names of temporary files being written and of
+// partial uploads, as given by tempPath and uploadSessions.Start.
+var serverFileName = regexp.MustCompile(`^\..+\.(tmp|upload)-[0-9a-f]+$`)
+
+// isServerFile reports if name, in a directory of a sandbox, is one of the
+// server's own files rather than one stored by a client: a temporary file,
+// a partial upload, or the trash if the directory is the sandbox itself.
+func isServerFile(name string, isRoot bool) bool {
+	return serverFileName.MatchString(name) || (isRoot && inTrash(name))
+}
+
+// readDirEntries gets the listing of the directory at path, which is the
+// sandbox itself if isRoot. The server's own files are left out.
+func readDirEntries(store Storage, path string, isRoot bool) ([]dirEntry, error) {
+	entries, err := store.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory '%s': %w", path, err)
+	}
+
+	listing := make([]dirEntry, 0, len(entries))
+	for _, e := range entries {
+		if isServerFile(e.Name(), isRoot) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, fmt.Errorf("error stating '%s' in '%s': %w", e.Name(), path, err)
+		}
+		listing = append(listing, dirEntry{
+			Name:    e.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC(),
+			IsDir:   e.IsDir(),
+		})
+	}
+
+	return listing, nil
+}
+
+// findIndex gets the path of the first of the index files found in the
+// directory at path, or "" if there are none.
+func findIndex(store Storage, path string, indexFiles []string) string {
+	for _, name := range indexFiles {
+		index := filepath.Join(path, name)
+		if fileCount(store, index) == 1 {
+			return index
+		}
+	}
+	return ""
+}
+
+// formats in which directories may be listed
+const (
+	listJSON  = "json"
+	listPlain = "plain"
+	listHTML  = "html"
+)
+
+// media types of the listing formats
+var listingTypes = map[string]string{
+	listJSON:  "application/json",
+	listPlain: "text/plain",
+	listHTML:  "text/html",
+}
+
+// listingFormat gets the format in which to list a directory for req: that
+// given by "format" in the query, or else the type preferred by the Accept
+// header, or else JSON.
+func listingFormat(req *http.Request) string {
+	if format := req.URL.Query().Get("format"); listingTypes[format] != "" {
+		return format
+	}
+
+	format, best := listJSON, 0.0
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediatype, params, err := mime.ParseMediaType(accepted)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, found := params["q"]; found {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		for f, t := range listingTypes {
+			if t == mediatype && q > best {
+				format, best = f, q
+			}
+		}
+	}
+	return format
+}
+
+// listDir writes a listing of the contents of the directory at path, the
+// sandbox itself if isRoot, into w in the format.
+func listDir(store Storage, path string, isRoot bool, w http.ResponseWriter, format string) error {
+	listing, err := readDirEntries(store, path, isRoot)
+	if err != nil {
+		return err
+	}
+	return writeListing(w, path, listing, format)
+}
+
+// listingPage is the template of directory listings in HTML.
+var listingPage = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index</title></head>
+<body>
+<ul>
+{{- range .}}
+<li><a href="{{.Link}}">{{.Name}}{{if .IsDir}}/{{end}}</a> {{.Size}} {{.ModTime.Format "2006-01-02 15:04:05"}}</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+// writeListing writes the listing of the directory at path into w in the
+// format: a JSON array, the names one to a line, or an HTML page linking
+// to each entry.
+func writeListing(w http.ResponseWriter, path string, listing []dirEntry, format string) error {
+	ctype := listingTypes[format]
+	if format != listJSON {
+		ctype += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Add("Vary", "Accept")
+
+	var err error
+	switch format {
+	case listPlain:
+		for _, e := range listing {
+			if _, err = fmt.Fprintln(w, e.Name); err != nil {
+				break
+			}
+		}
+	case listHTML:
+		type link struct {
+			dirEntry
+			Link string
+		}
+		links := make([]link, 0, len(listing))
+		for _, e := range listing {
+			href := url.PathEscape(e.Name)
+			if e.IsDir {
+				href += "/"
+			}
+			links = append(links, link{e, "./" + href})
+		}
+		err = listingPage.Execute(w, links)
+	default:
+		err = json.NewEncoder(w).Encode(listing)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing listing of '%s': %w", path, err)
+	}
+
+	return nil
+}
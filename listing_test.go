@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// listing GETs the directory listing at target as JSON.
+func listing(t *testing.T, fs *httpfsServer, target string) []dirEntry {
+	t.Helper()
+	resp := do(fs, http.MethodGet, target, testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	var entries []dirEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatalf("listing isn't JSON: %s", err)
+	}
+	return entries
+}
+
+// entryNames gives the sorted names of the entries.
+func entryNames(entries []dirEntry) []string {
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRootListing(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+
+	// nothing stored yet
+	if entries := listing(t, fs, "/"); len(entries) != 0 {
+		t.Errorf("empty sandbox lists %v", entries)
+	}
+	if exists(sandboxFile(cfg, "")) {
+		t.Error("listing created the sandbox")
+	}
+
+	writeSandboxFile(t, cfg, "a.txt", "12345")
+	writeSandboxFile(t, cfg, "dir/b.txt", "b")
+	entries := listing(t, fs, "/")
+	if names := entryNames(entries); len(names) != 2 || names[0] != "a.txt" || names[1] != "dir" {
+		t.Fatalf("root lists %v", names)
+	}
+	for _, e := range entries {
+		if (e.Name == "dir") != e.IsDir || (e.Name == "a.txt" && e.Size != 5) {
+			t.Errorf("got entry %+v", e)
+		}
+	}
+
+	for _, method := range []string{http.MethodPut, http.MethodPost, http.MethodPatch, http.MethodDelete} {
+		expectJSONError(t, do(fs, method, "/", testKey, "content"), http.StatusBadRequest)
+	}
+}
+
+func TestIndexFiles(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.IndexFiles = []string{"index.html", "index.htm"}
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "plain/file.txt", "content")
+	writeSandboxFile(t, cfg, "site/index.htm", "second choice")
+	writeSandboxFile(t, cfg, "site/file.txt", "content")
+
+	// without an index file the listing is given
+	if names := entryNames(listing(t, fs, "/plain/")); len(names) != 1 || names[0] != "file.txt" {
+		t.Errorf("directory without an index lists %v", names)
+	}
+
+	resp := do(fs, http.MethodGet, "/site/", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); body != "second choice" {
+		t.Errorf("directory with index.htm gave %q", body)
+	}
+
+	// the first index file found is served
+	writeSandboxFile(t, cfg, "site/index.html", "<p>first choice</p>")
+	resp = do(fs, http.MethodGet, "/site/", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); body != "<p>first choice</p>" {
+		t.Errorf("directory with index.html gave %q", body)
+	}
+	if ctype := resp.Header.Get("Content-Type"); ctype != "text/html; charset=utf-8" {
+		t.Errorf("index.html has Content-Type %q", ctype)
+	}
+}
+
+func TestListingFormats(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "a b.txt", "12345")
+	writeSandboxFile(t, cfg, "dir/c.txt", "c")
+
+	get := func(target, accept string) *http.Response {
+		req := newRequest(http.MethodGet, target, testKey, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp := serve(fs, req)
+		expectStatus(t, resp, http.StatusOK)
+		return resp
+	}
+
+	// JSON is the default
+	for _, accept := range []string{"", "*/*", "application/json", "image/png"} {
+		resp := get("/", accept)
+		if ctype := resp.Header.Get("Content-Type"); ctype != "application/json" {
+			t.Errorf("Accept %q got Content-Type %q", accept, ctype)
+		}
+		var entries []dirEntry
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			t.Fatalf("Accept %q listing isn't JSON: %s", accept, err)
+		}
+		if names := entryNames(entries); len(names) != 2 || names[0] != "a b.txt" || names[1] != "dir" {
+			t.Errorf("Accept %q lists %v", accept, names)
+		}
+	}
+
+	for _, resp := range []*http.Response{
+		get("/", "text/plain"),
+		get("/?format=plain", ""),
+		get("/?format=plain", "application/json"),
+		get("/", "text/html;q=0.5, text/plain"),
+	} {
+		if ctype := resp.Header.Get("Content-Type"); ctype != "text/plain; charset=utf-8" {
+			t.Errorf("got Content-Type %q, want text/plain", ctype)
+		}
+		if body := readBody(t, resp); body != "a b.txt\ndir\n" {
+			t.Errorf("plain listing is %q", body)
+		}
+	}
+
+	for _, resp := range []*http.Response{
+		get("/", "text/html"),
+		get("/?format=html", "text/plain"),
+	} {
+		if ctype := resp.Header.Get("Content-Type"); ctype != "text/html; charset=utf-8" {
+			t.Errorf("got Content-Type %q, want text/html", ctype)
+		}
+		body := readBody(t, resp)
+		if !strings.Contains(body, `<a href="./a%20b.txt">a b.txt</a>`) || !strings.Contains(body, `<a href="./dir/">dir/</a>`) {
+			t.Errorf("html listing doesn't link the entries: %s", body)
+		}
+	}
+	if vary := get("/", "").Header.Get("Vary"); vary != "Accept" {
+		t.Errorf("got Vary %q, want Accept", vary)
+	}
+}
+
+func TestSubdirectoryListing(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "dir/a.txt", "12345")
+	writeSandboxFile(t, cfg, "dir/sub/b.txt", "b")
+	writeSandboxFile(t, cfg, "other.txt", "other")
+
+	entries := listing(t, fs, "/dir/")
+	if names := entryNames(entries); len(names) != 2 || names[0] != "a.txt" || names[1] != "sub" {
+		t.Fatalf("directory lists %v", names)
+	}
+	for _, e := range entries {
+		if (e.Name == "sub") != e.IsDir || (e.Name == "a.txt" && e.Size != 5) || e.ModTime.IsZero() {
+			t.Errorf("got entry %+v", e)
+		}
+	}
+
+	// host paths are never given
+	resp := do(fs, http.MethodGet, "/dir/sub/", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); strings.Contains(body, cfg.FileRoot) || strings.Contains(body, "sandbox") {
+		t.Errorf("listing reveals host paths: %s", body)
+	}
+
+	// files are read as before, with or without a slash
+	for _, target := range []string{"/other.txt", "/other.txt/"} {
+		resp = do(fs, http.MethodGet, target, testKey, "")
+		expectStatus(t, resp, http.StatusOK)
+		if body := readBody(t, resp); body != "other" {
+			t.Errorf("%s read as %q", target, body)
+		}
+	}
+	expectJSONError(t, do(fs, http.MethodGet, "/missing/", testKey, ""), http.StatusNotFound)
+}
+
+func TestServerFilesHidden(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.TrashEnabled = true
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "dir/kept.txt", "kept")
+	writeSandboxFile(t, cfg, "deleted.txt", "deleted")
+	writeSandboxFile(t, cfg, "dir/.trash/user.txt", "only the sandbox's trash is the server's")
+	expectStatus(t, do(fs, http.MethodDelete, "/deleted.txt", testKey, ""), http.StatusOK)
+	startTestUpload(t, fs, "/dir/uploading.txt")
+
+	// a write in progress has its temporary file
+	body := &blockingReader{
+		content: strings.NewReader("written"),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(fs, newRequest(http.MethodPut, "/dir/kept.txt", testKey, body))
+	}()
+	<-body.started
+	defer func() {
+		close(body.release)
+		<-done
+	}()
+
+	onDisk, _ := filepath.Glob(sandboxFile(cfg, "dir/.*"))
+	if len(onDisk) != 3 {
+		t.Fatalf("found %v, want temporary, upload and trash files", onDisk)
+	}
+
+	if names := entryNames(listing(t, fs, "/")); len(names) != 1 || names[0] != "dir" {
+		t.Errorf("root lists %v", names)
+	}
+	if names := entryNames(listing(t, fs, "/dir/")); len(names) != 2 || names[0] != ".trash" || names[1] != "kept.txt" {
+		t.Errorf("directory lists %v", names)
+	}
+	for target, want := range map[string][]string{
+		"/":    {"/", "/dir/"},
+		"/dir": {"/dir/", "/dir/.trash/", "/dir/kept.txt"},
+	} {
+		var hrefs []string
+		for _, r := range doPropfind(t, fs, target, "1").Responses {
+			hrefs = append(hrefs, r.Href)
+		}
+		sort.Strings(hrefs)
+		if strings.Join(hrefs, " ") != strings.Join(want, " ") {
+			t.Errorf("PROPFIND of %s gave %v, want %v", target, hrefs, want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import "sync"
+
+// pathLocks provides a mutex for each file path so that operations on the
+// same file are serialized while operations on different files may run
+// concurrently. Mutexes are discarded once no one holds or waits for them.
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+// pathLock is a mutex and the number of users holding or waiting for it.
+type pathLock struct {
+	sync.Mutex
+	users int
+}
+
+// newPathLocks creates an empty pathLocks.
+func newPathLocks() *pathLocks {
+	return &pathLocks{locks: make(map[string]*pathLock)}
+}
+
+// Lock blocks until the lock for path is acquired, returning the function
+// to release it.
+func (p *pathLocks) Lock(path string) (unlock func()) {
+	p.mu.Lock()
+	l, found := p.locks[path]
+	if !found {
+		l = &pathLock{}
+		p.locks[path] = l
+	}
+	l.users++
+	p.mu.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		p.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(p.locks, path)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// LockBoth blocks until the locks for both paths are acquired, returning the
+// function to release them. The locks are always taken in the same order so
+// that requests locking the same two paths can't deadlock.
+func (p *pathLocks) LockBoth(a, b string) (unlock func()) {
+	if a == b {
+		return p.Lock(a)
+	}
+	if b < a {
+		a, b = b, a
+	}
+	unlockA := p.Lock(a)
+	unlockB := p.Lock(b)
+	return func() {
+		unlockB()
+		unlockA()
+	}
+}
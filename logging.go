@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/quillaja/sysdlog"
+)
+
+// formats for the per-request access log
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// names of the levels which can be given as LogLevel, in order of severity
+var logLevels = map[string]sysdlog.Level{
+	"emerg":   sysdlog.Emerg,
+	"alert":   sysdlog.Alert,
+	"crit":    sysdlog.Crit,
+	"err":     sysdlog.Err,
+	"warning": sysdlog.Warning,
+	"notice":  sysdlog.Notice,
+	"info":    sysdlog.Info,
+	"debug":   sysdlog.Debug,
+}
+
+// parseLogLevel gets the sysdlog level with the given name. An empty name
+// is Info.
+func parseLogLevel(name string) (sysdlog.Level, error) {
+	if name == "" {
+		return sysdlog.Info, nil
+	}
+	level, ok := logLevels[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level '%s'", name)
+	}
+	return level, nil
+}
+
+// levelFilter discards log lines less severe than max. It relies on the
+// "<level>" prefix which sysdlog gives each line.
+type levelFilter struct {
+	w   io.Writer
+	max sysdlog.Level
+}
+
+func (f *levelFilter) Write(p []byte) (int, error) {
+	if end := bytes.IndexByte(p, '>'); len(p) > 0 && p[0] == '<' && end > 0 {
+		level, err := strconv.Atoi(string(p[1:end]))
+		if err == nil && level > int(f.max) {
+			return len(p), nil
+		}
+	}
+	return f.w.Write(p)
+}
+
+// logf writes a line to the log at the level. The level is the prefix of
+// the logger, which is shared by every request, so it is set and the line
+// written while holding logMu.
+func (fs *httpfsServer) logf(level sysdlog.Level, format string, args ...interface{}) {
+	fs.logMu.Lock()
+	defer fs.logMu.Unlock()
+	fs.logger.SetLevel(level)
+	fs.logger.Printf(format, args...)
+}
+
+// openLog creates the writer for the server's log, appending to the file at
+// path, or writing to stdout if path is empty, and discarding lines less
+// severe than level.
+func openLog(path, level string) (io.Writer, error) {
+	max, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	var w io.Writer = os.Stdout
+	if path != "" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, filePerm)
+		if err != nil {
+			return nil, fmt.Errorf("error opening log file '%s': %w", path, err)
+		}
+		w = file
+	}
+
+	return &levelFilter{w: w, max: max}, nil
+}
+
+// accessRecord is a structured log entry for a single request.
+type accessRecord struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"` // relative to the sandbox
+	Key        string    `json:"key"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Status     int       `json:"status"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	DurationMS float64   `json:"duration_ms"`
+}
+
+// sampleLog reports if a successful request should be logged when only 1 in
+// rate of them are.
+func (fs *httpfsServer) sampleLog(rate int) bool {
+	n := atomic.AddUint32(&fs.requests, 1)
+	return rate <= 1 || n%uint32(rate) == 1
+}
+
+// loggedKeyKey is the context key of the api key given in a request's
+// access record.
+type loggedKeyKey struct{}
+
+// setLoggedKey gives key, as stored in the config, as the api key of req's
+// access record, if it has one.
+func setLoggedKey(req *http.Request, key apikey) {
+	if logged, ok := req.Context().Value(loggedKeyKey{}).(*string); ok {
+		*logged = string(key)
+	}
+}
+
+// keyID gives an identifier for an api key which can be logged without
+// revealing the key itself: the first 8 hex digits of its SHA-256. Keys
+// are identified as stored in the config, so hashed keys by their
+// "sha256$salt$hash" form, except for unrecognized keys, which have no
+// stored form.
+func keyID(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// responseRecorder wraps a ResponseWriter to record the response status and
+// number of bytes written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush sends any buffered data to the client, if the wrapped ResponseWriter
+// supports it.
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.bytes += int64(n)
+	return n, err
+}
+
+// logAccess writes a JSON accessRecord for each request handled by h when
+// the JSON log format is configured.
+func (fs *httpfsServer) logAccess(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if fs.config().LogFormat != logFormatJSON {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		body := &countingReader{ReadCloser: req.Body}
+		req.Body = body
+		_, given, _ := req.BasicAuth()
+		key := &given // replaced by the key as stored once it is found
+		req = req.WithContext(context.WithValue(req.Context(), loggedKeyKey{}, key))
+
+		h.ServeHTTP(rec, req)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status < http.StatusBadRequest && !fs.sampleLog(fs.config().LogSampleRate) {
+			return
+		}
+		data, err := json.Marshal(accessRecord{
+			Time:       start.UTC(),
+			RequestID:  requestID(req),
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			Key:        keyID(*key),
+			UserAgent:  req.UserAgent(),
+			Status:     rec.status,
+			BytesIn:    body.bytes,
+			BytesOut:   rec.bytes,
+			DurationMS: float64(time.Since(start)) / float64(time.Millisecond),
+		})
+		if err != nil {
+			fs.logf(sysdlog.Err, "error encoding access record: %s\n", err)
+			return
+		}
+		fs.logf(sysdlog.Info, "%s\n", string(data))
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/quillaja/sysdlog"
+)
+
+// readLog gives the lines written to the log of a server set up with cfg.
+func readLog(t *testing.T, cfg Config) []string {
+	t.Helper()
+	data, err := os.ReadFile(cfg.LogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+// accessRecords parses the JSON access records in the log of a server set
+// up with cfg.
+func accessRecords(t *testing.T, cfg Config) []accessRecord {
+	t.Helper()
+	var records []accessRecord
+	for _, line := range readLog(t, cfg) {
+		start := strings.IndexByte(line, '{')
+		if start < 0 {
+			continue
+		}
+		var rec accessRecord
+		if err := json.Unmarshal([]byte(line[start:]), &rec); err != nil {
+			t.Fatalf("error parsing log line %q: %s", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestJSONAccessLog(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.LogFormat = logFormatJSON
+	fs := newTestServer(t, cfg)
+
+	req := newRequest(http.MethodPut, "/dir/file.txt", testKey, strings.NewReader("0123456789"))
+	req.Header.Set("User-Agent", "tester/1.0")
+	expectStatus(t, serve(fs, req), http.StatusOK)
+	resp := do(fs, http.MethodGet, "/dir/file.txt", testKey, "")
+	readBody(t, resp)
+	do(fs, http.MethodGet, "/missing.txt", testKey, "")
+
+	records := accessRecords(t, cfg)
+	if len(records) != 3 {
+		t.Fatalf("got %d access records, want 3", len(records))
+	}
+	put, get, missing := records[0], records[1], records[2]
+	if put.Method != http.MethodPut || put.Path != "/dir/file.txt" || put.Status != http.StatusOK || put.BytesIn != 10 {
+		t.Errorf("PUT logged as %+v", put)
+	}
+	if put.Key != keyID(testKey) || put.UserAgent != "tester/1.0" || put.RequestID == "" || put.Time.IsZero() {
+		t.Errorf("PUT logged as %+v", put)
+	}
+	if get.Method != http.MethodGet || get.BytesOut != 10 || get.DurationMS < 0 {
+		t.Errorf("GET logged as %+v", get)
+	}
+	if missing.Status != http.StatusNotFound {
+		t.Errorf("GET of a missing file logged as %+v", missing)
+	}
+
+	// the key itself is never logged
+	if data, _ := os.ReadFile(cfg.LogFile); strings.Contains(string(data), testKey) {
+		t.Errorf("log contains the api key: %s", data)
+	}
+}
+
+func TestTextLogHasNoAccessRecords(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.LogFormat = logFormatText
+	fs := newTestServer(t, cfg)
+	expectStatus(t, do(fs, http.MethodPut, "/file.txt", testKey, "content"), http.StatusOK)
+
+	if records := accessRecords(t, cfg); len(records) != 0 {
+		t.Errorf("text log has JSON records %+v", records)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := map[string]sysdlog.Level{
+		"":        sysdlog.Info,
+		"info":    sysdlog.Info,
+		"DEBUG":   sysdlog.Debug,
+		"Warning": sysdlog.Warning,
+		"err":     sysdlog.Err,
+		"emerg":   sysdlog.Emerg,
+	}
+	for name, want := range tests {
+		if level, err := parseLogLevel(name); err != nil || level != want {
+			t.Errorf("level %q parsed as %v, %v, want %v", name, level, err, want)
+		}
+	}
+	if _, err := parseLogLevel("loud"); err == nil {
+		t.Error("unknown level parsed")
+	}
+}
+
+func TestLogFileLevel(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.LogLevel = "warning"
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+
+	expectStatus(t, do(fs, http.MethodGet, "/file.txt", testKey, ""), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodGet, "/file.txt", "wrong-key", ""), http.StatusUnauthorized)
+
+	log := strings.Join(readLog(t, cfg), "\n")
+	if !strings.Contains(log, "unrecognized") {
+		t.Errorf("warning wasn't logged to the file:\n%s", log)
+	}
+	if strings.Contains(log, "GET") {
+		t.Errorf("info was logged below the warning level:\n%s", log)
+	}
+}
+
+func TestConcurrentLogLevels(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.LogLevel = "warning"
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+
+	const n = 200
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			do(fs, http.MethodGet, "/file.txt", testKey, "")
+		}()
+		go func() {
+			defer wg.Done()
+			do(fs, http.MethodGet, "/file.txt", "wrong-key", "")
+		}()
+	}
+	wg.Wait()
+
+	warnings, infos := 0, 0
+	for _, line := range readLog(t, cfg) {
+		switch {
+		case strings.Contains(line, "unrecognized api key"):
+			warnings++
+		case strings.Contains(line, "GET '"):
+			infos++
+		}
+	}
+	if warnings != n || infos != 0 {
+		t.Errorf("logged %d of %d warnings and %d info lines below the level", warnings, n, infos)
+	}
+}
+
+func TestLogFileMustOpen(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.LogFile = filepath.Join(t.TempDir(), "missing", "dir", "httpfs.log")
+	if _, err := NewHTTPFSServer(cfg); err == nil {
+		t.Error("server created with a log file which can't be opened")
+	}
+}
+
+func TestAuthFailureLoggedAtWarning(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	expectStatus(t, do(fs, http.MethodGet, "/file.txt", "wrong-key", ""), http.StatusUnauthorized)
+
+	for _, line := range readLog(t, cfg) {
+		if strings.Contains(line, "unrecognized api key") {
+			if want := "<" + strconv.Itoa(int(sysdlog.Warning)) + ">"; !strings.HasPrefix(line, want) {
+				t.Errorf("auth failure logged as %q, want level prefix %s", line, want)
+			}
+			return
+		}
+	}
+	t.Error("auth failure wasn't logged")
+}
+
+func TestLogSampleRate(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.LogFormat = logFormatJSON
+	cfg.LogSampleRate = 5
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+
+	for i := 0; i < 10; i++ {
+		expectStatus(t, do(fs, http.MethodGet, "/file.txt", testKey, ""), http.StatusOK)
+	}
+	for i := 0; i < 3; i++ {
+		expectStatus(t, do(fs, http.MethodGet, "/missing.txt", testKey, ""), http.StatusNotFound)
+		expectStatus(t, do(fs, http.MethodGet, "/file.txt", "wrong-key", ""), http.StatusUnauthorized)
+	}
+
+	counts := make(map[int]int)
+	for _, rec := range accessRecords(t, cfg) {
+		counts[rec.Status]++
+	}
+	if counts[http.StatusOK] != 2 {
+		t.Errorf("logged %d of 10 successful requests, want 2", counts[http.StatusOK])
+	}
+	if counts[http.StatusNotFound] != 3 || counts[http.StatusUnauthorized] != 3 {
+		t.Errorf("logged %d of 3 missing files and %d of 3 auth failures, want all", counts[http.StatusNotFound], counts[http.StatusUnauthorized])
+	}
+
+	// text logs are sampled the same way
+	cfg = testConfig(t)
+	cfg.LogSampleRate = 5
+	fs = newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+	for i := 0; i < 10; i++ {
+		expectStatus(t, do(fs, http.MethodGet, "/file.txt", testKey, ""), http.StatusOK)
+	}
+	for i := 0; i < 3; i++ {
+		expectStatus(t, do(fs, http.MethodGet, "/file.txt", "wrong-key", ""), http.StatusUnauthorized)
+	}
+	gets, failures := 0, 0
+	for _, line := range readLog(t, cfg) {
+		if strings.Contains(line, "GET '") {
+			gets++
+		}
+		if strings.Contains(line, "unrecognized api key") {
+			failures++
+		}
+	}
+	if gets != 2 || failures != 3 {
+		t.Errorf("text log has %d of 10 requests and %d of 3 auth failures, want 2 and 3", gets, failures)
+	}
+}
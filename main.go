@@ -3,10 +3,44 @@
 // (eg www.example.com/mypath/myfile.txt) and the action is specified using
 // HTTP methods:
 //
-// 		GET - read the entire file
-//		POST - create/append to the file
-//		PUT - create/truncate (overwrite) the file
-//		DELETE - delete the file
+// 		GET - read the entire file, or list a directory if the path ends in '/' (serving its `index.html`, or other `IndexFiles`, if present)
+//		HEAD - read the file's size and modification time
+//		POST - create/append to the file, or only create it with `?mode=create`
+//		PUT - create/truncate (overwrite) the file, or write only the range in a `Content-Range` header
+//		PATCH - write into the file at the byte given by `?offset=N`, or merge a JSON document with `Content-Type: application/merge-patch+json`
+//		DELETE - delete the file or empty directory, or a directory and its contents with `?recursive=true`, also removing parent directories left empty with `?prune=true`
+//		MOVE - move the file to the path in the `Destination` header
+//		COPY - copy the file to the path in the `Destination` header
+//		PROPFIND - describe the file, or a directory and its contents, for WebDAV clients
+//
+// Large uploads may be resumed using an upload session. `POST` with
+// `?upload=init` replies with an `id`, chunks are written with `PATCH` to
+// `?upload=<id>&offset=N` in any order, and `POST` with `?upload=finish&id=<id>`
+// moves the upload into place. Sessions untouched for a day are abandoned.
+// `?upload=init&size=N` declares the upload's size; chunks outside it are
+// refused with 416. Chunks starting more than 64MiB past the end of the
+// partial upload, or taking it past `MaxUploadBytes`, are refused with 413.
+//
+// Uploads sent with `Content-Encoding: gzip` are decompressed before being stored.
+// Clients accepting gzip are sent `<path>.gz` in place of `<path>` if it exists
+// and is not older than `<path>`, with `Content-Encoding: gzip`.
+// Uploads sent with `Expect: 100-continue` are refused, if they would be, before
+// the client is asked for the body.
+//
+// Uploads given an `X-Modified-Time` header (RFC 3339) have their modification
+// time set to it.
+//
+// Paths through symlinks are refused with 403 Forbidden unless `FollowSymlinks`
+// is set in the config.
+//
+// Directories are listed as JSON, or as names one to a line or an HTML page of
+// links if `?format=plain` or `?format=html` is given or the `Accept` header
+// prefers `text/plain` or `text/html`.
+//
+// GET with `?stat=1` describes a file as JSON (its size, modification time and
+// mode) rather than reading it, and also gives its SHA-256 with `&sha256=1`.
+// GET with `?follow=1` keeps the response open after reading a file, sending any
+// bytes appended to it until the client disconnects.
 //
 // Authorization credentials are provided via the `Authorization` HTTP header,
 // using the `Basic` scheme. Instead of a "password", a previously obtained API
@@ -18,7 +52,20 @@
 //
 // A settings file must be provided. `APIKeys` maps api keys to their "sandbox"
 // subdirectory of the `FileRoot`. API keys must be unique, but multiple keys
-// can map to the same subdirectory.
+// can map to the same subdirectory. A key may instead map to an object giving
+// its subdirectory and permissions, any of 'r' (GET, HEAD, PROPFIND), 'w' (POST,
+// PUT, PATCH) and 'd' (DELETE). MOVE needs both 'w' and 'd', and COPY both 'r'
+// and 'w'. Keys mapping to a bare subdirectory have all permissions.
+// An object may also give a "quota" limiting the bytes stored by the key
+// and "max_files" limiting the number of files it stores.
+// "allowed_extensions" and "denied_extensions" (eg [".txt", ".csv"]) restrict
+// the extensions of the files it may write.
+// "bandwidth_bytes_per_sec" limits the bytes a second the key may upload and
+// download over all its requests.
+// Responses to keys with a quota give the bytes stored in `X-Storage-Used` and
+// the quota in `X-Storage-Quota`.
+// Keys may be stored hashed rather than in plaintext, using the value printed
+// by the `-hashkey` flag in place of the key.
 // For example:
 //
 //		{
@@ -28,50 +75,161 @@
 //		  "TLSKeyPath": "path/to/key",
 //		  "APIKeys": {
 //		    "SOME_KEY_1234": "hamburger",
-//		    "ANOTHER_KEY_0987": "hotdog"
+//		    "ANOTHER_KEY_0987": "hotdog",
+//		    "READ_ONLY_KEY_5678": {"dir": "hotdog", "perms": "r"},
+//		    "sha256$<salt>$<hash>": "hamburger"
 //		  }
 //		}
 //
+// Keys may also be kept in a separate file, given by `APIKeysFile`, in the same
+// form as `APIKeys`. Keys in the file replace any of the same name in `APIKeys`.
+//
+// TLS connections must use TLS 1.2 or later unless `TLSMinVersion` gives another
+// version, and `TLSCipherSuites` may restrict the cipher suites offered.
+// Without certificate files, certificates for the `ACMEDomains` are obtained
+// and renewed automatically from Let's Encrypt and kept in `ACMECacheDir`.
+// HTTP/2 is served over TLS unless `HTTP2Enabled` is false, and `H2CEnabled`
+// serves it without TLS too, for clients with prior knowledge.
+//
+// Settings may also be given by the environment variables `HTTPFS_ADDRESS`,
+// `HTTPFS_FILEROOT`, `HTTPFS_TLS_CERT`, `HTTPFS_TLS_KEY`, and `HTTPFS_API_KEYS`
+// (a comma separated list of key=dir), which override those in the settings
+// file. Use `-cfg env` to read settings from the environment alone.
+// Use `-check` to check the settings, including that the TLS files load and
+// `FileRoot` is writable, without starting the server.
+//
+// Sending the process SIGHUP reloads the settings file. Changes to `Address`
+// and the TLS settings require a restart.
+//
+// Keys listed in `AdminKeys` may GET `/_admin/usage` for the bytes stored in
+// each subdirectory, and `/_admin/access` for when each API key was last used,
+// by the first 8 hex digits of the key's SHA-256, as keys are given in the log.
+// The SHA-256 is of the key as written in the config, which for hashed keys is
+// the whole `sha256$<salt>$<hash>` string. Only unrecognized keys are given by
+// the SHA-256 of the key sent.
+// The times are kept across restarts in `AccessTimesFile`, if set.
+//
+// In maintenance mode, requests changing files are refused with 503 and a
+// `Retry-After` header while reads continue to work. Sending SIGUSR1 toggles
+// it, as does PUT `/_admin/maintenance?enabled=true` (or `false`) with an
+// admin key. GET `/_admin/maintenance` reports whether it is on.
+//
+// Requests without an API key or signed url may GET and HEAD files in the
+// subdirectory of `FileRoot` given by `PublicDir`, if set.
+// `RootResponse`, if set, is instead the reply to GET `/` without an API key:
+// a redirect to its `Redirect`, or else its `Body` with its `ContentType`.
+//
+// `VirtualHosts` maps host names to their own `FileRoot`, `APIKeys`,
+// `PublicDir` and `RootResponse`, used for requests whose `Host` header names
+// them. Other hosts use the top level settings.
+//
+// A key given a `signing_secret` may GET `/_sign/<path>` for a url granting
+// access to `<path>` without the key, for `?method=` (GET by default) until
+// `?ttl=` seconds (3600 by default) have passed. The url's query, including
+// any other parameters given, and the `Destination` header, set by
+// `?destination=` for MOVE and COPY, are signed and cannot be changed.
+//
+// Many files may be deleted at once by POSTing a JSON array of their paths to
+// `/_batch/delete`, which replies with the status of deleting each path.
+//
+// `/healthz` responds with 200 when `FileRoot` is accessible and 503 otherwise.
+// It does not require an API key.
+//
+// `/_version` gives the version, commit and build time of the binary as JSON,
+// also without an API key. They are set when building with
+// `-ldflags "-X main.version=... -X main.commit=... -X main.buildTime=..."`.
+//
+// `/_capabilities` describes the features enabled by the settings, such as the
+// maximum upload size and whether quotas, encryption and the trash are in use,
+// as JSON for clients to adapt to. It does not require an API key either.
+//
 package main
 
 import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 )
 
 func main() {
 	configPath := flag.String("cfg", "config.json",
-		"File containing program settings. If set to 'default', a template config file will be written to 'default.json'.")
+		"File containing program settings. If set to 'default', a template config file will be written to 'default.json'. "+
+			"If set to 'env', settings are read from environment variables only.")
+	check := flag.Bool("check", false,
+		"Check the settings, including that the TLS files load and FileRoot is writable, then exit without starting the server.")
+	hashKey := flag.String("hashkey", "",
+		"Print the salted hash of the given api key, for use in place of the plaintext key in the config file.")
 	flag.Parse()
 
+	if *hashKey != "" {
+		hashed, err := hashAPIKey(*hashKey)
+		if err != nil {
+			fmt.Printf("error hashing key: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(hashed)
+		os.Exit(0)
+	}
+
 	if *configPath == "default" {
 		DefaultConfig().Save("default.json")
 		fmt.Println("Default template config file written to 'default.json'.")
 		os.Exit(0)
 	}
-	cfg, err := OpenConfig(*configPath)
+	if *check {
+		os.Exit(checkConfig(*configPath, os.Stdout))
+	}
+	cfg, err := loadConfig(*configPath)
 	if err != nil {
 		fmt.Printf("fatal error opening config '%s': %s\n", *configPath, err)
 		os.Exit(1)
 	}
 
-	fs := NewHTTPFSServer(cfg)
+	fs, err := NewHTTPFSServer(cfg)
+	if err != nil {
+		fmt.Printf("fatal error setting up server: %s\n", err)
+		os.Exit(1)
+	}
 	go func() {
 		if fs.ListenAndServe() != nil {
 			os.Exit(1)
 		}
 	}()
 
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt, os.Kill, syscall.SIGTERM)
-	<-sig
+	// SIGHUP reloads the config, SIGUSR1 toggles maintenance mode, anything
+	// else shuts down
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+	for s := <-sig; s == syscall.SIGHUP || s == syscall.SIGUSR1; s = <-sig {
+		if s == syscall.SIGUSR1 {
+			fs.toggleMaintenance()
+			continue
+		}
+		fs.ReloadConfig(*configPath)
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), fs.config().shutdownTimeout())
 	defer cancel()
 	fs.Shutdown(ctx)
 }
+
+// checkConfig loads and checks the config at configPath for the -check flag,
+// writing a summary to out. It gives the status to exit with.
+func checkConfig(configPath string, out io.Writer) int {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(out, "fatal error opening config '%s': %s\n", configPath, err)
+		return 1
+	}
+	if err := cfg.Check(); err != nil {
+		fmt.Fprintf(out, "config '%s' failed checks: %s\n", configPath, err)
+		return 1
+	}
+	fmt.Fprintf(out, "config '%s' is ok: %d api keys, serving '%s' on %s\n",
+		configPath, len(cfg.APIKeys), cfg.FileRoot, cfg.Address)
+	return 0
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckFlag(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(t)
+	cfg.FileRoot = filepath.Join(dir, "missing", "files")
+	cfg.LogFile = filepath.Join(dir, "httpfs.log")
+	good := writeConfigFile(t, cfg)
+	badCert := cfg
+	badCert.TLSCertPath = filepath.Join(t.TempDir(), "garbage.pem")
+	badCert.TLSKeyPath = badCert.TLSCertPath
+	os.WriteFile(badCert.TLSCertPath, []byte("not a certificate"), filePerm)
+	failing := writeConfigFile(t, badCert)
+	cfg.Address = ""
+	invalid := writeConfigFile(t, cfg)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		output string
+	}{
+		{"good config", good, 0, "is ok: 1 api keys, serving '" + filepath.Join(dir, "missing", "files") + "'"},
+		{"bad certificate", failing, 1, "failed checks: error loading TLS certificate"},
+		{"invalid config", invalid, 1, "Address is empty"},
+		{"missing config", filepath.Join(dir, "missing.json"), 1, "fatal error opening config"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if status := checkConfig(test.path, &out); status != test.status {
+			t.Errorf("%s: exit status %d, want %d", test.name, status, test.status)
+		}
+		if !strings.Contains(out.String(), test.output) {
+			t.Errorf("%s: printed %q, want it to contain %q", test.name, out.String(), test.output)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("%s: check created %v", test.name, entries)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/quillaja/sysdlog"
+)
+
+// seconds clients are told to wait before retrying changes refused during
+// maintenance
+const maintenanceRetryAfter = 60
+
+// setMaintenance turns maintenance mode, in which files may be read but not
+// changed, on or off.
+func (fs *httpfsServer) setMaintenance(on bool) {
+	flag, state := int32(0), "off"
+	if on {
+		flag, state = 1, "on"
+	}
+	if atomic.SwapInt32(&fs.maintenance, flag) != flag {
+		fs.logf(sysdlog.Notice, "maintenance mode %s\n", state)
+	}
+}
+
+// toggleMaintenance turns maintenance mode off if on, and on if off.
+func (fs *httpfsServer) toggleMaintenance() {
+	fs.setMaintenance(!fs.inMaintenance())
+}
+
+// inMaintenance reports if maintenance mode is on.
+func (fs *httpfsServer) inMaintenance() bool {
+	return atomic.LoadInt32(&fs.maintenance) == 1
+}
+
+// refuseMaintenance replies that changes are refused during maintenance.
+func refuseMaintenance(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+	writeJSONError(w, http.StatusServiceUnavailable, "in maintenance, files are read only")
+}
+
+// maintenanceReport replies with whether maintenance mode is on, after
+// turning it on or off as given by "enabled" for PUT requests.
+func (fs *httpfsServer) maintenanceReport(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		on, err := strconv.ParseBool(req.URL.Query().Get("enabled"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid enabled")
+			return
+		}
+		fs.setMaintenance(on)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Enabled bool `json:"enabled"`
+	}{fs.inMaintenance()})
+}
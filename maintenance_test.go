@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// expectMaintenance fails the test if the maintenance report in resp
+// doesn't say maintenance mode is on as given by enabled.
+func expectMaintenance(t *testing.T, resp *http.Response, enabled bool) {
+	t.Helper()
+	expectStatus(t, resp, http.StatusOK)
+	var report struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("maintenance report isn't JSON: %s", err)
+	}
+	if report.Enabled != enabled {
+		t.Errorf("got maintenance %t, want %t", report.Enabled, enabled)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AdminKeys = []apikey{"admin-key"}
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "a.txt", "original")
+
+	expectMaintenance(t, do(fs, http.MethodGet, adminPrefix+"maintenance", "admin-key", ""), false)
+	expectMaintenance(t, do(fs, http.MethodPut, adminPrefix+"maintenance?enabled=true", "admin-key", ""), true)
+	expectJSONError(t, do(fs, http.MethodPut, adminPrefix+"maintenance?enabled=maybe", "admin-key", ""), http.StatusBadRequest)
+	expectJSONError(t, do(fs, http.MethodPut, adminPrefix+"maintenance?enabled=false", testKey, ""), http.StatusForbidden)
+
+	resp := do(fs, http.MethodGet, "/a.txt", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); body != "original" {
+		t.Errorf("got %q during maintenance, want %q", body, "original")
+	}
+
+	for _, method := range []string{http.MethodPut, http.MethodPost, http.MethodPatch, http.MethodDelete} {
+		resp := do(fs, method, "/a.txt", testKey, "changed")
+		if resp.Header.Get("Retry-After") != strconv.Itoa(maintenanceRetryAfter) {
+			t.Errorf("%s got Retry-After %q, want %d", method, resp.Header.Get("Retry-After"), maintenanceRetryAfter)
+		}
+		expectJSONError(t, resp, http.StatusServiceUnavailable)
+	}
+	expectJSONError(t, batchDelete(fs, "", testKey, "a.txt"), http.StatusServiceUnavailable)
+	if got := readSandboxFile(t, cfg, "a.txt"); got != "original" {
+		t.Errorf("file changed to %q during maintenance", got)
+	}
+
+	// the signal handler toggles maintenance the same way
+	fs.toggleMaintenance()
+	expectMaintenance(t, do(fs, http.MethodGet, adminPrefix+"maintenance", "admin-key", ""), false)
+	expectStatus(t, do(fs, http.MethodPut, "/a.txt", testKey, "changed"), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "a.txt"); got != "changed" {
+		t.Errorf("got %q after maintenance, want %q", got, "changed")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+)
+
+// content type of the body of PATCH requests holding a JSON merge patch
+const mergePatchType = "application/merge-patch+json"
+
+// errNotJSON is returned when merging a patch into a file which isn't JSON.
+var errNotJSON = errors.New("file is not JSON")
+
+// errInvalidPatch is returned for merge patches which aren't valid JSON.
+var errInvalidPatch = errors.New("invalid JSON merge patch")
+
+// isMergePatch reports if the request body is a JSON merge patch.
+func isMergePatch(req *http.Request) bool {
+	mediatype, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediatype == mergePatchType
+}
+
+// mergeJSON applies the JSON merge patch (RFC 7386) read from patch to the
+// JSON document in the file at path, decrypting it with aead if not nil, and
+// gives the resulting document. A missing file is patched as if empty.
+func mergeJSON(store Storage, path string, patch io.Reader, aead cipher.AEAD) ([]byte, error) {
+	var changes interface{}
+	dec := json.NewDecoder(patch)
+	dec.UseNumber()
+	if err := dec.Decode(&changes); err != nil {
+		if isBodyTooLarge(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error parsing patch for '%s': %w", path, errInvalidPatch)
+	}
+
+	var doc interface{}
+	file, err := store.Open(path)
+	if err == nil {
+		defer file.Close()
+		content, _, err := plaintext(file, aead)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting file '%s': %w", path, err)
+		}
+		dec := json.NewDecoder(content)
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("error parsing file '%s': %w", path, errNotJSON)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error opening file '%s': %w", path, err)
+	}
+
+	merged, err := json.Marshal(mergePatch(doc, changes))
+	if err != nil {
+		return nil, fmt.Errorf("error encoding patched '%s': %w", path, err)
+	}
+	return merged, nil
+}
+
+// mergePatch applies the merge patch to target. Members of an object patch
+// replace those of target, recursively, and are removed if null. Any other
+// patch replaces target entirely.
+func mergePatch(target, patch interface{}) interface{} {
+	members, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	result, ok := target.(map[string]interface{})
+	if !ok {
+		result = make(map[string]interface{})
+	}
+	for name, value := range members {
+		if value == nil {
+			delete(result, name)
+		} else {
+			result[name] = mergePatch(result[name], value)
+		}
+	}
+	return result
+}
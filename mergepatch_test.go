@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mergeRequest PATCHes the merge patch into the file at target.
+func mergeRequest(fs *httpfsServer, target, patch string) *http.Response {
+	req := newRequest(http.MethodPatch, target, testKey, strings.NewReader(patch))
+	req.Header.Set("Content-Type", mergePatchType)
+	return serve(fs, req)
+}
+
+// expectJSONFile checks that the file holds JSON equal to want.
+func expectJSONFile(t *testing.T, cfg Config, resource, want string) {
+	t.Helper()
+	var got, wanted interface{}
+	if err := json.Unmarshal([]byte(readSandboxFile(t, cfg, resource)), &got); err != nil {
+		t.Fatalf("%s isn't JSON: %s", resource, err)
+	}
+	json.Unmarshal([]byte(want), &wanted)
+	if !reflect.DeepEqual(got, wanted) {
+		t.Errorf("%s holds %v, want %v", resource, got, wanted)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "config.json", `{"name": "httpfs", "nested": {"a": 1, "b": 2}, "old": true}`)
+
+	expectStatus(t, mergeRequest(fs, "/config.json", `{"added": [1, 2]}`), http.StatusOK)
+	expectJSONFile(t, cfg, "config.json", `{"name": "httpfs", "nested": {"a": 1, "b": 2}, "old": true, "added": [1, 2]}`)
+
+	expectStatus(t, mergeRequest(fs, "/config.json", `{"old": null, "nested": {"a": null, "c": 3}}`), http.StatusOK)
+	expectJSONFile(t, cfg, "config.json", `{"name": "httpfs", "nested": {"b": 2, "c": 3}, "added": [1, 2]}`)
+
+	// a missing file is patched as if empty
+	expectStatus(t, mergeRequest(fs, "/new.json", `{"a": {"b": null, "c": 1}}`), http.StatusOK)
+	expectJSONFile(t, cfg, "new.json", `{"a": {"c": 1}}`)
+
+	// large numbers are kept exactly
+	expectStatus(t, mergeRequest(fs, "/new.json", `{"big": 12345678901234567890}`), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "new.json"); !strings.Contains(got, "12345678901234567890") {
+		t.Errorf("large number changed: %s", got)
+	}
+}
+
+func TestMergePatchRejected(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "config.json", `{"name": "httpfs"}`)
+	writeSandboxFile(t, cfg, "notes.txt", "not json")
+
+	expectJSONError(t, mergeRequest(fs, "/config.json", `{"name": `), http.StatusBadRequest)
+	expectJSONError(t, mergeRequest(fs, "/notes.txt", `{"name": "x"}`), http.StatusBadRequest)
+	expectJSONFile(t, cfg, "config.json", `{"name": "httpfs"}`)
+	if got := readSandboxFile(t, cfg, "notes.txt"); got != "not json" {
+		t.Errorf("non-JSON target changed to %q", got)
+	}
+}
+
+func TestMergePatchRFCExamples(t *testing.T) {
+	// from the appendix of RFC 7386
+	tests := []struct{ target, patch, result string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, test := range tests {
+		var target, patch, want interface{}
+		json.Unmarshal([]byte(test.target), &target)
+		json.Unmarshal([]byte(test.patch), &patch)
+		json.Unmarshal([]byte(test.result), &want)
+		if got := mergePatch(target, patch); !reflect.DeepEqual(got, want) {
+			t.Errorf("patching %s with %s gave %v, want %s", test.target, test.patch, got, test.result)
+		}
+	}
+}
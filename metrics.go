@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/quillaja/sysdlog"
+)
+
+// metrics holds the prometheus instrumentation of the server.
+type metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// newMetrics creates and registers the server's metrics. Bytes stored per
+// sandbox are gathered from the usageTracker when scraped.
+func newMetrics(fs *httpfsServer) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "httpfs_requests_total",
+			Help: "Number of requests by method and status code.",
+		}, []string{"method", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "httpfs_request_duration_seconds",
+			Help:    "Time taken to handle requests by method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method"}),
+	}
+	m.registry.MustRegister(m.requests, m.duration, &storedCollector{fs: fs})
+	return m
+}
+
+// Handler serves the metrics in the prometheus exposition format.
+func (m *metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Instrument records the request count and duration for requests handled by h.
+func (m *metrics) Instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+
+		h.ServeHTTP(rec, req)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		method := methodLabel(req.Method)
+		m.requests.WithLabelValues(method, strconv.Itoa(rec.status)).Inc()
+		m.duration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// methodLabel gives the method as labelled in metrics. Methods which aren't
+// handled are all labelled "other", so clients can't create any number of
+// series by sending made up methods.
+func methodLabel(method string) string {
+	if _, known := methodPerms[method]; known || method == http.MethodOptions {
+		return method
+	}
+	return "other"
+}
+
+// storedCollector reports the bytes stored in every configured sandbox,
+// those of virtual hosts included, labelled by the sandbox's path.
+type storedCollector struct {
+	fs *httpfsServer
+}
+
+var storedDesc = prometheus.NewDesc(
+	"httpfs_stored_bytes",
+	"Bytes stored in each sandbox directory.",
+	[]string{"sandbox"}, nil)
+
+func (c *storedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storedDesc
+}
+
+func (c *storedCollector) Collect(ch chan<- prometheus.Metric) {
+	seen := make(map[string]bool)
+	for _, sandbox := range c.fs.config().sandboxes() {
+		if seen[sandbox] {
+			continue
+		}
+		seen[sandbox] = true
+
+		used, err := c.fs.usage.Used(sandbox)
+		if err != nil {
+			c.fs.logf(sysdlog.Err, "error collecting stored bytes: %s\n", err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(storedDesc, prometheus.GaugeValue, float64(used), sandbox)
+	}
+}
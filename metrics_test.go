@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MetricsEnabled = true
+	vroot := filepath.Join(t.TempDir(), "vhost")
+	cfg.VirtualHosts = map[string]virtualHost{
+		"other.example": {FileRoot: vroot, APIKeys: map[apikey]keyConfig{"vkey": {Dir: "vdir", Perms: permAll}}},
+	}
+	fs := newTestServer(t, cfg)
+
+	expectStatus(t, do(fs, http.MethodPut, "/file.txt", testKey, "12345"), http.StatusOK)
+	req := newRequest(http.MethodPut, "/file.txt", "vkey", strings.NewReader("123"))
+	req.Host = "other.example"
+	expectStatus(t, serve(fs, req), http.StatusOK)
+	do(fs, http.MethodGet, "/missing.txt", testKey, "")
+	for _, method := range []string{"BREW", "FOO1", "foo2"} {
+		do(fs, method, "/file.txt", testKey, "")
+	}
+
+	resp := serve(fs, newRequest(http.MethodGet, "/metrics", "", nil))
+	expectStatus(t, resp, http.StatusOK)
+	body := readBody(t, resp)
+	for _, want := range []string{
+		`httpfs_requests_total{method="PUT",status="200"} 2`,
+		`httpfs_requests_total{method="GET",status="404"} 1`,
+		`httpfs_request_duration_seconds_count{method="PUT"} 2`,
+		`httpfs_requests_total{method="other",status="405"} 3`,
+		`httpfs_stored_bytes{sandbox="` + filepath.Join(cfg.FileRoot, "sandbox") + `"} 5`,
+		`httpfs_stored_bytes{sandbox="` + filepath.Join(vroot, "vdir") + `"} 3`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %s:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "BREW") || strings.Contains(body, "FOO1") {
+		t.Errorf("metrics are labelled with unknown methods:\n%s", body)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// memory used to hold multipart uploads before they are spooled to disk
+const multipartMemory = 32 * mebibyte
+
+// storedFile describes a file stored from a multipart upload.
+type storedFile struct {
+	Name string `json:"name"`
+	Path string `json:"path"` // relative to the sandbox
+	Size int64  `json:"size"`
+}
+
+// isMultipart reports if the request body is multipart/form-data.
+func isMultipart(req *http.Request) bool {
+	mediatype, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediatype == "multipart/form-data"
+}
+
+// storeMultipart writes each file in the multipart/form-data request into
+// the directory at localpath, using the filename given for each part, then
+// replies with a JSON array of the stored files.
+func (fs *httpfsServer) storeMultipart(w http.ResponseWriter, req *http.Request, sandbox, localpath string, keycfg keyConfig, aead cipher.AEAD, perms filePerms) error {
+	if err := req.ParseMultipartForm(multipartMemory); err != nil {
+		return fmt.Errorf("error parsing multipart form: %w", err)
+	}
+	defer req.MultipartForm.RemoveAll()
+
+	fields := make([]string, 0, len(req.MultipartForm.File))
+	for field := range req.MultipartForm.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	stored := []storedFile{}
+	for _, field := range fields {
+		for _, header := range req.MultipartForm.File[field] {
+			name := filepath.Base(header.Filename)
+			if name == "." || name == ".." || name == string(filepath.Separator) {
+				return fmt.Errorf("invalid filename '%s' in multipart form", header.Filename)
+			}
+			if !fs.config().AllowDotfiles && hasDotSegment(name) {
+				return errDotfile
+			}
+			if !keycfg.allowsName(name) {
+				return errExtension
+			}
+			resource := path.Join(req.URL.Path, name)
+			dest, err := sandboxPath(sandbox, resource)
+			if err != nil {
+				return err
+			}
+			if inTrash(relativePath(sandbox, dest)) {
+				return errTrash
+			}
+			if !fs.config().withinPathLimits(relativePath(sandbox, dest)) {
+				return errPathLimit
+			}
+			if !fs.config().CaseSensitivePaths && caseCollision(fs.storage, sandbox, dest) {
+				return errCaseCollision
+			}
+			if !fs.config().FollowSymlinks && hasSymlink(fs.storage, sandbox, dest) {
+				return errSymlink
+			}
+
+			if err := fs.storePart(req.Context(), sandbox, dest, header, aead, perms, keycfg.MaxFiles); err != nil {
+				return err
+			}
+			stored = append(stored, storedFile{Name: name, Path: resource, Size: header.Size})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stored); err != nil {
+		return fmt.Errorf("error writing multipart summary: %w", err)
+	}
+	return nil
+}
+
+// storePart writes the content of a multipart file to dest, keeping the
+// sandbox usage up to date. A new file is refused if the sandbox already
+// has maxFiles files.
+func (fs *httpfsServer) storePart(ctx context.Context, sandbox, dest string, header *multipart.FileHeader, aead cipher.AEAD, perms filePerms, maxFiles int64) error {
+	defer fs.locks.Lock(dest)()
+
+	part, err := header.Open()
+	if err != nil {
+		return fmt.Errorf("error opening multipart file for '%s': %w", dest, err)
+	}
+	defer part.Close()
+
+	oldSize, oldCount := fileSize(fs.storage, dest), fileCount(fs.storage, dest)
+	if oldCount == 0 {
+		if err := fs.usage.checkFileLimit(sandbox, maxFiles); err != nil {
+			return err
+		}
+	}
+	err = writeFile(ctx, fs.storage, os.O_TRUNC, dest, part, aead, perms, fs.config().CopyBufferBytes)
+	fs.usage.Add(sandbox, fileSize(fs.storage, dest)-oldSize, fileCount(fs.storage, dest)-oldCount)
+	return err
+}
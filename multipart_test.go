@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"testing"
+)
+
+// multipartRequest creates a multipart/form-data POST of the files, by name.
+func multipartRequest(t *testing.T, target string, files map[string]string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, content := range files {
+		part, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+	mw.Close()
+	req := newRequest(http.MethodPost, target, testKey, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestMultipartUpload(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+
+	req := multipartRequest(t, "/uploads", map[string]string{
+		"one.txt": "first file",
+		"two.txt": "second file",
+	})
+	resp := serve(fs, req)
+	expectStatus(t, resp, http.StatusOK)
+
+	var stored []storedFile
+	if err := json.NewDecoder(resp.Body).Decode(&stored); err != nil {
+		t.Fatalf("summary isn't JSON: %s", err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("summary lists %+v, want both files", stored)
+	}
+	for _, file := range stored {
+		if file.Path != "/uploads/"+file.Name || file.Size != int64(len(readSandboxFile(t, cfg, "uploads/"+file.Name))) {
+			t.Errorf("summary has %+v", file)
+		}
+	}
+	if got := readSandboxFile(t, cfg, "uploads/one.txt"); got != "first file" {
+		t.Errorf("one.txt has %q", got)
+	}
+	if got := readSandboxFile(t, cfg, "uploads/two.txt"); got != "second file" {
+		t.Errorf("two.txt has %q", got)
+	}
+	if exists(sandboxFile(cfg, "uploads")) && !isDir(localStorage{}, sandboxFile(cfg, "uploads")) {
+		t.Error("the request path was written as a file")
+	}
+}
+
+func TestMultipartFilenameSandboxed(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+
+	req := multipartRequest(t, "/uploads", map[string]string{"../../escaped.txt": "escaped"})
+	expectStatus(t, serve(fs, req), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "uploads/escaped.txt"); got != "escaped" {
+		t.Errorf("escaped.txt has %q", got)
+	}
+	if exists(sandboxFile(cfg, "escaped.txt")) || exists(sandboxFile(cfg, "../escaped.txt")) {
+		t.Error("filename escaped the request path")
+	}
+}
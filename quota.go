@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// errQuotaExceeded is returned when a write would take a key over its quota.
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// errFileLimitExceeded is returned when a write would take a key over its
+// limit on the number of files.
+var errFileLimitExceeded = errors.New("file limit exceeded")
+
+// sandboxUsage is the storage used by a sandbox.
+type sandboxUsage struct {
+	bytes int64
+	files int64
+}
+
+// usageTracker caches the bytes and files used by each sandbox directory so
+// that the directory doesn't need to be walked for every request.
+type usageTracker struct {
+	mu    sync.Mutex
+	store Storage
+	usage map[string]sandboxUsage // sandbox dir -> usage
+}
+
+// newUsageTracker creates an empty usageTracker of sandboxes in store.
+func newUsageTracker(store Storage) *usageTracker {
+	return &usageTracker{store: store, usage: make(map[string]sandboxUsage)}
+}
+
+// load gets the usage of the sandbox, walking the sandbox directory the
+// first time it is requested.
+func (u *usageTracker) load(sandbox string) (sandboxUsage, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if usage, found := u.usage[sandbox]; found {
+		return usage, nil
+	}
+	usage, err := dirUsage(u.store, sandbox)
+	if err != nil {
+		return sandboxUsage{}, err
+	}
+	u.usage[sandbox] = usage
+	return usage, nil
+}
+
+// Used gets the number of bytes used by the sandbox.
+func (u *usageTracker) Used(sandbox string) (int64, error) {
+	usage, err := u.load(sandbox)
+	return usage.bytes, err
+}
+
+// Files gets the number of files in the sandbox.
+func (u *usageTracker) Files(sandbox string) (int64, error) {
+	usage, err := u.load(sandbox)
+	return usage.files, err
+}
+
+// Add adjusts the usage of the sandbox by delta bytes and files. Sandboxes
+// which are not yet cached are ignored since they will be walked when first
+// needed.
+func (u *usageTracker) Add(sandbox string, bytes, files int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if usage, found := u.usage[sandbox]; found {
+		usage.bytes += bytes
+		usage.files += files
+		u.usage[sandbox] = usage
+	}
+}
+
+// Forget discards the cached usage of the sandbox, for when it has changed
+// by an unknown amount.
+func (u *usageTracker) Forget(sandbox string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.usage, sandbox)
+}
+
+// dirSize totals the size of all regular files within dir in store,
+// including its trash. A dir which doesn't exist yet is empty.
+func dirSize(store Storage, dir string) (int64, error) {
+	usage, err := dirUsage(store, dir)
+	return usage.bytes, err
+}
+
+// dirUsage totals the size and number of regular files within dir in store,
+// including its trash so that deleting doesn't free space until the trash
+// is purged. A dir which doesn't exist yet is empty.
+func dirUsage(store Storage, dir string) (sandboxUsage, error) {
+	var usage sandboxUsage
+	err := addUsage(store, dir, &usage)
+	if errors.Is(err, os.ErrNotExist) {
+		return sandboxUsage{}, nil
+	}
+	if err != nil {
+		return sandboxUsage{}, fmt.Errorf("error calculating size of '%s': %w", dir, err)
+	}
+	return usage, nil
+}
+
+// addUsage adds the size and number of regular files within dir, and the
+// directories within it, to usage.
+func addUsage(store Storage, dir string, usage *sandboxUsage) error {
+	entries, err := store.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			if err := addUsage(store, filepath.Join(dir, e.Name()), usage); err != nil {
+				return err
+			}
+			continue
+		}
+		if !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		usage.bytes += info.Size()
+		usage.files++
+	}
+	return nil
+}
+
+// fileSize gets the size of the file at path in store, or 0 if it doesn't
+// exist.
+func fileSize(store Storage, path string) int64 {
+	info, err := store.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
+
+// fileCount is 1 if there is a regular file at path in store, otherwise 0.
+func fileCount(store Storage, path string) int64 {
+	info, err := store.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return 1
+}
+
+// checkFileLimit returns errFileLimitExceeded if adding a file to the
+// sandbox would give it more than max files. A max of 0 is unlimited.
+func (u *usageTracker) checkFileLimit(sandbox string, max int64) error {
+	if max <= 0 {
+		return nil
+	}
+	files, err := u.Files(sandbox)
+	if err != nil {
+		return err
+	}
+	if files >= max {
+		return errFileLimitExceeded
+	}
+	return nil
+}
+
+// quotaReader reads from r until more than remaining bytes have been read,
+// at which point it returns errQuotaExceeded.
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if q.remaining < 0 {
+		return 0, errQuotaExceeded
+	}
+	if int64(len(p)) > q.remaining+1 {
+		p = p[:q.remaining+1] // one extra byte to detect going over
+	}
+	n, err := q.r.Read(p)
+	if int64(n) > q.remaining {
+		n = int(q.remaining)
+		q.remaining = -1
+		return n, errQuotaExceeded
+	}
+	q.remaining -= int64(n)
+	return n, err
+}
+
+// setStorageHeaders gives the bytes used by the sandbox, and the quota, in
+// the X-Storage-Used and X-Storage-Quota headers of the response if the key
+// has a quota.
+func (fs *httpfsServer) setStorageHeaders(w http.ResponseWriter, sandbox string, quota int64) {
+	if quota <= 0 {
+		return
+	}
+	used, err := fs.usage.Used(sandbox)
+	if err != nil {
+		return
+	}
+	w.Header().Set("X-Storage-Used", strconv.FormatInt(used, 10))
+	w.Header().Set("X-Storage-Quota", strconv.FormatInt(quota, 10))
+}
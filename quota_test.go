@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys[testKey] = keyConfig{Dir: "sandbox", Perms: permAll, QuotaBytes: 10}
+	fs := newTestServer(t, cfg)
+
+	expectStatus(t, do(fs, http.MethodPut, "/a.txt", testKey, "123456"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPut, "/b.txt", testKey, "12345"), http.StatusInsufficientStorage)
+	if exists(sandboxFile(cfg, "b.txt")) {
+		t.Error("refused upload was stored")
+	}
+	expectStatus(t, do(fs, http.MethodPost, "/a.txt", testKey, "12345"), http.StatusInsufficientStorage)
+	if got := readSandboxFile(t, cfg, "a.txt"); got != "123456" {
+		t.Errorf("refused append left %q", got)
+	}
+
+	// replacing a file only counts the difference
+	expectStatus(t, do(fs, http.MethodPut, "/a.txt", testKey, "1234567890"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPut, "/b.txt", testKey, "1"), http.StatusInsufficientStorage)
+
+	// deleting frees the space
+	expectStatus(t, do(fs, http.MethodDelete, "/a.txt", testKey, ""), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPut, "/b.txt", testKey, "1234567890"), http.StatusOK)
+}
+
+func TestQuotaWithoutContentLength(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys[testKey] = keyConfig{Dir: "sandbox", Perms: permAll, QuotaBytes: 10}
+	fs := newTestServer(t, cfg)
+
+	// a body of unknown length is cut off once over the quota
+	req := newRequest(http.MethodPut, "/big.txt", testKey, strings.NewReader(strings.Repeat("x", 100)))
+	req.ContentLength = -1
+	expectStatus(t, serve(fs, req), http.StatusInsufficientStorage)
+	if exists(sandboxFile(cfg, "big.txt")) {
+		t.Error("upload over the quota was stored")
+	}
+}
+
+func TestQuotaCountsExistingFiles(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys[testKey] = keyConfig{Dir: "sandbox", Perms: permAll, QuotaBytes: 10}
+	writeSandboxFile(t, cfg, "dir/existing.txt", "12345678")
+	fs := newTestServer(t, cfg)
+
+	resp := do(fs, http.MethodPut, "/new.txt", testKey, "123")
+	expectStatus(t, resp, http.StatusInsufficientStorage)
+	if got := resp.Header.Get("X-Storage-Used"); got != strconv.Itoa(8) {
+		t.Errorf("X-Storage-Used is %q, want 8", got)
+	}
+	expectStatus(t, do(fs, http.MethodPut, "/new.txt", testKey, "12"), http.StatusOK)
+}
+
+func TestQuotaReader(t *testing.T) {
+	data, err := io.ReadAll(&quotaReader{r: strings.NewReader("12345"), remaining: 4})
+	if err != errQuotaExceeded || string(data) != "1234" {
+		t.Errorf("read %q with error %v, want 1234 and errQuotaExceeded", data, err)
+	}
+
+	data, err = io.ReadAll(&quotaReader{r: strings.NewReader("1234"), remaining: 4})
+	if err != nil || string(data) != "1234" {
+		t.Errorf("read %q with error %v, want exactly the quota", data, err)
+	}
+}
+
+func TestMaxFiles(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys[testKey] = keyConfig{Dir: "sandbox", Perms: permAll, MaxFiles: 2}
+	fs := newTestServer(t, cfg)
+
+	expectStatus(t, do(fs, http.MethodPut, "/a.txt", testKey, "a"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPost, "/dir/b.txt", testKey, "b"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPut, "/c.txt", testKey, "c"), http.StatusInsufficientStorage)
+	expectStatus(t, do(fs, http.MethodPost, "/c.txt", testKey, "c"), http.StatusInsufficientStorage)
+	if exists(sandboxFile(cfg, "c.txt")) {
+		t.Error("file was created past the limit")
+	}
+
+	// existing files may still be written
+	expectStatus(t, do(fs, http.MethodPut, "/a.txt", testKey, "changed"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPost, "/dir/b.txt", testKey, "appended"), http.StatusOK)
+
+	// deleting frees a slot, even a whole directory
+	expectStatus(t, do(fs, http.MethodDelete, "/dir?recursive=true", testKey, ""), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPut, "/c.txt", testKey, "c"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPut, "/d.txt", testKey, "d"), http.StatusInsufficientStorage)
+}
+
+func TestStorageHeaders(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys[testKey] = keyConfig{Dir: "sandbox", Perms: permAll, QuotaBytes: 100}
+	cfg.APIKeys["unlimited"] = keyConfig{Dir: "other", Perms: permAll}
+	fs := newTestServer(t, cfg)
+
+	expectHeaders := func(resp *http.Response, used string) {
+		t.Helper()
+		if got := resp.Header.Get("X-Storage-Used"); got != used {
+			t.Errorf("X-Storage-Used is %q, want %s", got, used)
+		}
+		if got := resp.Header.Get("X-Storage-Quota"); got != "100" {
+			t.Errorf("X-Storage-Quota is %q, want 100", got)
+		}
+	}
+	resp := do(fs, http.MethodPut, "/a.txt", testKey, "123456")
+	expectStatus(t, resp, http.StatusOK)
+	expectHeaders(resp, "6") // after the write
+	expectHeaders(do(fs, http.MethodGet, "/a.txt", testKey, ""), "6")
+	expectHeaders(do(fs, http.MethodPost, "/a.txt", testKey, "7890"), "10")
+	expectHeaders(do(fs, http.MethodGet, "/missing.txt", testKey, ""), "10")
+	expectHeaders(do(fs, http.MethodDelete, "/a.txt", testKey, ""), "0")
+
+	// usage comes from the tracker, not walking the sandbox each request
+	writeSandboxFile(t, cfg, "behind-its-back.txt", "12345")
+	expectHeaders(do(fs, http.MethodGet, "/", testKey, ""), "0")
+
+	resp = do(fs, http.MethodPut, "/b.txt", "unlimited", "123")
+	if resp.Header.Get("X-Storage-Used") != "" || resp.Header.Get("X-Storage-Quota") != "" {
+		t.Error("storage headers given without a quota")
+	}
+	if resp := do(fs, http.MethodGet, "/a.txt", "wrong-key", ""); resp.Header.Get("X-Storage-Quota") != "" {
+		t.Error("storage headers given to an unauthenticated request")
+	}
+}
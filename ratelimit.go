@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiters holds a token bucket rate limiter for each api key.
+type rateLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter // api key -> limiter
+}
+
+// newRateLimiters creates an empty rateLimiters.
+func newRateLimiters() *rateLimiters {
+	return &rateLimiters{limiters: make(map[string]*rate.Limiter)}
+}
+
+// Allow reports if a request with the api key may proceed under a limit of
+// perSecond requests with bursts of up to burst requests. If not, the time
+// to wait before retrying is also given.
+func (r *rateLimiters) Allow(key string, perSecond float64, burst int) (bool, time.Duration) {
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(perSecond)))
+	}
+
+	r.mu.Lock()
+	lim, found := r.limiters[key]
+	if !found {
+		lim = rate.NewLimiter(rate.Limit(perSecond), burst)
+		r.limiters[key] = lim
+	}
+	r.mu.Unlock()
+
+	// settings may have been reloaded
+	if lim.Limit() != rate.Limit(perSecond) {
+		lim.SetLimit(rate.Limit(perSecond))
+	}
+	if lim.Burst() != burst {
+		lim.SetBurst(burst)
+	}
+
+	res := lim.Reserve()
+	if delay := res.Delay(); delay > 0 {
+		res.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+// concurrencyLimits counts the requests in progress for each api key.
+type concurrencyLimits struct {
+	mu       sync.Mutex
+	inFlight map[string]int // api key -> requests in progress
+}
+
+// newConcurrencyLimits creates an empty concurrencyLimits.
+func newConcurrencyLimits() *concurrencyLimits {
+	return &concurrencyLimits{inFlight: make(map[string]int)}
+}
+
+// Acquire reports if a request with the api key may proceed with fewer
+// than max requests already in progress for the key. If so, the returned
+// function must be called once the request is finished.
+func (c *concurrencyLimits) Acquire(key string, max int) (release func(), ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inFlight[key] >= max {
+		return nil, false
+	}
+	c.inFlight[key]++
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.inFlight[key]--
+		if c.inFlight[key] == 0 {
+			delete(c.inFlight, key)
+		}
+	}, true
+}
+
+// admit reports if a request with the api key is within the rate and
+// concurrency limits of settings, replying with 429 if not. If admitted, the
+// returned function must be called once the request is finished.
+func (fs *httpfsServer) admit(w http.ResponseWriter, settings Config, key string) (release func(), ok bool) {
+	if settings.RateLimitPerSecond > 0 {
+		if ok, wait := fs.limiters.Allow(key, settings.RateLimitPerSecond, settings.RateLimitBurst); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return nil, false
+		}
+	}
+	if max := settings.MaxConcurrentPerKey; max > 0 {
+		release, ok := fs.inFlight.Acquire(key, max)
+		if !ok {
+			writeJSONError(w, http.StatusTooManyRequests, "too many concurrent requests")
+			return nil, false
+		}
+		return release, true
+	}
+	return func() {}, true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RateLimitPerSecond = 1
+	cfg.RateLimitBurst = 3
+	cfg.APIKeys["other-key"] = keyConfig{Dir: "other", Perms: permAll}
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+
+	for i := 0; i < cfg.RateLimitBurst; i++ {
+		expectStatus(t, do(fs, http.MethodGet, "/file.txt", testKey, ""), http.StatusOK)
+	}
+	resp := do(fs, http.MethodGet, "/file.txt", testKey, "")
+	expectStatus(t, resp, http.StatusTooManyRequests)
+	if wait, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || wait < 1 {
+		t.Errorf("got Retry-After %q, want whole seconds", resp.Header.Get("Retry-After"))
+	}
+
+	// other keys aren't held back
+	expectStatus(t, do(fs, http.MethodGet, "/file.txt", "other-key", ""), http.StatusNotFound)
+}
+
+func TestRateLimitersReload(t *testing.T) {
+	limiters := newRateLimiters()
+	if ok, _ := limiters.Allow("key", 1, 1); !ok {
+		t.Fatal("first request refused")
+	}
+	if ok, _ := limiters.Allow("key", 1, 1); ok {
+		t.Fatal("request past the burst allowed")
+	}
+	// a higher limit after a reload applies to the existing limiter
+	limiters.Allow("key", 1000, 10)
+	time.Sleep(10 * time.Millisecond)
+	if ok, _ := limiters.Allow("key", 1000, 10); !ok {
+		t.Error("request refused after raising the limit")
+	}
+}
+
+func TestMaxConcurrentPerKey(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxConcurrentPerKey = 2
+	cfg.APIKeys["other-key"] = keyConfig{Dir: "other", Perms: permAll}
+	fs := newTestServer(t, cfg)
+
+	// hold two uploads in progress
+	release := make(chan struct{})
+	done := make(chan *http.Response)
+	for i := 0; i < 2; i++ {
+		body := &blockingReader{
+			content: strings.NewReader("content"),
+			started: make(chan struct{}),
+			release: release,
+		}
+		target := "/file" + strconv.Itoa(i) + ".txt"
+		go func() {
+			done <- serve(fs, newRequest(http.MethodPut, target, testKey, body))
+		}()
+		<-body.started
+	}
+
+	expectJSONError(t, do(fs, http.MethodGet, "/file0.txt", testKey, ""), http.StatusTooManyRequests)
+	expectJSONError(t, do(fs, http.MethodPut, "/file2.txt", testKey, "content"), http.StatusTooManyRequests)
+	if exists(sandboxFile(cfg, "file2.txt")) {
+		t.Error("rejected PUT was written")
+	}
+	// other keys are counted apart
+	expectStatus(t, do(fs, http.MethodPut, "/file.txt", "other-key", "content"), http.StatusOK)
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		expectStatus(t, <-done, http.StatusOK)
+	}
+	// requests finished are no longer counted
+	expectStatus(t, do(fs, http.MethodPut, "/file2.txt", testKey, "content"), http.StatusOK)
+}
+
+func TestConcurrencyLimitsRelease(t *testing.T) {
+	limits := newConcurrencyLimits()
+	release, ok := limits.Acquire("key", 1)
+	if !ok {
+		t.Fatal("first request refused")
+	}
+	if _, ok := limits.Acquire("key", 1); ok {
+		t.Error("request over the limit allowed")
+	}
+	release()
+	if len(limits.inFlight) != 0 {
+		t.Errorf("released key still counted: %v", limits.inFlight)
+	}
+	if _, ok := limits.Acquire("key", 1); !ok {
+		t.Error("request after release refused")
+	}
+}
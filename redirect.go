@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/quillaja/sysdlog"
+)
+
+// httpsRedirect creates a handler which permanently redirects requests to
+// the same host and path using https on the port of the https address.
+func httpsRedirect(httpsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddress)
+	if port == strconv.Itoa(httpsPort) {
+		port = ""
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// serveRedirect runs the server redirecting http to https.
+func (fs *httpfsServer) serveRedirect() {
+	fs.logf(sysdlog.Info, "redirecting http on %s to https\n", fs.redirectServer.Addr)
+	err := fs.redirectServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		fs.logf(sysdlog.Err, "error starting redirect server: %s\n", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for localhost and its key,
+// giving their paths.
+func writeTestCert(t *testing.T) (certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certPath, certPEM, filePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		address  string
+		target   string
+		location string
+	}{
+		{":443", "http://example.com/dir/file.txt?x=1", "https://example.com/dir/file.txt?x=1"},
+		{":8443", "http://example.com:8080/file.txt", "https://example.com:8443/file.txt"},
+		{"0.0.0.0:443", "http://example.com:80/", "https://example.com/"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		httpsRedirect(test.address).ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.target, nil))
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != test.location {
+			t.Errorf("%s to %s redirected with %d to %q, want 301 to %q",
+				test.target, test.address, w.Code, w.Header().Get("Location"), test.location)
+		}
+	}
+}
+
+func TestRedirectServer(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Address = "127.0.0.1:8443"
+	cfg.HTTPRedirectAddress = "127.0.0.1:0"
+	cfg.TLSCertPath, cfg.TLSKeyPath = writeTestCert(t)
+	fs := newTestServer(t, cfg)
+	if fs.redirectServer == nil {
+		t.Fatal("no redirect server with TLS configured")
+	}
+
+	redirect := httptest.NewServer(fs.redirectServer.Handler)
+	defer redirect.Close()
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(redirect.URL + "/file.txt?x=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "https://127.0.0.1:8443/file.txt?x=1" {
+		t.Errorf("got %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	// only with TLS
+	cfg.TLSCertPath, cfg.TLSKeyPath = "", ""
+	if fs := newTestServer(t, cfg); fs.redirectServer != nil {
+		t.Error("redirect server set up without TLS")
+	}
+}
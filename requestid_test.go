@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+
+	first := do(fs, http.MethodGet, "/file.txt", testKey, "").Header.Get(requestIDHeader)
+	second := do(fs, http.MethodGet, "/file.txt", testKey, "").Header.Get(requestIDHeader)
+	if first == "" || first == second {
+		t.Errorf("got request ids %q and %q, want distinct ids", first, second)
+	}
+
+	req := newRequest(http.MethodGet, "/file.txt", "wrong-key", nil)
+	req.Header.Set(requestIDHeader, "client-id.42")
+	resp := serve(fs, req)
+	if got := resp.Header.Get(requestIDHeader); got != "client-id.42" {
+		t.Errorf("supplied id came back as %q", got)
+	}
+	if log := strings.Join(readLog(t, cfg), "\n"); !strings.Contains(log, "[client-id.42] request with unrecognized api key") {
+		t.Errorf("log doesn't tag the request with its id:\n%s", log)
+	}
+
+	// ids which could forge log lines or headers are replaced
+	for _, bad := range []string{"has space", "new\nline", strings.Repeat("x", maxRequestIDLen+1)} {
+		req := newRequest(http.MethodGet, "/file.txt", testKey, nil)
+		req.Header.Set(requestIDHeader, bad)
+		if got := serve(fs, req).Header.Get(requestIDHeader); got == bad || !validRequestID(got) {
+			t.Errorf("id %q came back as %q", bad, got)
+		}
+	}
+}
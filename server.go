@@ -1,30 +1,125 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/quillaja/sysdlog"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/netutil"
 )
 
-// permissions used in creating files and directories
+// default permissions used in creating files and directories
 const (
 	filePerm = 0644
 	dirPerm  = 0755
 )
 
-// Applies CORS headers to all responses to allow access.
-func addCORSHeaders(h http.Handler) http.Handler {
+// filePerms are the permissions given to created files and directories.
+type filePerms struct {
+	File os.FileMode
+	Dir  os.FileMode
+}
+
+// WebDAV methods which are also supported
+const (
+	methodMove     = "MOVE"
+	methodCopy     = "COPY"
+	methodPropfind = "PROPFIND"
+)
+
+// methodPerms maps http methods to the permission required to use them.
+var methodPerms = map[string]permission{
+	http.MethodGet:    permRead,
+	http.MethodHead:   permRead,
+	http.MethodPost:   permWrite,
+	http.MethodPut:    permWrite,
+	http.MethodPatch:  permWrite,
+	http.MethodDelete: permDelete,
+	methodMove:        permWrite | permDelete,
+	methodCopy:        permRead | permWrite,
+	methodPropfind:    permRead,
+}
+
+// supportedMethods lists every method handled, in the form of an Allow header.
+var supportedMethods = strings.Join([]string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, methodMove, methodCopy,
+	methodPropfind, http.MethodOptions,
+}, ", ")
+
+// collapseSlashes replaces runs of '/' in request paths with a single '/'
+// before h sees them, so that such paths aren't redirected.
+func collapseSlashes(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Path, "//") {
+			var b strings.Builder
+			for i, r := range req.URL.Path {
+				if r != '/' || i == 0 || req.URL.Path[i-1] != '/' {
+					b.WriteRune(r)
+				}
+			}
+			req.URL.Path = b.String()
+			req.URL.RawPath = ""
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// Applies CORS headers to all responses to allow access. If the config lists
+// allowed origins, only requests from those origins are allowed, otherwise
+// requests from any origin are.
+func (fs *httpfsServer) addCORSHeaders(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		w.Header().Add("Access-Control-Allow-Origin", "*")
-		w.Header().Add("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
-		w.Header().Add("Access-Control-Allow-Headers", "*")
+		origins := fs.config().CORSAllowedOrigins
+		if len(origins) == 0 {
+			w.Header().Add("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Add("Vary", "Origin")
+			origin := req.Header.Get("Origin")
+			for _, allowed := range origins {
+				if allowed == "*" && origin == "" {
+					w.Header().Add("Access-Control-Allow-Origin", "*")
+					break
+				}
+				if allowed == "*" || (origin != "" && allowed == origin) {
+					w.Header().Add("Access-Control-Allow-Origin", origin)
+					break
+				}
+			}
+		}
+		if w.Header().Get("Access-Control-Allow-Origin") != "" {
+			w.Header().Add("Access-Control-Allow-Methods", supportedMethods)
+			w.Header().Add("Access-Control-Allow-Headers", "*")
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// Sets the Server header of all responses to ServerHeader, if given.
+func (fs *httpfsServer) addServerHeader(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if server := fs.config().ServerHeader; server != "" {
+			w.Header().Set("Server", server)
+		}
 		h.ServeHTTP(w, req)
 	})
 }
@@ -32,169 +127,1736 @@ func addCORSHeaders(h http.Handler) http.Handler {
 // httpfsServer encapsulates the core functionality of the application
 // around a server and logger.
 type httpfsServer struct {
+	mu       sync.RWMutex // guards settings
 	settings Config
+	logMu    sync.Mutex // guards setting the logger's level with writing a line
 	logger   *sysdlog.LevelLogger
 	server   *http.Server
+	usage    *usageTracker
+	locks    *pathLocks
+	limiters *rateLimiters
+	inFlight *concurrencyLimits
+	throttle *bandwidthLimiters
+	access   *accessTimes
+	writes   sync.WaitGroup // in-flight changes to files
+	drainMu  sync.Mutex     // guards draining and adding to writes
+	draining bool           // set once shutdown starts
+	uploads  *uploadSessions
+	cache    *fileCache // nil if disabled
+	storage  Storage
+
+	maintenance int32  // 1 while in maintenance mode, accessed atomically
+	requests    uint32 // counted for log sampling, accessed atomically
+
+	stopFollowing chan struct{} // closed on shutdown to end follow requests
+	stopTrash     chan struct{} // closed on shutdown to end purging the trash
+	stopOnce      sync.Once     // closes the stop channels on the first shutdown
+
+	metrics       *metrics     // nil if disabled
+	metricsServer *http.Server // nil if served on the main server
+
+	redirectServer *http.Server // nil if not redirecting http to https
+}
+
+// NewHTTPFSServer uses the Config to set up a server. An error is returned
+// if the log can't be opened, the TLS settings are invalid, or FileRoot, or
+// sandboxes when EnsureSandboxes is set, can't be created.
+func NewHTTPFSServer(cfg Config) (*httpfsServer, error) {
+	return newServer(cfg, localStorage{})
 }
 
-// NewHTTPFSServer uses the Config to set up a server.
-func NewHTTPFSServer(cfg Config) *httpfsServer {
+// newServer sets up a server using the Config to serve the files in storage.
+func newServer(cfg Config, storage Storage) (*httpfsServer, error) {
+	logOutput, err := openLog(cfg.LogFile, cfg.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range cfg.fileRoots() {
+		if err := storage.MakeDirs(root, cfg.perms()); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.EnsureSandboxes {
+		if err := cfg.ensureSandboxes(storage); err != nil {
+			return nil, err
+		}
+	}
+
 	fs := &httpfsServer{
 		settings: cfg,
-		logger:   sysdlog.NewLevelLogger(log.New(os.Stdout, "", 0)),
+		logger:   sysdlog.NewLevelLogger(log.New(logOutput, "", 0)),
+		usage:    newUsageTracker(storage),
+		locks:    newPathLocks(),
+		limiters: newRateLimiters(),
+		inFlight: newConcurrencyLimits(),
+		throttle: newBandwidthLimiters(),
+		access:   newAccessTimes(),
+		uploads:  newUploadSessions(storage),
+		cache:    newFileCache(cfg.CacheBytes),
+		storage:  storage,
+
+		stopFollowing: make(chan struct{}),
+		stopTrash:     make(chan struct{}),
 	}
-	fs.logger.SetLevel(sysdlog.Info) // initial level
+	if cfg.AccessTimesFile != "" {
+		if err := fs.access.Load(cfg.AccessTimesFile); err != nil {
+			fs.logf(sysdlog.Err, "%s\n", err)
+		}
+	}
+
+	// errors from net/http, such as failed TLS handshakes, go to the same log
+	errorLog := log.New(logOutput, fmt.Sprintf("<%d>", sysdlog.Err), 0)
 
+	var files http.Handler = http.HandlerFunc(fs.reqHandler)
+	var batch http.Handler = http.HandlerFunc(fs.batchDeleteHandler)
 	mux := http.NewServeMux()
-	mux.Handle("/", addCORSHeaders(http.HandlerFunc(fs.reqHandler)))
+	mux.HandleFunc("/healthz", fs.healthHandler)
+	mux.HandleFunc(versionPath, versionHandler)
+	mux.HandleFunc(capabilitiesPath, fs.capabilitiesHandler)
+	mux.HandleFunc(adminPrefix, fs.adminHandler)
+	mux.HandleFunc(signPrefix, fs.signHandler)
+
+	if cfg.MetricsEnabled {
+		fs.metrics = newMetrics(fs)
+		files = fs.metrics.Instrument(files)
+		batch = fs.metrics.Instrument(batch)
+		if cfg.MetricsAddress == "" {
+			mux.Handle("/metrics", fs.metrics.Handler())
+		} else {
+			metricsMux := http.NewServeMux()
+			metricsMux.Handle("/metrics", fs.metrics.Handler())
+			fs.metricsServer = &http.Server{
+				Addr:         cfg.MetricsAddress,
+				Handler:      metricsMux,
+				ReadTimeout:  cfg.timeout(cfg.ReadTimeoutSeconds),
+				WriteTimeout: cfg.timeout(cfg.WriteTimeoutSeconds),
+				IdleTimeout:  cfg.timeout(cfg.IdleTimeoutSeconds),
+				ErrorLog:     errorLog,
+			}
+		}
+	}
+
+	mux.Handle(batchDeletePath, fs.logAccess(fs.addCORSHeaders(batch)))
+	mux.Handle("/", fs.logAccess(fs.addCORSHeaders(files)))
+
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	acmeManager := cfg.acmeManager()
+	if acmeManager != nil {
+		useACME(tlsConfig, acmeManager)
+	}
+
+	handler := fs.addServerHeader(tagRequest(collapseSlashes(mux)))
+	if cfg.HTTP2Enabled && cfg.H2CEnabled && !cfg.usesTLS() {
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: cfg.timeout(cfg.IdleTimeoutSeconds)})
+	}
 
 	fs.server = &http.Server{
 		Addr:         cfg.Address,
-		Handler:      mux,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  30 * time.Second,
+		Handler:      handler,
+		ConnContext:  withConn,
+		TLSConfig:    tlsConfig,
+		ReadTimeout:  cfg.timeout(cfg.ReadTimeoutSeconds),
+		WriteTimeout: cfg.timeout(cfg.WriteTimeoutSeconds),
+		IdleTimeout:  cfg.timeout(cfg.IdleTimeoutSeconds),
+		ErrorLog:     errorLog,
+	}
+
+	fs.server.RegisterOnShutdown(fs.stop)
+
+	if !cfg.HTTP2Enabled {
+		// a non-nil map stops net/http from configuring HTTP/2
+		fs.server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	if cfg.HTTPRedirectAddress != "" && cfg.usesTLS() {
+		redirect := fs.addServerHeader(httpsRedirect(cfg.Address))
+		if acmeManager != nil {
+			redirect = acmeManager.HTTPHandler(redirect) // answers http-01 challenges
+		}
+		fs.redirectServer = &http.Server{
+			Addr:         cfg.HTTPRedirectAddress,
+			Handler:      redirect,
+			ReadTimeout:  cfg.timeout(cfg.ReadTimeoutSeconds),
+			WriteTimeout: cfg.timeout(cfg.WriteTimeoutSeconds),
+			IdleTimeout:  cfg.timeout(cfg.IdleTimeoutSeconds),
+			ErrorLog:     errorLog,
+		}
 	}
 
-	return fs
+	return fs, nil
 }
 
 // ListenAndServe begins the server
 func (fs *httpfsServer) ListenAndServe() (err error) {
-	fs.logger.SetLevel(sysdlog.Info)
-	if fs.settings.TLSCertPath == "" || fs.settings.TLSKeyPath == "" {
-		fs.logger.Println("no TLS certificate and/or key provided")
-		fs.logger.Printf("listening for http on %s\n", fs.server.Addr)
-		err = fs.server.ListenAndServe()
-	} else {
-		fs.logger.Printf("using certificate: %s, key: %s\n", fs.settings.TLSCertPath, fs.settings.TLSKeyPath)
-		fs.logger.Printf("listening for https on %s\n", fs.server.Addr)
-		err = fs.server.ListenAndServeTLS(fs.settings.TLSCertPath, fs.settings.TLSKeyPath)
+	if fs.metricsServer != nil {
+		go fs.serveMetrics()
+	}
+	if fs.redirectServer != nil {
+		go fs.serveRedirect()
+	}
+	go fs.collectTrash(fs.stopTrash)
+
+	settings := fs.config()
+	ln, err := net.Listen("tcp", fs.server.Addr)
+	if err == nil {
+		if max := settings.MaxConnections; max > 0 {
+			fs.logf(sysdlog.Info, "accepting at most %d connections at once\n", max)
+			ln = netutil.LimitListener(ln, max)
+		}
+		switch {
+		case settings.usesACME():
+			fs.logf(sysdlog.Info, "using ACME certificates for: %s\n", strings.Join(settings.ACMEDomains, ", "))
+			fs.logf(sysdlog.Info, "listening for https on %s\n", fs.server.Addr)
+			err = fs.server.ServeTLS(ln, "", "")
+		case !settings.usesTLS():
+			fs.logf(sysdlog.Info, "no TLS certificate and/or key provided\n")
+			fs.logf(sysdlog.Info, "listening for http on %s\n", fs.server.Addr)
+			err = fs.server.Serve(ln)
+		default:
+			fs.logf(sysdlog.Info, "using certificate: %s, key: %s\n", settings.TLSCertPath, settings.TLSKeyPath)
+			fs.logf(sysdlog.Info, "listening for https on %s\n", fs.server.Addr)
+			err = fs.server.ServeTLS(ln, settings.TLSCertPath, settings.TLSKeyPath)
+		}
 	}
 	if err != nil && err != http.ErrServerClosed {
-		fs.logger.SetLevel(sysdlog.Alert)
-		fs.logger.Printf("error starting server: %s\n", err)
+		fs.logf(sysdlog.Alert, "error starting server: %s\n", err)
 		return err
 	}
 	return nil
 }
 
-// Shutdown attempts to gracefully shutdown the server.
+// serveMetrics runs the separate metrics server.
+func (fs *httpfsServer) serveMetrics() {
+	fs.logf(sysdlog.Info, "listening for metrics on %s\n", fs.metricsServer.Addr)
+	err := fs.metricsServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		fs.logf(sysdlog.Err, "error starting metrics server: %s\n", err)
+	}
+}
+
+// errShuttingDown is returned for changes to files begun after shutdown.
+var errShuttingDown = errors.New("server is shutting down")
+
+// beginWrite counts a change to files as in progress so that shutdown can
+// wait for it, reporting false once shutdown has started. fs.writes.Done
+// must be called when a write which began has finished.
+func (fs *httpfsServer) beginWrite() bool {
+	fs.drainMu.Lock()
+	defer fs.drainMu.Unlock()
+	if fs.draining {
+		return false
+	}
+	fs.writes.Add(1)
+	return true
+}
+
+// Shutdown attempts to gracefully shutdown the server. Changes to files are
+// refused from then on. If configured to drain writes, it also waits for all
+// writes to finish even if ctx expires.
 func (fs *httpfsServer) Shutdown(ctx context.Context) error {
-	fs.logger.SetLevel(sysdlog.Info)
-	fs.logger.Println("attempting to shutdown server")
-	return fs.server.Shutdown(ctx)
+	fs.logf(sysdlog.Info, "attempting to shutdown server\n")
+	fs.drainMu.Lock()
+	fs.draining = true
+	fs.drainMu.Unlock()
+	if fs.metricsServer != nil {
+		fs.metricsServer.Shutdown(ctx)
+	}
+	if fs.redirectServer != nil {
+		fs.redirectServer.Shutdown(ctx)
+	}
+	err := fs.server.Shutdown(ctx)
+
+	// handlers are left running if ctx expires, so wait for any writes
+	if fs.config().DrainWrites {
+		fs.logf(sysdlog.Info, "waiting for writes to finish\n")
+		fs.writes.Wait()
+	}
+	fs.uploads.Close()
+
+	if path := fs.config().AccessTimesFile; path != "" {
+		if err := fs.access.Save(path); err != nil {
+			fs.logf(sysdlog.Err, "%s\n", err)
+		}
+	}
+
+	return err
+}
+
+// stop ends follow requests and purging the trash. It is called on every
+// shutdown, but only the first closes the channels.
+func (fs *httpfsServer) stop() {
+	fs.stopOnce.Do(func() {
+		close(fs.stopFollowing)
+		close(fs.stopTrash)
+	})
+}
+
+// config gets the current settings.
+func (fs *httpfsServer) config() Config {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.settings
+}
+
+// configFor gets the current settings for the host req was sent to.
+func (fs *httpfsServer) configFor(req *http.Request) Config {
+	return fs.config().forHost(req.Host)
+}
+
+// ReloadConfig reads the config at path and swaps it in for the current
+// settings. The address and TLS settings are kept since changing them
+// requires a restart.
+func (fs *httpfsServer) ReloadConfig(path string) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		fs.logf(sysdlog.Err, "error reloading config '%s': %s\n", path, err)
+		return err
+	}
+
+	fs.mu.Lock()
+	cfg.Address = fs.settings.Address
+	cfg.TLSCertPath = fs.settings.TLSCertPath
+	cfg.TLSKeyPath = fs.settings.TLSKeyPath
+	cfg.TLSMinVersion = fs.settings.TLSMinVersion
+	cfg.TLSCipherSuites = fs.settings.TLSCipherSuites
+	cfg.ACMEDomains = fs.settings.ACMEDomains
+	cfg.ACMECacheDir = fs.settings.ACMECacheDir
+	fs.settings = cfg
+	fs.mu.Unlock()
+
+	fs.logf(sysdlog.Notice, "reloaded config '%s'\n", path)
+	return nil
+}
+
+// healthHandler reports if the server is able to serve files. It does not
+// require an api key.
+func (fs *httpfsServer) healthHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Add("Cache-Control", "no-cache")
+
+	root := fs.config().FileRoot
+	if _, err := fs.storage.Stat(root); err != nil {
+		fs.logf(sysdlog.Err, "health check failed: %s\n", err)
+		writeJSONError(w, http.StatusServiceUnavailable, "file root unavailable")
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// writeRootResponse replies to a request for "/" with the configured root.
+func writeRootResponse(w http.ResponseWriter, req *http.Request, root rootResponse) {
+	if root.Redirect != "" {
+		http.Redirect(w, req, root.Redirect, http.StatusFound)
+		return
+	}
+	ctype := root.ContentType
+	if ctype == "" {
+		ctype = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", ctype)
+	io.WriteString(w, root.Body)
 }
 
 // reqHandler validates and executes the request.
 func (fs *httpfsServer) reqHandler(w http.ResponseWriter, req *http.Request) {
 
-	fs.logger.SetLevel(sysdlog.Info)
+	settings := fs.configFor(req)
+	id := requestID(req)
 
 	w.Header().Add("Cache-Control", "no-cache") // make client validate cached data
 
+	// reject paths which could confuse the log or the filesystem before
+	// either sees them
+	if hasControlChars(req.URL.Path) {
+		fs.logf(sysdlog.Warning, "[%s] rejected path %q with control characters\n", id, req.URL.Path)
+		writeJSONError(w, http.StatusBadRequest, "invalid path")
+		return
+	}
+
+	if status, ok := settings.checkUserAgent(req.UserAgent()); !ok {
+		fs.logf(sysdlog.Warning, "[%s] rejected user agent %q\n", id, req.UserAgent())
+		writeJSONError(w, status, "user agent not allowed")
+		return
+	}
+
 	if req.Method == http.MethodOptions {
-		return // status 200 with cors headers
+		w.Header().Set("Allow", supportedMethods)
+		w.WriteHeader(http.StatusNoContent) // with cors headers
+		return
 	}
 
-	// authorize
+	// authorize by api key, or failing that a signed url. requests with
+	// neither may read the public directory.
 	username, key, ok := req.BasicAuth()
-	userdir, found := fs.settings.APIKeys[apikey(key)]
-	if !ok || !found {
-		log.Printf("request with unrecognized api key '%s'\n", key)
-		http.Error(w, "unrecognized api key", http.StatusUnauthorized)
+	if root := settings.RootResponse; root != nil && !ok && req.URL.Path == "/" && req.URL.Query().Get("sig") == "" &&
+		(req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		writeRootResponse(w, req, *root)
+		return
+	}
+	stored, keycfg, found := settings.findKey(key)
+	if !ok {
+		stored, keycfg, found = settings.findSignedKey(req)
+	}
+	if !ok && !found && req.URL.Query().Get("sig") == "" && settings.PublicDir != "" &&
+		(req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		keycfg, found = keyConfig{Dir: settings.PublicDir, Perms: permRead}, true
+	}
+	release, admitted := fs.authorize(w, req, settings, username, key, stored, keycfg, found, methodPerms[req.Method])
+	if !admitted {
 		return
 	}
+	defer release()
+	key = string(stored)
+	if max := keycfg.BandwidthBytesPerSec; max > 0 {
+		lim := fs.throttle.Limiter(key, max)
+		req.Body = &throttledReader{ReadCloser: req.Body, ctx: req.Context(), lim: lim}
+		w = &throttledWriter{ResponseWriter: w, ctx: req.Context(), lim: lim}
+	}
 
-	// get file to process
+	// get file to process. the sandbox itself may only be listed.
 	resourcePath := req.URL.Path
-	localpath := filepath.Join(fs.settings.FileRoot, string(userdir), resourcePath)
-	if resourcePath == "/" {
-		log.Printf("no file specified by '%s':'%s'\n", username, key)
-		http.Error(w, "no file specified", http.StatusBadRequest)
+	isRoot := resourcePath == "/"
+	if isRoot && req.Method != http.MethodGet && req.Method != methodPropfind {
+		fs.logf(sysdlog.Warning, "[%s] no file specified by '%s':'%s'\n", id, username, keyID(key))
+		writeJSONError(w, http.StatusBadRequest, "no file specified")
 		return
 	}
-	fs.logger.Printf("%s '%s' from '%s':'%s'\n", req.Method, localpath, username, key)
+	sandbox := filepath.Join(settings.FileRoot, string(keycfg.Dir))
+	fs.setStorageHeaders(w, sandbox, keycfg.QuotaBytes)
+	localpath, err := sandboxResource(fs.storage, settings, sandbox, resourcePath)
+	switch {
+	case errors.Is(err, errSymlink):
+		fs.logf(sysdlog.Warning, "[%s] refused symlink in '%s' from '%s':'%s'\n", id, resourcePath, username, keyID(key))
+		writeJSONError(w, http.StatusForbidden, errSymlink.Error())
+		return
+	case err != nil:
+		fs.logf(sysdlog.Warning, "[%s] rejected path '%s' from '%s':'%s': %s\n", id, resourcePath, username, keyID(key), err)
+		writeJSONError(w, http.StatusBadRequest, "invalid path")
+		return
+	}
+	if isUpload(req.Method) && inTrash(relativePath(sandbox, localpath)) {
+		writeJSONError(w, http.StatusForbidden, errTrash.Error())
+		return
+	}
+	if !settings.AllowDotfiles && isUpload(req.Method) && hasDotSegment(resourcePath) {
+		writeJSONError(w, http.StatusBadRequest, errDotfile.Error())
+		return
+	}
+	if isUpload(req.Method) && !settings.withinPathLimits(relativePath(sandbox, localpath)) {
+		writeJSONError(w, http.StatusBadRequest, errPathLimit.Error())
+		return
+	}
+	if !settings.CaseSensitivePaths && isUpload(req.Method) && caseCollision(fs.storage, sandbox, localpath) {
+		writeJSONError(w, http.StatusConflict, errCaseCollision.Error())
+		return
+	}
+	if isUpload(req.Method) && !isMultipart(req) && !keycfg.allowsName(resourcePath) {
+		writeJSONError(w, http.StatusUnsupportedMediaType, errExtension.Error())
+		return
+	}
+	if settings.LogFormat != logFormatJSON && fs.sampleLog(settings.LogSampleRate) {
+		fs.logf(sysdlog.Info, "[%s] %s '%s' from '%s':'%s' using %q\n", id, req.Method, localpath, username, keyID(key), req.UserAgent())
+	}
+
+	var aead cipher.AEAD
+	if settings.EncryptionKey != "" {
+		aead, err = newFileCipher(settings.EncryptionKey)
+		if err != nil {
+			fs.logf(sysdlog.Err, "[%s] error setting up encryption:%s\n", id, err)
+			writeJSONError(w, http.StatusInternalServerError, "error setting up encryption")
+			return
+		}
+	}
+
+	perms := settings.perms()
+
+	// modification time to give uploaded files
+	var modtime time.Time
+	if header := req.Header.Get("X-Modified-Time"); header != "" && isUpload(req.Method) {
+		modtime, err = time.Parse(time.RFC3339, header)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid X-Modified-Time")
+			return
+		}
+	}
+
+	// resumable upload session, if any
+	upload := req.URL.Query().Get("upload")
+
+	// position at which PATCH writes, unless merging a JSON document
+	var offset int64
+	merging := req.Method == http.MethodPatch && upload == "" && isMergePatch(req)
+	if req.Method == http.MethodPatch && !merging {
+		if aead != nil && upload == "" {
+			writeJSONError(w, http.StatusNotImplemented, "PATCH is not supported for encrypted files")
+			return
+		}
+		// offsets of upload chunks are checked against the session
+		offset, err = strconv.ParseInt(req.URL.Query().Get("offset"), 10, 64)
+		if err != nil || (offset < 0 && upload == "") {
+			writeJSONError(w, http.StatusBadRequest, "invalid offset")
+			return
+		}
+	}
+
+	// PUT with a Content-Range writes only that range of the file
+	ranged := req.Method == http.MethodPut && req.Header.Get("Content-Range") != "" && !isMultipart(req)
+	var length int64
+	if ranged {
+		if aead != nil {
+			writeJSONError(w, http.StatusNotImplemented, "Content-Range is not supported for encrypted files")
+			return
+		}
+		offset, length, err = parseContentRange(req.Header.Get("Content-Range"))
+		if err != nil || (req.ContentLength >= 0 && req.ContentLength != length && !isGzipEncoded(req.Header)) {
+			writeJSONError(w, http.StatusBadRequest, "invalid Content-Range")
+			return
+		}
+	}
+
+	// nothing before the check for empty uploads below may read the body.
+	// go replies to "Expect: 100-continue" only on the first read, so
+	// requests refused by the checks up to there are answered without the
+	// body being sent.
 
 	// do something with file depending on http method
 	var doing string
-	var err error
+	var dest string // of MOVE and COPY
 	defer req.Body.Close()
 
+	if max := settings.MaxUploadBytes; max > 0 {
+		if req.ContentLength > max {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		req.Body = http.MaxBytesReader(w, req.Body, max)
+	}
+
+	// decompress gzipped uploads, limiting their decompressed size too
+	if isUpload(req.Method) && isGzipEncoded(req.Header) {
+		req.Body = newGunzipReader(req.Body)
+		req.ContentLength = -1
+		if max := settings.MaxUploadBytes; max > 0 {
+			req.Body = http.MaxBytesReader(w, req.Body, max)
+		}
+	}
+
+	// serialize changes to the same file. readers don't need to wait since
+	// replacement is atomic and files already open are unaffected by it.
+	// MOVE and COPY also lock their destination, once it's known.
+	switch req.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		defer fs.locks.Lock(localpath)()
+	}
+
+	// don't overwrite or delete files changed since the client saw them
+	switch req.Method {
+	case http.MethodPut, http.MethodDelete:
+		if modifiedSince(fs.storage, localpath, req.Header.Get("If-Unmodified-Since")) {
+			writeJSONError(w, http.StatusPreconditionFailed, "file modified since If-Unmodified-Since")
+			return
+		}
+		if !etagMatches(fs.storage, localpath, req.Header.Get("If-Match")) {
+			writeJSONError(w, http.StatusPreconditionFailed, "file does not match If-Match")
+			return
+		}
+	}
+
+	// track changes so shutdown can wait for them to finish
+	if isChange(req.Method) {
+		if !fs.beginWrite() {
+			writeJSONError(w, http.StatusServiceUnavailable, errShuttingDown.Error())
+			return
+		}
+		defer fs.writes.Done()
+	}
+
+	// count the bytes received for the webhook
+	body := &countingReader{ReadCloser: req.Body}
+	req.Body = body
+
+	// check and limit storage used by writes
+	oldSize, oldCount := fileSize(fs.storage, localpath), fileCount(fs.storage, localpath)
+	if quota := keycfg.QuotaBytes; quota > 0 && isUpload(req.Method) {
+		used, err := fs.usage.Used(sandbox)
+		if err != nil {
+			fs.logf(sysdlog.Err, "[%s] error checking quota:%s\n", id, err)
+			writeJSONError(w, http.StatusInternalServerError, "error checking quota")
+			return
+		}
+		switch req.Method {
+		case http.MethodPut:
+			if ranged {
+				used -= oldSize - offset
+			} else {
+				used -= oldSize // file will be replaced
+			}
+		case http.MethodPatch:
+			used -= oldSize - offset // bytes after offset are overwritten
+		}
+		remaining := quota - used
+		if req.ContentLength > remaining {
+			writeJSONError(w, http.StatusInsufficientStorage, errQuotaExceeded.Error())
+			return
+		}
+		req.Body = io.NopCloser(&quotaReader{r: req.Body, remaining: remaining})
+	}
+	if isUpload(req.Method) && oldCount == 0 && !isMultipart(req) {
+		if err := fs.usage.checkFileLimit(sandbox, keycfg.MaxFiles); err != nil {
+			if errors.Is(err, errFileLimitExceeded) {
+				writeJSONError(w, http.StatusInsufficientStorage, errFileLimitExceeded.Error())
+				return
+			}
+			fs.logf(sysdlog.Err, "[%s] error checking file limit:%s\n", id, err)
+			writeJSONError(w, http.StatusInternalServerError, "error checking file limit")
+			return
+		}
+	}
+
+	// verify uploads against any checksums given
+	if isUpload(req.Method) {
+		body, err := checksumBody(req.Header, req.Body)
+		if err != nil {
+			fs.logf(sysdlog.Warning, "[%s] rejected checksum from '%s':'%s': %s\n", id, username, keyID(key), err)
+			writeJSONError(w, http.StatusBadRequest, "invalid checksum header")
+			return
+		}
+		req.Body = io.NopCloser(body)
+	}
+
+	// refuse empty files, unless starting or finishing an upload session
+	if settings.RejectEmptyUploads && (req.Method == http.MethodPost || req.Method == http.MethodPut) && upload == "" {
+		if emptyBody(req) {
+			writeJSONError(w, http.StatusBadRequest, errEmptyUpload.Error())
+			return
+		}
+	}
+
 	switch req.Method {
 	case http.MethodGet:
+		if stat, _ := strconv.ParseBool(req.URL.Query().Get("stat")); stat {
+			doing = "stating"
+			withHash, _ := strconv.ParseBool(req.URL.Query().Get("sha256"))
+			err = statFile(fs.storage, localpath, w, aead, withHash)
+			break
+		}
+		if follow, _ := strconv.ParseBool(req.URL.Query().Get("follow")); follow {
+			if aead != nil {
+				writeJSONError(w, http.StatusNotImplemented, "encrypted files can't be followed")
+				return
+			}
+			doing = "following"
+			err = followFile(fs.storage, localpath, w, req, fs.stopFollowing, settings.CopyBufferBytes)
+			break
+		}
+		if isRoot && !isDir(fs.storage, localpath) {
+			doing = "listing"
+			err = writeListing(w, localpath, []dirEntry{}, listingFormat(req)) // nothing stored yet
+			break
+		}
+		if strings.HasSuffix(resourcePath, "/") && isDir(fs.storage, localpath) {
+			if index := findIndex(fs.storage, localpath, settings.IndexFiles); index != "" {
+				doing = "reading"
+				if !settings.FollowSymlinks && hasSymlink(fs.storage, sandbox, index) {
+					err = errSymlink
+					break
+				}
+				err = serveFile(fs.storage, index, gzipSidecar(fs.storage, settings, sandbox, index), w, req, aead, fs.cache, settings.CopyBufferBytes)
+				break
+			}
+			doing = "listing"
+			err = listDir(fs.storage, localpath, localpath == sandbox, w, listingFormat(req))
+			break
+		}
 		doing = "reading"
-		err = readFile(localpath, w)
+		err = serveFile(fs.storage, localpath, gzipSidecar(fs.storage, settings, sandbox, localpath), w, req, aead, fs.cache, settings.CopyBufferBytes)
+
+	case http.MethodHead:
+		doing = "stating"
+		err = headFile(fs.storage, localpath, w, aead)
+
+	case methodPropfind:
+		doing = "finding properties of"
+		err = propfind(fs.storage, localpath, resourcePath, req.Header.Get("Depth"), w)
 
 	case http.MethodDelete:
 		doing = "deleting"
-		err = deleteFile(localpath)
+		err = fs.deletePath(settings, sandbox, localpath, deleteOptionsOf(req, settings))
 
 	case http.MethodPost:
+		if upload == uploadInit {
+			doing = "starting upload of"
+			err = fs.startUpload(w, req, localpath, settings.MaxUploadBytes, perms)
+			break
+		}
+		if upload == uploadFinish {
+			doing = "finishing upload of"
+			err = fs.finishUpload(req.Context(), req.URL.Query().Get("id"), sandbox, localpath, keycfg, aead, perms)
+			break
+		}
+		if upload != "" {
+			writeJSONError(w, http.StatusBadRequest, "invalid upload")
+			return
+		}
+		if isMultipart(req) {
+			doing = "storing"
+			err = fs.storeMultipart(w, req, sandbox, localpath, keycfg, aead, perms)
+			break
+		}
+		if req.URL.Query().Get("mode") == "create" {
+			doing = "creating"
+			err = writeFile(req.Context(), fs.storage, os.O_EXCL, localpath, req.Body, aead, perms, settings.CopyBufferBytes)
+			break
+		}
 		doing = "appending"
-		err = writeFile(os.O_APPEND, localpath, req.Body)
+		err = writeFile(req.Context(), fs.storage, os.O_APPEND, localpath, req.Body, aead, perms, settings.CopyBufferBytes)
 
 	case http.MethodPut:
+		if isMultipart(req) {
+			doing = "storing"
+			err = fs.storeMultipart(w, req, sandbox, localpath, keycfg, aead, perms)
+			break
+		}
+		if ranged {
+			doing = "writing range of"
+			err = writeFileAt(req.Context(), fs.storage, localpath, offset, &rangeReader{r: req.Body, remaining: length}, perms, settings.CopyBufferBytes)
+			break
+		}
 		doing = "truncating"
-		err = writeFile(os.O_TRUNC, localpath, req.Body)
+		err = writeFile(req.Context(), fs.storage, os.O_TRUNC, localpath, req.Body, aead, perms, settings.CopyBufferBytes)
+
+	case http.MethodPatch:
+		if upload != "" {
+			doing = "uploading"
+			err = fs.writeUploadChunk(req, upload, localpath, offset, settings.MaxUploadBytes, perms)
+			break
+		}
+		if merging {
+			doing = "merging patch into"
+			var doc []byte
+			doc, err = mergeJSON(fs.storage, localpath, req.Body, aead)
+			if err == nil && keycfg.QuotaBytes > 0 {
+				var used int64
+				used, err = fs.usage.Used(sandbox)
+				if err == nil && used-oldSize+int64(len(doc)) > keycfg.QuotaBytes {
+					err = errQuotaExceeded
+				}
+			}
+			if err == nil {
+				err = writeFile(req.Context(), fs.storage, os.O_TRUNC, localpath, bytes.NewReader(doc), aead, perms, settings.CopyBufferBytes)
+			}
+			break
+		}
+		doing = "patching"
+		err = writeFileAt(req.Context(), fs.storage, localpath, offset, req.Body, perms, settings.CopyBufferBytes)
+
+	case methodMove:
+		doing = "moving"
+		if dest, err = fs.validateDestination(sandbox, req, settings, keycfg); err != nil {
+			break
+		}
+		defer fs.locks.LockBoth(localpath, dest)()
+		replaced, replacedCount := fileSize(fs.storage, dest), fileCount(fs.storage, dest)
+		err = moveFile(fs.storage, localpath, dest, perms)
+		if err == nil {
+			fs.usage.Add(sandbox, -replaced, -replacedCount)
+		}
+
+	case methodCopy:
+		doing = "copying"
+		if dest, err = fs.validateDestination(sandbox, req, settings, keycfg); err != nil {
+			break
+		}
+		defer fs.locks.Lock(dest)()
+		replaced, replacedCount := fileSize(fs.storage, dest), fileCount(fs.storage, dest)
+		if quota := keycfg.QuotaBytes; quota > 0 {
+			var used int64
+			used, err = fs.usage.Used(sandbox)
+			if err == nil && used-replaced+oldSize > quota {
+				err = errQuotaExceeded
+			}
+			if err != nil {
+				break
+			}
+		}
+		if replacedCount == 0 {
+			if err = fs.usage.checkFileLimit(sandbox, keycfg.MaxFiles); err != nil {
+				break
+			}
+		}
+		err = copyFile(req.Context(), fs.storage, localpath, dest, perms, settings.CopyBufferBytes)
+		if err == nil {
+			fs.usage.Add(sandbox, oldSize-replaced, oldCount-replacedCount)
+		}
 
 	default:
-		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		w.Header().Set("Allow", supportedMethods)
+		writeJSONError(w, http.StatusMethodNotAllowed, "Unsupported method")
 		return
 	}
 
+	if isChange(req.Method) {
+		fs.cache.Invalidate(localpath)
+		if dest != "" {
+			fs.cache.Invalidate(dest)
+		}
+	}
+
+	switch req.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		fs.usage.Add(sandbox, fileSize(fs.storage, localpath)-oldSize, fileCount(fs.storage, localpath)-oldCount)
+	}
+	if isChange(req.Method) {
+		fs.setStorageHeaders(w, sandbox, keycfg.QuotaBytes) // if not yet sent
+	}
+
+	if err == nil && !modtime.IsZero() && !isMultipart(req) && (upload == "" || upload == uploadFinish) {
+		if err = fs.storage.Chtimes(localpath, modtime, modtime); err != nil {
+			err = fmt.Errorf("error setting modification time of '%s': %w", localpath, err)
+		}
+	}
+
+	if err != nil {
+		fs.logf(sysdlog.Err, "[%s] error %s:%s\n", id, req.Method, err)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			writeJSONError(w, http.StatusNotFound, "file not found")
+			return
+		case errors.Is(err, os.ErrExist):
+			writeJSONError(w, http.StatusConflict, "file already exists")
+			return
+		case isBodyTooLarge(err):
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		case errors.Is(err, errQuotaExceeded):
+			writeJSONError(w, http.StatusInsufficientStorage, errQuotaExceeded.Error())
+			return
+		case errors.Is(err, errFileLimitExceeded):
+			writeJSONError(w, http.StatusInsufficientStorage, errFileLimitExceeded.Error())
+			return
+		case errors.Is(err, errChecksumMismatch):
+			writeJSONError(w, http.StatusBadRequest, errChecksumMismatch.Error())
+			return
+		case errors.Is(err, errRangeLength):
+			writeJSONError(w, http.StatusBadRequest, errRangeLength.Error())
+			return
+		case errors.Is(err, errTrash):
+			writeJSONError(w, http.StatusForbidden, errTrash.Error())
+			return
+		case errors.Is(err, errInvalidDestination):
+			writeJSONError(w, http.StatusBadRequest, errInvalidDestination.Error())
+			return
+		case errors.Is(err, errUploadNotFound):
+			writeJSONError(w, http.StatusNotFound, errUploadNotFound.Error())
+			return
+		case errors.Is(err, errInvalidUploadSize):
+			writeJSONError(w, http.StatusBadRequest, errInvalidUploadSize.Error())
+			return
+		case errors.Is(err, errChunkOutOfRange):
+			writeJSONError(w, http.StatusRequestedRangeNotSatisfiable, errChunkOutOfRange.Error())
+			return
+		case errors.Is(err, errUploadTooLarge):
+			writeJSONError(w, http.StatusRequestEntityTooLarge, errUploadTooLarge.Error())
+			return
+		case errors.Is(err, errInvalidGzip):
+			writeJSONError(w, http.StatusBadRequest, errInvalidGzip.Error())
+			return
+		case errors.Is(err, errDirNotEmpty):
+			writeJSONError(w, http.StatusConflict, errDirNotEmpty.Error())
+			return
+		case errors.Is(err, errIsDir):
+			writeJSONError(w, http.StatusBadRequest, errIsDir.Error())
+			return
+		case errors.Is(err, errInvalidDepth):
+			writeJSONError(w, http.StatusBadRequest, errInvalidDepth.Error())
+			return
+		case errors.Is(err, errDotfile):
+			writeJSONError(w, http.StatusBadRequest, errDotfile.Error())
+			return
+		case errors.Is(err, errNotJSON):
+			writeJSONError(w, http.StatusBadRequest, errNotJSON.Error())
+			return
+		case errors.Is(err, errInvalidPatch):
+			writeJSONError(w, http.StatusBadRequest, errInvalidPatch.Error())
+			return
+		case errors.Is(err, errCaseCollision):
+			writeJSONError(w, http.StatusConflict, errCaseCollision.Error())
+			return
+		case errors.Is(err, errSymlink):
+			writeJSONError(w, http.StatusForbidden, errSymlink.Error())
+			return
+		case errors.Is(err, errPathLimit):
+			writeJSONError(w, http.StatusBadRequest, errPathLimit.Error())
+			return
+		case errors.Is(err, errExtension):
+			writeJSONError(w, http.StatusUnsupportedMediaType, errExtension.Error())
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("error %s file", doing))
+		return
+	}
+
+	// changes within upload sessions are only reported once finished
+	if settings.WebhookURL != "" && isChange(req.Method) && (upload == "" || upload == uploadFinish) {
+		event := changeEvent{
+			Time:    time.Now().UTC(),
+			Method:  req.Method,
+			Sandbox: keycfg.Dir,
+			Path:    resourcePath,
+			Bytes:   body.bytes,
+		}
+		if dest != "" {
+			event.Destination = "/" + relativePath(sandbox, dest)
+		}
+		fs.notifyWebhook(settings.WebhookURL, event)
+	}
+}
+
+// authorize lets a request from username with the key go ahead if its
+// settings keycfg were found for the key, as stored, and permit need, if
+// maintenance mode doesn't hold back the change it makes and if the key is
+// within its limits, replying with the error otherwise. If admitted, the
+// returned function must be called once the request is finished.
+func (fs *httpfsServer) authorize(w http.ResponseWriter, req *http.Request, settings Config, username, key string, stored apikey, keycfg keyConfig, found bool, need permission) (release func(), ok bool) {
+	id := requestID(req)
+	if !found {
+		fs.logf(sysdlog.Warning, "[%s] request with unrecognized api key '%s'\n", id, keyID(key))
+		writeJSONError(w, http.StatusUnauthorized, "unrecognized api key")
+		return nil, false
+	}
+	// access times and limits are kept for the key as stored in the config,
+	// so requests with a key and with urls it signed share them
+	key = string(stored)
+	setLoggedKey(req, stored)
+	fs.access.Touch(key, keycfg.Dir, time.Now())
+	if !keycfg.Perms.Has(need) {
+		fs.logf(sysdlog.Warning, "[%s] %s not permitted for '%s':'%s'\n", id, req.Method, username, keyID(key))
+		writeJSONError(w, http.StatusForbidden, "operation not permitted")
+		return nil, false
+	}
+	if isChange(req.Method) && fs.inMaintenance() {
+		refuseMaintenance(w)
+		return nil, false
+	}
+	return fs.admit(w, settings, key)
+}
+
+// errInvalidPath is returned for paths which aren't within the sandbox.
+var errInvalidPath = errors.New("invalid path")
+
+// sandboxResource gives the host path of the resource in sandbox, which is
+// the sandbox itself for "/". It fails with errInvalidPath for resources
+// outside the sandbox and errSymlink for those through a symlink in store,
+// unless settings follow them.
+func sandboxResource(store Storage, settings Config, sandbox, resource string) (string, error) {
+	localpath := sandbox
+	if resource != "/" {
+		var err error
+		if localpath, err = sandboxPath(sandbox, resource); err != nil {
+			return "", fmt.Errorf("%w: %s", errInvalidPath, err)
+		}
+	}
+	if !settings.FollowSymlinks && hasSymlink(store, sandbox, localpath) {
+		return "", errSymlink
+	}
+	return localpath, nil
+}
+
+// deleteOptions are how a DELETE deletes its file.
+type deleteOptions struct {
+	recursive bool // delete directories with their contents
+	trash     bool // move to the trash instead
+	prune     bool // remove parent directories left empty
+}
+
+// deleteOptionsOf gives the options of a DELETE from the "recursive",
+// "purge" and "prune" query parameters of req and settings.
+func deleteOptionsOf(req *http.Request, settings Config) deleteOptions {
+	query := req.URL.Query()
+	prune, _ := strconv.ParseBool(query.Get("prune"))
+	return deleteOptions{
+		recursive: query.Get("recursive") == "true",
+		trash:     settings.TrashEnabled && query.Get("purge") != "true",
+		prune:     prune || settings.PruneEmptyDirs,
+	}
+}
+
+// deletePath deletes, or moves to the trash, the file at localpath in
+// sandbox as given by opts, keeping the sandbox's usage up to date. Files
+// already in the trash are deleted.
+func (fs *httpfsServer) deletePath(settings Config, sandbox, localpath string, opts deleteOptions) error {
+	oldSize, oldCount := fileSize(fs.storage, localpath), fileCount(fs.storage, localpath)
+	wasDir := isDir(fs.storage, localpath)
+	trash := opts.trash && !inTrash(relativePath(sandbox, localpath))
+	var err error
+	if trash {
+		err = trashFile(fs.storage, sandbox, localpath, settings.perms(), opts.recursive)
+	} else {
+		err = deleteFile(fs.storage, localpath, opts.recursive)
+	}
+
+	fs.cache.Invalidate(localpath)
+	switch {
+	case trash:
+		// still counted toward the quota while in the trash
+	case wasDir:
+		fs.usage.Forget(sandbox) // walked again when next needed
+	default:
+		fs.usage.Add(sandbox, fileSize(fs.storage, localpath)-oldSize, fileCount(fs.storage, localpath)-oldCount)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.prune {
+		pruneEmptyParents(fs.storage, sandbox, localpath)
+	}
+	return nil
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes start-end/total", where total may be "*", giving the offset and
+// length of the range.
+func parseContentRange(header string) (offset, length int64, err error) {
+	spec := strings.TrimPrefix(header, "bytes ")
+	slash := strings.IndexByte(spec, '/')
+	dash := strings.IndexByte(spec, '-')
+	if spec == header || slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, fmt.Errorf("invalid Content-Range '%s'", header)
+	}
+
+	start, err := strconv.ParseInt(spec[:dash], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid start in Content-Range '%s'", header)
+	}
+	end, err := strconv.ParseInt(spec[dash+1:slash], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, fmt.Errorf("invalid end in Content-Range '%s'", header)
+	}
+	if total := spec[slash+1:]; total != "*" {
+		size, err := strconv.ParseInt(total, 10, 64)
+		if err != nil || size <= end {
+			return 0, 0, fmt.Errorf("invalid total in Content-Range '%s'", header)
+		}
+	}
+
+	return start, end - start + 1, nil
+}
+
+// errRangeLength is returned when the body of a PUT with a Content-Range
+// isn't the length of the range.
+var errRangeLength = errors.New("body does not match Content-Range")
+
+// rangeReader reads the body of a PUT with a Content-Range, returning
+// errRangeLength if it holds more or less than remaining bytes. Chunked and
+// gzipped bodies have no Content-Length to check beforehand.
+type rangeReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *rangeReader) Read(p []byte) (int, error) {
+	if l.remaining == 0 {
+		var extra [1]byte
+		_, err := io.ReadFull(l.r, extra[:])
+		if err == nil {
+			return 0, errRangeLength
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if err == io.EOF && l.remaining > 0 {
+		err = errRangeLength
+	}
+	return n, err
+}
+
+// modifiedSince reports if the file at path in store was modified after the
+// HTTP date in header. It is false if the file doesn't exist or header is
+// empty or invalid, so the precondition is ignored.
+func modifiedSince(store Storage, path, header string) bool {
+	if header == "" {
+		return false
+	}
+	since, err := http.ParseTime(header)
+	if err != nil {
+		return false
+	}
+	info, err := store.Stat(path)
+	if err != nil {
+		return false
+	}
+	// HTTP dates have a resolution of seconds
+	return info.ModTime().Truncate(time.Second).After(since)
+}
+
+// etagMatches reports if the file at path in store has one of the ETags in
+// the If-Match header, or exists if the header is "*". The gzip ETags given
+// to compressed responses match the file too. It is true if header is empty.
+func etagMatches(store Storage, path, header string) bool {
+	if header == "" {
+		return true
+	}
+	info, err := store.Stat(path)
 	if err != nil {
-		fs.logger.SetLevel(sysdlog.Err)
-		fs.logger.Printf("error %s:%s\n", req.Method, err)
-		http.Error(w, fmt.Sprintf("error %s file", doing), http.StatusInternalServerError)
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	etag := fileETag(info)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == etag || tag == gzipETag(etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonError is the body of error responses.
+type jsonError struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// writeJSONError replies to the request with the status code and a JSON
+// object holding the error message.
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(jsonError{Error: msg, Code: code})
+}
+
+// isUpload reports if requests with the method write their body to a file.
+func isUpload(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return true
 	}
+	return false
+}
+
+// isDir reports if path is an existing directory in store.
+func isDir(store Storage, path string) bool {
+	info, err := store.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// isBodyTooLarge reports if err was caused by reading past the limit of a
+// reader created by http.MaxBytesReader.
+func isBodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "http: request body too large")
+}
+
+// errDirNotEmpty is returned when deleting a directory with contents without
+// deleting them too.
+var errDirNotEmpty = errors.New("directory is not empty")
+
+// errIsDir is returned when reading a directory as a file.
+var errIsDir = errors.New("path is a directory")
+
+// errDotfile is returned when writing to a path with a segment starting with
+// '.' while AllowDotfiles is false.
+var errDotfile = errors.New("dotfiles are not allowed")
+
+// errExtension is returned when writing a file with an extension the api key
+// isn't allowed to write.
+var errExtension = errors.New("file extension is not allowed")
+
+// errEmptyUpload is returned when uploading an empty file while
+// RejectEmptyUploads is true.
+var errEmptyUpload = errors.New("empty uploads are not allowed")
+
+// emptyBody reports if the body of req is empty, reading its first byte if
+// the Content-Length isn't known. The byte is put back to be read again, and
+// errors reading it are left to be met again by the next read.
+func emptyBody(req *http.Request) bool {
+	if req.ContentLength >= 0 {
+		return req.ContentLength == 0
+	}
+	first := make([]byte, 1)
+	n, err := io.ReadFull(req.Body, first)
+	if n == 0 && err == io.EOF {
+		return true
+	}
+	req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(first[:n]), req.Body))
+	return false
+}
+
+// errPathLimit is returned when writing to a path deeper, or with longer
+// names, than MaxPathDepth or MaxNameLength allow.
+var errPathLimit = errors.New("path is too deep or has too long a name")
 
+// withinPathLimits reports if the slash separated path, relative to a
+// sandbox, is within MaxPathDepth and MaxNameLength.
+func (s Config) withinPathLimits(rel string) bool {
+	segments := strings.Split(rel, "/")
+	if s.MaxPathDepth > 0 && len(segments) > s.MaxPathDepth {
+		return false
+	}
+	for _, segment := range segments {
+		if s.MaxNameLength > 0 && len(segment) > s.MaxNameLength {
+			return false
+		}
+	}
+	return true
 }
 
-// writeFile appends or truncates, according to the flag, the file at path,
-// creating the file and any required directories.
-func writeFile(flag int, path string, src io.Reader) error {
-	// create directories if necessary
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, dirPerm); err != nil {
+// errSymlink is returned for paths through symlinks while FollowSymlinks is
+// false.
+var errSymlink = errors.New("symlinks are not followed")
+
+// hasSymlink reports if any existing file or directory in store in the path
+// of localpath within sandbox, including localpath itself, is a symlink. The
+// sandbox itself may be one.
+func hasSymlink(store Storage, sandbox, localpath string) bool {
+	rel, err := filepath.Rel(sandbox, localpath)
+	if err != nil {
+		return true
+	}
+	if rel == "." {
+		return false
+	}
+	path := sandbox
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		path = filepath.Join(path, name)
+		info, err := store.Lstat(path)
+		if err != nil {
+			return false // nothing exists below to be a symlink
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// errCaseCollision is returned when writing to a path differing only in case
+// from an existing file while CaseSensitivePaths is false.
+var errCaseCollision = errors.New("path differs only in case from an existing file")
+
+// caseCollision reports if any name in the path of localpath within sandbox
+// differs only in case from an existing file or directory, the name itself
+// not existing.
+func caseCollision(store Storage, sandbox, localpath string) bool {
+	dir := sandbox
+	for _, name := range strings.Split(relativePath(sandbox, localpath), "/") {
+		entries, err := store.ReadDir(dir)
+		if err != nil {
+			return false // nothing below can exist yet
+		}
+		exact, folded := false, false
+		for _, e := range entries {
+			exact = exact || e.Name() == name
+			folded = folded || strings.EqualFold(e.Name(), name)
+		}
+		if !exact {
+			return folded
+		}
+		dir = filepath.Join(dir, name)
+	}
+	return false
+}
+
+// hasDotSegment reports if any segment of the slash separated resource path
+// starts with '.', such as hidden files or the trash directory.
+func hasDotSegment(resource string) bool {
+	for _, segment := range strings.Split(resource, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUserAgent reports if requests from the user agent are allowed and, if
+// not, the status to reply with.
+func (s Config) checkUserAgent(agent string) (int, bool) {
+	if agent == "" {
+		if s.RequireUserAgent {
+			return http.StatusBadRequest, false
+		}
+		return http.StatusOK, true
+	}
+	agent = strings.ToLower(agent)
+	for _, blocked := range s.BlockedUserAgents {
+		if blocked != "" && strings.Contains(agent, strings.ToLower(blocked)) {
+			return http.StatusForbidden, false
+		}
+	}
+	return http.StatusOK, true
+}
+
+// hasControlChars reports if the path contains control characters such as
+// NUL or newline.
+func hasControlChars(path string) bool {
+	for _, r := range path {
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// relativePath gives the slash separated path of localpath within sandbox.
+func relativePath(sandbox, localpath string) string {
+	rel, err := filepath.Rel(sandbox, localpath)
+	if err != nil {
+		return localpath
+	}
+	return filepath.ToSlash(rel)
+}
+
+// sandboxPath joins resource onto the sandbox directory and verifies that
+// the result is still inside the sandbox. This prevents '..' segments or
+// similar tricks from escaping to other parts of the host filesystem.
+func sandboxPath(sandbox, resource string) (string, error) {
+	if hasControlChars(resource) {
+		return "", fmt.Errorf("path %q has control characters", resource)
+	}
+	path := filepath.Join(sandbox, resource)
+
+	absSandbox, err := filepath.Abs(sandbox)
+	if err != nil {
+		return "", fmt.Errorf("error resolving sandbox '%s': %w", sandbox, err)
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("error resolving path '%s': %w", path, err)
+	}
+
+	// trailing separator so 'files/hamburger-evil' isn't inside 'files/hamburger'
+	if !strings.HasPrefix(absPath, absSandbox+string(filepath.Separator)) {
+		return "", fmt.Errorf("path '%s' is outside of sandbox '%s'", path, sandbox)
+	}
+
+	return path, nil
+}
+
+// makeDirs creates dir and any missing parents. Created directories are
+// explicitly given perms.Dir so the mode isn't reduced by the umask.
+func makeDirs(dir string, perms filePerms) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+
+	if err := os.MkdirAll(dir, perms.Dir); err != nil {
 		return fmt.Errorf("error creating directories '%s': %w", dir, err)
 	}
+	for _, d := range missing {
+		if err := os.Chmod(d, perms.Dir); err != nil {
+			return fmt.Errorf("error setting permissions of '%s': %w", d, err)
+		}
+	}
+	return nil
+}
+
+// openFile opens the file at path with flag, creating it if necessary. A
+// created file is explicitly given perms.File so the mode isn't reduced by
+// the umask.
+func openFile(path string, flag int, perms filePerms) (*os.File, error) {
+	_, statErr := os.Stat(path)
+	file, err := os.OpenFile(path, flag|os.O_CREATE, perms.File)
+	if err != nil {
+		return nil, err
+	}
+	if errors.Is(statErr, os.ErrNotExist) {
+		if err := file.Chmod(perms.File); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// writeFile appends, truncates, or exclusively creates, according to the
+// flag, the file at path, creating the file and any required directories.
+// Truncating writes are atomic: the payload goes to a temporary file which
+// replaces the original only once it has been completely written. Failed
+// appends are undone by truncating to the original size, as are writes
+// stopped early by ctx being done. If aead is not nil the payload is
+// encrypted. The payload is copied using a buffer of bufSize bytes, or
+// io.Copy's if 0.
+func writeFile(ctx context.Context, store Storage, flag int, path string, src io.Reader, aead cipher.AEAD, perms filePerms, bufSize int) error {
+	if flag&os.O_TRUNC != 0 {
+		return replaceFile(ctx, store, path, src, aead, perms, bufSize)
+	}
 
-	// open file
-	file, err := os.OpenFile(path, flag|os.O_CREATE|os.O_WRONLY, filePerm)
+	// open file, creating directories if necessary
+	file, err := store.Create(path, flag, perms)
 	if err != nil {
 		return fmt.Errorf("error opening file '%s': %w", path, err)
 	}
 	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error stating file '%s': %w", path, err)
+	}
 
 	// write
-	_, err = io.Copy(file, src)
+	var restore func() error
+	if aead == nil {
+		_, err = copyContext(ctx, file, src, bufSize)
+	} else {
+		var ew *encryptWriter
+		ew, restore, err = newAppendWriter(store, path, file, aead)
+		if err == nil {
+			_, err = copyContext(ctx, ew, src, bufSize)
+		}
+		if err == nil {
+			err = ew.Close()
+		}
+	}
 	if err != nil {
+		// don't leave a partial write behind
+		switch {
+		case flag&os.O_EXCL != 0:
+			store.Remove(path)
+		case restore != nil:
+			restore()
+		default:
+			file.Truncate(info.Size())
+		}
 		return fmt.Errorf("error writing payload to %s: %w", path, err)
 	}
 
 	return nil
 }
 
-// readFile reads the file at path and write its contents into dest.
-func readFile(path string, dest io.Writer) error {
-	file, err := os.Open(path)
+// writeFileAt writes src into the file at path starting at offset, in
+// place, creating the file and any required directories. A gap between the
+// end of the file and offset is filled with zeros. Writing in place keeps
+// the file's inode and mode, so followers see the change, and costs only
+// the size of the write. On failure the file is truncated back to its
+// original size, or removed if it was created, though bytes already written
+// within it are kept.
+func writeFileAt(ctx context.Context, store Storage, path string, offset int64, src io.Reader, perms filePerms, bufSize int) (err error) {
+	original := int64(-1) // size before writing, or -1 if missing
+	if info, err := store.Stat(path); err == nil {
+		original = info.Size()
+	}
+
+	file, err := store.Create(path, 0, perms)
+	if err != nil {
+		return fmt.Errorf("error opening file '%s': %w", path, err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if original < 0 {
+			file.Close()
+			store.Remove(path)
+			return
+		}
+		file.Truncate(original)
+		file.Close()
+	}()
+
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking to %d in '%s': %w", offset, path, err)
+	}
+	if _, err = copyContext(ctx, file, src, bufSize); err != nil {
+		return fmt.Errorf("error writing payload to %s: %w", path, err)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("error closing file '%s': %w", path, err)
+	}
+
+	return nil
+}
+
+// writeChunkAt writes src into the file at path starting at offset, in
+// place, creating the file and any required directories. It is used for
+// partial uploads, which aren't visible until finished and whose failed
+// chunks are sent again.
+func writeChunkAt(ctx context.Context, store Storage, path string, offset int64, src io.Reader, perms filePerms, bufSize int) error {
+	file, err := store.Create(path, 0, perms)
 	if err != nil {
 		return fmt.Errorf("error opening file '%s': %w", path, err)
 	}
 	defer file.Close()
 
-	_, err = io.Copy(dest, file)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking to %d in '%s': %w", offset, path, err)
+	}
+	if _, err := copyContext(ctx, file, src, bufSize); err != nil {
+		return fmt.Errorf("error writing payload to %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// replaceFile writes src to a temporary file in the same directory as path,
+// then renames it to path. On failure the temporary file is removed and any
+// existing file at path is left untouched. If aead is not nil the payload is
+// encrypted.
+func replaceFile(ctx context.Context, store Storage, path string, src io.Reader, aead cipher.AEAD, perms filePerms, bufSize int) (err error) {
+	name, err := tempPath(path)
+	if err != nil {
+		return fmt.Errorf("error naming temporary file for '%s': %w", path, err)
+	}
+	temp, err := store.Create(name, os.O_EXCL, perms)
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for '%s': %w", path, err)
+	}
+	defer func() {
+		if err != nil {
+			temp.Close()
+			store.Remove(name)
+		}
+	}()
+
+	if aead == nil {
+		_, err = copyContext(ctx, temp, src, bufSize)
+	} else {
+		var id []byte
+		if id, err = writeEncryptHeader(temp); err == nil {
+			ew := newEncryptWriter(temp, aead, id, 0)
+			if _, err = copyContext(ctx, ew, src, bufSize); err == nil {
+				err = ew.Close()
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error writing payload to %s: %w", path, err)
+	}
+	if err = temp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary file '%s': %w", name, err)
+	}
+	if err = store.Rename(name, path); err != nil {
+		return fmt.Errorf("error replacing file '%s': %w", path, err)
+	}
+
+	return nil
+}
+
+// serveFile writes the file at path into w, setting its Content-Type and
+// ETag. Conditional and range requests, including If-Range with the ETag or
+// Last-Modified date so downloads may be resumed, are handled by
+// http.ServeContent. Compressible content is gzipped for clients accepting
+// it, except for range requests, so a range is never resumed against the
+// gzip ETag. The precompressed file at sidecar, if not "", is served in its
+// place to such clients if present and not older than the file. Encrypted
+// files are decrypted using aead. The file is read bufSize bytes at a time,
+// or in the size ServeContent reads if 0.
+// Small files are kept in cache, which may be nil.
+//
+// Uncompressed responses have a Content-Length of the size found when the
+// file is opened, and http.ServeContent never sends more than that even if
+// the file grows while being sent.
+func serveFile(store Storage, path, sidecar string, w http.ResponseWriter, req *http.Request, aead cipher.AEAD, cache *fileCache, bufSize int) error {
+	file, err := store.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening file '%s': %w", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error stating file '%s': %w", path, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("error reading '%s': %w", path, errIsDir)
+	}
+
+	content, err := cache.content(path, file, info, aead)
+	if err != nil {
+		return fmt.Errorf("error decrypting file '%s': %w", path, err)
+	}
+
+	ctype, err := detectContentType(content, info.Name())
 	if err != nil {
 		return fmt.Errorf("error reading file '%s': %w", path, err)
 	}
+	w.Header().Set("Content-Type", ctype)
+
+	if aead == nil && acceptsGzip(req) && req.Header.Get("Range") == "" && serveGzipSidecar(store, sidecar, info, w, req, bufSize) {
+		return nil
+	}
+
+	etag := fileETag(info)
+	if isCompressible(ctype) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(req) && req.Header.Get("Range") == "" {
+			etag = gzipETag(etag)
+			gz := &gzipResponseWriter{ResponseWriter: w}
+			defer gz.Close()
+			w = gz
+		}
+	}
+	w.Header().Set("ETag", etag)
+
+	// stop reading the file once the client has gone
+	http.ServeContent(w, req, info.Name(), info.ModTime(), contentReader(req.Context(), content, bufSize))
+
+	return nil
+}
+
+// fileETag computes an ETag for the file from its size and modification time.
+// The time is used to the nanosecond, so the ETag changes whenever the file
+// is rewritten and can serve as a strong validator for If-Range.
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// headFile writes the size and modification time of the file at path into
+// the headers of w without writing any of the file's contents. The size of
+// encrypted files is that of their plaintext.
+func headFile(store Storage, path string, w http.ResponseWriter, aead cipher.AEAD) error {
+	file, err := store.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening file '%s': %w", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error stating file '%s': %w", path, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("error reading '%s': %w", path, errIsDir)
+	}
+	_, size, err := plaintext(file, aead)
+	if err != nil {
+		return fmt.Errorf("error decrypting file '%s': %w", path, err)
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", fileETag(info))
+	w.Header().Set("Accept-Ranges", "bytes")
 
 	return nil
 }
 
-// deleteFile deletes the file at path.
-func deleteFile(path string) error {
-	if err := os.Remove(path); err != nil {
+// errInvalidDestination is returned for MOVE and COPY requests without a
+// Destination within the sandbox.
+var errInvalidDestination = errors.New("invalid destination")
+
+// validateDestination gives the path within sandbox of the Destination of a
+// MOVE or COPY request, checking that the file may be written there as it
+// would be for an upload to that path.
+func (fs *httpfsServer) validateDestination(sandbox string, req *http.Request, settings Config, keycfg keyConfig) (string, error) {
+	dest, err := destinationPath(sandbox, req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", errInvalidDestination, err)
+	}
+	rel := relativePath(sandbox, dest)
+	switch {
+	case inTrash(rel):
+		return "", errTrash
+	case !settings.AllowDotfiles && hasDotSegment(rel):
+		return "", errDotfile
+	case !settings.withinPathLimits(rel):
+		return "", errPathLimit
+	case !settings.CaseSensitivePaths && caseCollision(fs.storage, sandbox, dest):
+		return "", errCaseCollision
+	case !settings.FollowSymlinks && hasSymlink(fs.storage, sandbox, dest):
+		return "", errSymlink
+	case !keycfg.allowsName(dest):
+		return "", errExtension
+	}
+	return dest, nil
+}
+
+// destinationPath resolves the URL or path in the Destination header of req
+// to a path within sandbox.
+func destinationPath(sandbox string, req *http.Request) (string, error) {
+	header := req.Header.Get("Destination")
+	dest, err := url.Parse(header)
+	if err != nil {
+		return "", fmt.Errorf("error parsing destination '%s': %w", header, err)
+	}
+	if dest.Path == "" {
+		return "", fmt.Errorf("no destination given")
+	}
+	return sandboxPath(sandbox, dest.Path)
+}
+
+// moveFile renames the file at src in store to dest, creating any
+// directories required for dest.
+func moveFile(store Storage, src, dest string, perms filePerms) error {
+	if _, err := store.Stat(src); err != nil {
+		return fmt.Errorf("error stating file '%s': %w", src, err)
+	}
+
+	dir := filepath.Dir(dest)
+	if err := store.MakeDirs(dir, perms); err != nil {
+		return err
+	}
+
+	if err := store.Rename(src, dest); err != nil {
+		return fmt.Errorf("error moving file '%s' to '%s': %w", src, dest, err)
+	}
+
+	return nil
+}
+
+// copyFile copies the file at src to dest, creating any directories
+// required for dest. The copy has the same permissions as src.
+func copyFile(ctx context.Context, store Storage, src, dest string, perms filePerms, bufSize int) error {
+	file, err := store.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening file '%s': %w", src, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error stating file '%s': %w", src, err)
+	}
+
+	// copied as stored, so encrypted files stay encrypted
+	perms.File = info.Mode().Perm()
+	if err := writeFile(ctx, store, os.O_TRUNC, dest, file, nil, perms, bufSize); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// pruneEmptyParents removes the directories containing path which are left
+// empty, from the innermost outwards, stopping at the first which isn't
+// empty. The sandbox itself is never removed.
+func pruneEmptyParents(store Storage, sandbox, path string) {
+	for dir := filepath.Dir(path); strings.HasPrefix(dir, sandbox+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if store.Remove(dir) != nil {
+			return // not empty
+		}
+	}
+}
+
+// deleteFile deletes the file or empty directory at path. Directories with
+// contents are only deleted, with everything in them, if recursive is true.
+func deleteFile(store Storage, path string, recursive bool) error {
+	if info, err := store.Stat(path); recursive && err == nil && info.IsDir() {
+		if err := removeAll(store, path); err != nil {
+			return fmt.Errorf("error deleting directory '%s': %w", path, err)
+		}
+		return nil
+	}
+
+	if err := store.Remove(path); err != nil {
+		if entries, _ := store.ReadDir(path); len(entries) > 0 {
+			return fmt.Errorf("error deleting directory '%s': %w", path, errDirNotEmpty)
+		}
 		return fmt.Errorf("error deleting file '%s': %w", path, err)
 	}
 
@@ -0,0 +1,2121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// api key given all permissions on the "sandbox" directory by testConfig
+const testKey = "test-key"
+
+// testConfig gives the settings OpenConfig would for a config serving a
+// temporary FileRoot, which it creates, to testKey, logging to a file beside
+// it.
+func testConfig(t testing.TB) Config {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "files"), dirPerm); err != nil {
+		t.Fatal(err)
+	}
+	return Config{
+		Address:            "127.0.0.1:0",
+		FileRoot:           filepath.Join(dir, "files"),
+		AllowDotfiles:      true,
+		IndexFiles:         defaultIndexFiles(),
+		HTTP2Enabled:       true,
+		CaseSensitivePaths: true,
+		LogFile:            filepath.Join(dir, "httpfs.log"),
+		APIKeys: map[apikey]keyConfig{
+			testKey: {Dir: "sandbox", Perms: permAll},
+		},
+	}
+}
+
+// newTestServer sets up a server using cfg.
+func newTestServer(t *testing.T, cfg Config) *httpfsServer {
+	t.Helper()
+	fs, err := NewHTTPFSServer(cfg)
+	if err != nil {
+		t.Fatalf("error setting up server: %s", err)
+	}
+	return fs
+}
+
+// newRequest creates a request for target using key, or no key if empty.
+func newRequest(method, target, key string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	if key != "" {
+		req.SetBasicAuth("user", key)
+	}
+	return req
+}
+
+// serve gives the response of fs's handler to req.
+func serve(fs *httpfsServer, req *http.Request) *http.Response {
+	rec := httptest.NewRecorder()
+	fs.server.Handler.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+// do sends a request for target with body to fs using key.
+func do(fs *httpfsServer, method, target, key, body string) *http.Response {
+	return serve(fs, newRequest(method, target, key, strings.NewReader(body)))
+}
+
+// readBody reads the whole body of resp.
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading response: %s", err)
+	}
+	return string(data)
+}
+
+// expectStatus fails the test if resp doesn't have the status code.
+func expectStatus(t *testing.T, resp *http.Response, code int) {
+	t.Helper()
+	if resp.StatusCode != code {
+		t.Fatalf("got status %d, want %d: %s", resp.StatusCode, code, readBody(t, resp))
+	}
+}
+
+// sandboxFile gives the host path of the resource in testKey's sandbox.
+func sandboxFile(cfg Config, resource string) string {
+	return filepath.Join(cfg.FileRoot, "sandbox", filepath.FromSlash(resource))
+}
+
+// writeSandboxFile stores content as the resource in testKey's sandbox.
+func writeSandboxFile(t *testing.T, cfg Config, resource, content string) {
+	t.Helper()
+	path := sandboxFile(cfg, resource)
+	if err := os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), filePerm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readSandboxFile gives the content of the resource in testKey's sandbox.
+func readSandboxFile(t *testing.T, cfg Config, resource string) string {
+	t.Helper()
+	data, err := os.ReadFile(sandboxFile(cfg, resource))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// exists reports if there is a file at path.
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestSandboxPath(t *testing.T) {
+	sandbox := filepath.Join(t.TempDir(), "hamburger")
+	tests := []struct {
+		resource string
+		ok       bool
+	}{
+		{"/file.txt", true},
+		{"/dir/file.txt", true},
+		{"/dir/", true},
+		{"/dir/../file.txt", true},
+		{"/../file.txt", false},
+		{"/../../etc/passwd", false},
+		{"/dir/../../file.txt", false},
+		{"/../hamburger-evil/file.txt", false},
+		{"/..", false},
+		{"/../", false},
+		{"/", false}, // the sandbox itself
+		{"/etc/passwd", true},
+		{"//etc/passwd", true},
+		{"/file\x00.txt", false},
+	}
+	for _, test := range tests {
+		path, err := sandboxPath(sandbox, test.resource)
+		if (err == nil) != test.ok {
+			t.Errorf("sandboxPath(%q) gave error %v, want ok %t", test.resource, err, test.ok)
+			continue
+		}
+		if test.ok && !strings.HasPrefix(path, sandbox+string(filepath.Separator)) {
+			t.Errorf("sandboxPath(%q) = %q, outside of %q", test.resource, path, sandbox)
+		}
+	}
+}
+
+func TestTraversalRejected(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "inside.txt", "inside")
+
+	// files beside the sandbox which must never be served
+	const content = "top secret"
+	secret := filepath.Join(cfg.FileRoot, "secret.txt")
+	if err := os.WriteFile(secret, []byte(content), filePerm); err != nil {
+		t.Fatal(err)
+	}
+	evil := filepath.Join(cfg.FileRoot, "sandbox-evil", "secret.txt")
+	os.MkdirAll(filepath.Dir(evil), dirPerm)
+	if err := os.WriteFile(evil, []byte(content), filePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{
+		"/../secret.txt",
+		"/%2e%2e/secret.txt",
+		"/%2E%2E/secret.txt",
+		"/%2e%2e%2fsecret.txt",
+		"/sub/%2e%2e/%2e%2e/secret.txt",
+		"/../sandbox-evil/secret.txt",
+		"/%2e%2e/sandbox-evil/secret.txt",
+		"/../",
+		"/%2e%2e/",
+	} {
+		// as decoded, reaching the handler without the mux cleaning it first
+		req := newRequest(http.MethodGet, "/", testKey, nil)
+		req.URL.Path = strings.NewReplacer("%2e", ".", "%2E", ".", "%2f", "/").Replace(target)
+		rec := httptest.NewRecorder()
+		fs.reqHandler(rec, req)
+		expectStatus(t, rec.Result(), http.StatusBadRequest)
+
+		// as sent on the wire, leaving any cleaning to the server
+		resp := do(fs, http.MethodGet, target, testKey, "")
+		if body := readBody(t, resp); resp.StatusCode == http.StatusOK || strings.Contains(body, content) {
+			t.Errorf("GET %s gave %d: %s", target, resp.StatusCode, body)
+		}
+	}
+
+	// writes are refused too, leaving nothing outside the sandbox
+	req := newRequest(http.MethodPut, "/", testKey, strings.NewReader("overwritten"))
+	req.URL.Path = "/../secret.txt"
+	rec := httptest.NewRecorder()
+	fs.reqHandler(rec, req)
+	expectStatus(t, rec.Result(), http.StatusBadRequest)
+	if data, _ := os.ReadFile(secret); string(data) != content {
+		t.Errorf("file outside the sandbox was overwritten with %q", data)
+	}
+
+	// absolute looking and trailing slash paths stay in the sandbox
+	resp := do(fs, http.MethodGet, "//inside.txt", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); body != "inside" {
+		t.Errorf("GET //inside.txt gave %q", body)
+	}
+	expectStatus(t, do(fs, http.MethodPut, "/etc/passwd", testKey, "sandboxed"), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "etc/passwd"); got != "sandboxed" {
+		t.Errorf("PUT /etc/passwd stored %q in the sandbox", got)
+	}
+	resp = do(fs, http.MethodGet, "/inside.txt/", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); body != "inside" {
+		t.Errorf("GET /inside.txt/ gave %q", body)
+	}
+}
+
+func TestHead(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+
+	const content = "some file content"
+	expectStatus(t, do(fs, http.MethodPut, "/dir/file.txt", testKey, content), http.StatusOK)
+	info, err := os.Stat(sandboxFile(cfg, "dir/file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := do(fs, http.MethodHead, "/dir/file.txt", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	if got, want := resp.Header.Get("Content-Length"), strconv.Itoa(len(content)); got != want {
+		t.Errorf("Content-Length is %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get("Last-Modified"), info.ModTime().UTC().Format(http.TimeFormat); got != want {
+		t.Errorf("Last-Modified is %q, want %q", got, want)
+	}
+	if body := readBody(t, resp); body != "" {
+		t.Errorf("HEAD gave a body %q", body)
+	}
+
+	expectStatus(t, do(fs, http.MethodHead, "/missing.txt", testKey, ""), http.StatusNotFound)
+}
+
+func TestMethodPermissions(t *testing.T) {
+	cfg := testConfig(t)
+	perms := []string{"", "r", "w", "d", "rw", "rd", "wd", "rwd"}
+	for _, p := range perms {
+		var perm permission
+		if err := perm.UnmarshalJSON([]byte(strconv.Quote(p))); err != nil {
+			t.Fatal(err)
+		}
+		cfg.APIKeys[apikey("key-"+p)] = keyConfig{Dir: "sandbox", Perms: perm}
+	}
+	fs := newTestServer(t, cfg)
+
+	for _, p := range perms {
+		key := "key-" + p
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete} {
+			writeSandboxFile(t, cfg, "file.txt", "content")
+			resp := do(fs, method, "/file.txt", key, "more")
+			allowed := cfg.APIKeys[apikey(key)].Perms.Has(methodPerms[method])
+			if denied := resp.StatusCode == http.StatusForbidden; denied == allowed {
+				t.Errorf("%s with perms %q gave %d: %s", method, p, resp.StatusCode, readBody(t, resp))
+				continue
+			}
+			if allowed && resp.StatusCode != http.StatusOK {
+				t.Errorf("%s with perms %q gave %d: %s", method, p, resp.StatusCode, readBody(t, resp))
+			}
+			resp.Body.Close()
+		}
+	}
+
+	// nothing is changed by a refused request
+	writeSandboxFile(t, cfg, "file.txt", "content")
+	expectStatus(t, do(fs, http.MethodPut, "/file.txt", "key-r", "changed"), http.StatusForbidden)
+	expectStatus(t, do(fs, http.MethodDelete, "/file.txt", "key-rw", ""), http.StatusForbidden)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "content" {
+		t.Errorf("refused requests changed the file to %q", got)
+	}
+}
+
+func TestMissingFileNotFound(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "present.txt", "here")
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		for _, target := range []string{"/missing.txt", "/missing/dir/file.txt"} {
+			resp := do(fs, method, target, testKey, "")
+			expectStatus(t, resp, http.StatusNotFound)
+			if body := readBody(t, resp); !strings.Contains(body, "file not found") {
+				t.Errorf("%s %s gave %q", method, target, body)
+			}
+		}
+	}
+	expectStatus(t, do(fs, http.MethodDelete, "/present.txt", testKey, ""), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodGet, "/present.txt", testKey, ""), http.StatusNotFound)
+}
+
+func TestETag(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.bin", "content")
+
+	resp := do(fs, http.MethodGet, "/file.bin", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag given")
+	}
+	if head := do(fs, http.MethodHead, "/file.bin", testKey, ""); head.Header.Get("ETag") != etag {
+		t.Errorf("HEAD gave ETag %q, GET gave %q", head.Header.Get("ETag"), etag)
+	}
+
+	req := newRequest(http.MethodGet, "/file.bin", testKey, nil)
+	req.Header.Set("If-None-Match", etag)
+	resp = serve(fs, req)
+	expectStatus(t, resp, http.StatusNotModified)
+	if body := readBody(t, resp); body != "" {
+		t.Errorf("304 had a body %q", body)
+	}
+
+	req = newRequest(http.MethodGet, "/file.bin", testKey, nil)
+	req.Header.Set("If-None-Match", `"something-else"`)
+	resp = serve(fs, req)
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); body != "content" {
+		t.Errorf("GET with another ETag gave %q", body)
+	}
+
+	// rewriting the file changes its ETag
+	expectStatus(t, do(fs, http.MethodPut, "/file.bin", testKey, "changed"), http.StatusOK)
+	req = newRequest(http.MethodGet, "/file.bin", testKey, nil)
+	req.Header.Set("If-None-Match", etag)
+	resp = serve(fs, req)
+	expectStatus(t, resp, http.StatusOK)
+	if resp.Header.Get("ETag") == etag {
+		t.Error("ETag didn't change when the file did")
+	}
+}
+
+func TestContentType(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00"
+	tests := []struct {
+		name, content, ctype string
+	}{
+		{"data.json", `{"a": 1}`, "application/json"},
+		{"image.png", png, "image/png"},
+		{"noextension", png, "image/png"},
+		{"notes", "just some text", "text/plain; charset=utf-8"},
+		{"page", "<!DOCTYPE html><html><body>hi</body></html>", "text/html; charset=utf-8"},
+	}
+	for _, test := range tests {
+		writeSandboxFile(t, cfg, test.name, test.content)
+		resp := do(fs, http.MethodGet, "/"+test.name, testKey, "")
+		expectStatus(t, resp, http.StatusOK)
+		if got := resp.Header.Get("Content-Type"); got != test.ctype {
+			t.Errorf("%s has Content-Type %q, want %q", test.name, got, test.ctype)
+		}
+		if body := readBody(t, resp); body != test.content {
+			t.Errorf("%s gave %q after sniffing, want %q", test.name, body, test.content)
+		}
+	}
+}
+
+// failingReader gives its content and then fails with err.
+type failingReader struct {
+	content io.Reader
+	err     error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.content.Read(p)
+	if err == io.EOF {
+		return n, f.err
+	}
+	return n, err
+}
+
+func TestAtomicTruncatingWrite(t *testing.T) {
+	cfg := testConfig(t)
+	writeSandboxFile(t, cfg, "file.txt", "original content")
+	path := sandboxFile(cfg, "file.txt")
+
+	src := &failingReader{strings.NewReader("partial new"), errors.New("connection reset")}
+	err := writeFile(context.Background(), localStorage{}, os.O_TRUNC, path, src, nil, cfg.perms(), 0)
+	if err == nil {
+		t.Fatal("failed write reported success")
+	}
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "original content" {
+		t.Errorf("failed write left %q", got)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("failed write left %d files behind", len(entries)-1)
+	}
+
+	// the same through a request
+	fs := newTestServer(t, cfg)
+	req := newRequest(http.MethodPut, "/file.txt", testKey, &failingReader{strings.NewReader("partial"), io.ErrUnexpectedEOF})
+	expectStatus(t, serve(fs, req), http.StatusInternalServerError)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "original content" {
+		t.Errorf("failed PUT left %q", got)
+	}
+
+	if err := writeFile(context.Background(), localStorage{}, os.O_TRUNC, path, strings.NewReader("new"), nil, cfg.perms(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "new" {
+		t.Errorf("successful write left %q", got)
+	}
+}
+
+func TestFailedAppendTruncated(t *testing.T) {
+	cfg := testConfig(t)
+	writeSandboxFile(t, cfg, "file.txt", "original")
+	path := sandboxFile(cfg, "file.txt")
+
+	src := &failingReader{strings.NewReader(" and more"), errors.New("connection reset")}
+	if err := writeFile(context.Background(), localStorage{}, os.O_APPEND, path, src, nil, cfg.perms(), 0); err == nil {
+		t.Fatal("failed append reported success")
+	}
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "original" {
+		t.Errorf("failed append left %q", got)
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.bin", "0123456789")
+
+	req := newRequest(http.MethodGet, "/file.bin", testKey, nil)
+	req.Header.Set("Range", "bytes=0-4")
+	resp := serve(fs, req)
+	expectStatus(t, resp, http.StatusPartialContent)
+	if got := resp.Header.Get("Content-Range"); got != "bytes 0-4/10" {
+		t.Errorf("Content-Range is %q", got)
+	}
+	if body := readBody(t, resp); body != "01234" {
+		t.Errorf("range gave %q", body)
+	}
+
+	req = newRequest(http.MethodGet, "/file.bin", testKey, nil)
+	req.Header.Set("Range", "bytes=-3")
+	resp = serve(fs, req)
+	expectStatus(t, resp, http.StatusPartialContent)
+	if body := readBody(t, resp); body != "789" {
+		t.Errorf("suffix range gave %q", body)
+	}
+
+	req = newRequest(http.MethodGet, "/file.bin", testKey, nil)
+	req.Header.Set("Range", "bytes=20-30")
+	expectStatus(t, serve(fs, req), http.StatusRequestedRangeNotSatisfiable)
+
+	resp = do(fs, http.MethodGet, "/file.bin", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	if got := resp.Header.Get("Accept-Ranges"); got != "bytes" {
+		t.Errorf("Accept-Ranges is %q", got)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+
+	resp := serve(fs, newRequest(http.MethodGet, "/healthz", "", nil))
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); strings.TrimSpace(body) != "ok" {
+		t.Errorf("healthz gave %q", body)
+	}
+
+	if err := os.RemoveAll(cfg.FileRoot); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, serve(fs, newRequest(http.MethodGet, "/healthz", "", nil)), http.StatusServiceUnavailable)
+}
+
+func TestCreateOnly(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+
+	expectStatus(t, do(fs, http.MethodPost, "/file.txt?mode=create", testKey, "first"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPost, "/file.txt?mode=create", testKey, "second"), http.StatusConflict)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "first" {
+		t.Errorf("second create left %q", got)
+	}
+
+	// appending is still the default
+	expectStatus(t, do(fs, http.MethodPost, "/file.txt", testKey, "+more"), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "first+more" {
+		t.Errorf("append left %q", got)
+	}
+}
+
+func TestConcurrentPuts(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+
+	// bodies large enough to be written in several pieces
+	bodies := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		body := strings.Repeat(string(rune('a'+i)), 256*1024)
+		bodies[body] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := do(fs, http.MethodPut, "/file.txt", testKey, body)
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("PUT gave %d", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := readSandboxFile(t, cfg, "file.txt"); !bodies[got] {
+		t.Errorf("concurrent PUTs left a mix of %d bytes starting %q", len(got), got[:10])
+	}
+}
+
+func TestConcurrentAppends(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		body := strings.Repeat(string(rune('a'+i)), 64*1024)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			do(fs, http.MethodPost, "/file.txt", testKey, body)
+		}()
+	}
+	wg.Wait()
+
+	// each append is whole, never interleaved with another
+	got := readSandboxFile(t, cfg, "file.txt")
+	if len(got) != 20*64*1024 {
+		t.Fatalf("appends left %d bytes", len(got))
+	}
+	for i := 0; i < len(got); i += 64 * 1024 {
+		chunk := got[i : i+64*1024]
+		if strings.Count(chunk, chunk[:1]) != len(chunk) {
+			t.Fatalf("append at %d is interleaved", i)
+		}
+	}
+}
+
+func TestMove(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "from.txt", "moving")
+
+	req := newRequest(methodMove, "/from.txt", testKey, nil)
+	req.Header.Set("Destination", "/new/dir/to.txt")
+	expectStatus(t, serve(fs, req), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "new/dir/to.txt"); got != "moving" {
+		t.Errorf("destination has %q after MOVE", got)
+	}
+	if exists(sandboxFile(cfg, "from.txt")) {
+		t.Error("source still exists after MOVE")
+	}
+
+	req = newRequest(methodMove, "/from.txt", testKey, nil)
+	req.Header.Set("Destination", "/to.txt")
+	expectStatus(t, serve(fs, req), http.StatusNotFound)
+}
+
+func TestMoveDestinationRejected(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AllowDotfiles = false
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "from.txt", "staying")
+
+	tests := []struct {
+		dest   string
+		status int
+	}{
+		{"", http.StatusBadRequest},
+		{"/../escaped.txt", http.StatusBadRequest},
+		{"/a/../../escaped.txt", http.StatusBadRequest},
+		{"/.hidden", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req := newRequest(methodMove, "/from.txt", testKey, nil)
+		if test.dest != "" {
+			req.Header.Set("Destination", test.dest)
+		}
+		resp := serve(fs, req)
+		if resp.StatusCode != test.status {
+			t.Errorf("MOVE to %q gave %d, want %d", test.dest, resp.StatusCode, test.status)
+		}
+	}
+	if got := readSandboxFile(t, cfg, "from.txt"); got != "staying" {
+		t.Errorf("source has %q after rejected moves", got)
+	}
+	if exists(filepath.Join(cfg.FileRoot, "escaped.txt")) {
+		t.Error("MOVE wrote outside the sandbox")
+	}
+}
+
+func TestMoveSwapDoesNotDeadlock(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "a.txt", "a")
+	writeSandboxFile(t, cfg, "b.txt", "b")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for _, pair := range [][2]string{{"/a.txt", "/b.txt"}, {"/b.txt", "/a.txt"}} {
+			wg.Add(1)
+			go func(from, to string) {
+				defer wg.Done()
+				req := newRequest(methodMove, from, testKey, nil)
+				req.Header.Set("Destination", to)
+				serve(fs, req)
+			}(pair[0], pair[1])
+		}
+	}
+	wg.Wait()
+}
+
+func TestLockBoth(t *testing.T) {
+	locks := newPathLocks()
+	locks.LockBoth("same", "same")()
+
+	unlock := locks.LockBoth("b", "a")
+	taken := make(chan struct{})
+	go func() {
+		locks.Lock("a")()
+		close(taken)
+	}()
+	select {
+	case <-taken:
+		t.Fatal("lock was taken while held")
+	default:
+	}
+	unlock()
+	<-taken
+}
+
+func TestCopy(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "from.txt", "copied")
+	if err := os.Chmod(sandboxFile(cfg, "from.txt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	req := newRequest(methodCopy, "/from.txt", testKey, nil)
+	req.Header.Set("Destination", "/new/dir/to.txt")
+	expectStatus(t, serve(fs, req), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "new/dir/to.txt"); got != "copied" {
+		t.Errorf("destination has %q after COPY", got)
+	}
+	if got := readSandboxFile(t, cfg, "from.txt"); got != "copied" {
+		t.Errorf("source has %q after COPY", got)
+	}
+	info, err := os.Stat(sandboxFile(cfg, "new/dir/to.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("copy has mode %v, want the source's 0600", info.Mode().Perm())
+	}
+
+	req = newRequest(methodCopy, "/missing.txt", testKey, nil)
+	req.Header.Set("Destination", "/to.txt")
+	expectStatus(t, serve(fs, req), http.StatusNotFound)
+	if exists(sandboxFile(cfg, "to.txt")) {
+		t.Error("COPY of a missing file created the destination")
+	}
+}
+
+func TestCopyDestinationRejected(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "from.txt", "copied")
+
+	for _, dest := range []string{"/../escaped.txt", "http://example.com/../../escaped.txt"} {
+		req := newRequest(methodCopy, "/from.txt", testKey, nil)
+		req.Header.Set("Destination", dest)
+		expectStatus(t, serve(fs, req), http.StatusBadRequest)
+	}
+	if exists(filepath.Join(cfg.FileRoot, "escaped.txt")) {
+		t.Error("COPY wrote outside the sandbox")
+	}
+}
+
+func TestDeleteToTrash(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.TrashEnabled = true
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "dir/file.txt", "deleted")
+
+	expectStatus(t, do(fs, http.MethodDelete, "/dir/file.txt", testKey, ""), http.StatusOK)
+	if exists(sandboxFile(cfg, "dir/file.txt")) {
+		t.Fatal("file still exists after DELETE")
+	}
+	trashed, _ := filepath.Glob(sandboxFile(cfg, ".trash/*/dir/file.txt"))
+	if len(trashed) != 1 {
+		t.Fatalf("found %v in the trash, want the deleted file", trashed)
+	}
+	if content, _ := os.ReadFile(trashed[0]); string(content) != "deleted" {
+		t.Errorf("trashed file has %q", content)
+	}
+
+	// deleting within the trash removes it for good
+	rel, _ := filepath.Rel(sandboxFile(cfg, ""), trashed[0])
+	expectStatus(t, do(fs, http.MethodDelete, "/"+filepath.ToSlash(rel), testKey, ""), http.StatusOK)
+	if exists(trashed[0]) {
+		t.Error("file in the trash still exists after DELETE")
+	}
+	if again, _ := filepath.Glob(sandboxFile(cfg, ".trash/*/.trash")); len(again) != 0 {
+		t.Errorf("file in the trash was moved to %v", again)
+	}
+
+	writeSandboxFile(t, cfg, "purged.txt", "gone")
+	expectStatus(t, do(fs, http.MethodDelete, "/purged.txt?purge=true", testKey, ""), http.StatusOK)
+	if found, _ := filepath.Glob(sandboxFile(cfg, ".trash/*/purged.txt")); len(found) != 0 {
+		t.Errorf("purged file was moved to %v", found)
+	}
+}
+
+func TestTrashIsReadOnly(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.TrashEnabled = true
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+
+	for _, method := range []string{http.MethodPut, http.MethodPost, http.MethodPatch} {
+		for _, target := range []string{"/.trash/file.txt", "/.TRASH/x/file.txt", "/.trash"} {
+			resp := do(fs, method, target, testKey, "content")
+			if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("%s %s gave %d, want 403", method, target, resp.StatusCode)
+			}
+		}
+	}
+	for _, method := range []string{methodMove, methodCopy} {
+		req := newRequest(method, "/file.txt", testKey, nil)
+		req.Header.Set("Destination", "/.trash/20990101T000000.000000000Z/file.txt")
+		expectStatus(t, serve(fs, req), http.StatusForbidden)
+	}
+	if exists(sandboxFile(cfg, ".trash")) {
+		t.Error("the trash was written to")
+	}
+}
+
+func TestTrashCountsTowardQuota(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.TrashEnabled = true
+	cfg.APIKeys[testKey] = keyConfig{Dir: "sandbox", Perms: permAll, QuotaBytes: 10}
+	fs := newTestServer(t, cfg)
+
+	expectStatus(t, do(fs, http.MethodPut, "/dir/a.txt", testKey, "12345678"), http.StatusOK)
+	// deleting a directory forgets the sandbox usage, which mustn't free the
+	// space of what was moved to the trash
+	expectStatus(t, do(fs, http.MethodDelete, "/dir?recursive=true", testKey, ""), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPut, "/b.txt", testKey, "12345678"), http.StatusInsufficientStorage)
+
+	used, err := fs.usage.Used(sandboxFile(cfg, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != 8 {
+		t.Errorf("usage is %d after trashing, want the 8 bytes in the trash", used)
+	}
+}
+
+// expectJSONError checks that resp is a JSON error with the status code.
+func expectJSONError(t *testing.T, resp *http.Response, code int) {
+	t.Helper()
+	expectStatus(t, resp, code)
+	if ctype := resp.Header.Get("Content-Type"); ctype != "application/json" {
+		t.Errorf("error has Content-Type %q", ctype)
+	}
+	var body jsonError
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("error body isn't JSON: %s", err)
+	}
+	if body.Code != code || body.Error == "" {
+		t.Errorf("got error %+v, want code %d with a message", body, code)
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+
+	expectJSONError(t, do(fs, http.MethodGet, "/file.txt", "wrong-key", ""), http.StatusUnauthorized)
+	expectJSONError(t, do(fs, http.MethodGet, "/file.txt", "", ""), http.StatusUnauthorized)
+	expectJSONError(t, do(fs, http.MethodGet, "/missing.txt", testKey, ""), http.StatusNotFound)
+	expectJSONError(t, do(fs, http.MethodDelete, "/missing.txt", testKey, ""), http.StatusNotFound)
+}
+
+func TestOptions(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.CORSAllowedOrigins = []string{"https://allowed.example"}
+	fs := newTestServer(t, cfg)
+
+	tests := []struct {
+		origin string
+		allow  string
+	}{
+		{"https://allowed.example", "https://allowed.example"},
+		{"https://other.example", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		req := newRequest(http.MethodOptions, "/file.txt", "", nil)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		resp := serve(fs, req)
+		expectStatus(t, resp, http.StatusNoContent)
+		if resp.Header.Get("Allow") != supportedMethods {
+			t.Errorf("got Allow %q", resp.Header.Get("Allow"))
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != test.allow {
+			t.Errorf("origin %q was allowed as %q, want %q", test.origin, got, test.allow)
+		}
+		if methods := resp.Header.Get("Access-Control-Allow-Methods"); (methods != "") != (test.allow != "") {
+			t.Errorf("origin %q got Access-Control-Allow-Methods %q", test.origin, methods)
+		}
+	}
+
+	// any origin is allowed without a list
+	cfg.CORSAllowedOrigins = nil
+	fs = newTestServer(t, cfg)
+	req := newRequest(http.MethodOptions, "/file.txt", "", nil)
+	req.Header.Set("Origin", "https://other.example")
+	resp := serve(fs, req)
+	expectStatus(t, resp, http.StatusNoContent)
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("got Access-Control-Allow-Origin %q without a list, want *", got)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ReadTimeoutSeconds = 5
+	cfg.WriteTimeoutSeconds = 600
+	cfg.IdleTimeoutSeconds = 7
+	fs := newTestServer(t, cfg)
+	if fs.server.ReadTimeout != 5*time.Second || fs.server.WriteTimeout != 10*time.Minute || fs.server.IdleTimeout != 7*time.Second {
+		t.Errorf("got timeouts %v, %v and %v, want those configured",
+			fs.server.ReadTimeout, fs.server.WriteTimeout, fs.server.IdleTimeout)
+	}
+
+	fs = newTestServer(t, testConfig(t))
+	if fs.server.ReadTimeout != defaultTimeout || fs.server.WriteTimeout != defaultTimeout || fs.server.IdleTimeout != defaultTimeout {
+		t.Errorf("got timeouts %v, %v and %v when unset, want %v",
+			fs.server.ReadTimeout, fs.server.WriteTimeout, fs.server.IdleTimeout, defaultTimeout)
+	}
+
+	def := DefaultConfig()
+	if def.ReadTimeoutSeconds != 30 || def.WriteTimeoutSeconds != 30 || def.IdleTimeoutSeconds != 30 {
+		t.Errorf("DefaultConfig has timeouts %d, %d and %d, want 30",
+			def.ReadTimeoutSeconds, def.WriteTimeoutSeconds, def.IdleTimeoutSeconds)
+	}
+}
+
+func TestPatchAtOffset(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "0123456789")
+
+	expectStatus(t, do(fs, http.MethodPatch, "/file.txt?offset=0", testKey, "ab"), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "ab23456789" {
+		t.Errorf("PATCH at 0 left %q", got)
+	}
+	expectStatus(t, do(fs, http.MethodPatch, "/file.txt?offset=4", testKey, "XY"), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "ab23XY6789" {
+		t.Errorf("PATCH at 4 left %q", got)
+	}
+	expectStatus(t, do(fs, http.MethodPatch, "/file.txt?offset=12", testKey, "end"), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "ab23XY6789\x00\x00end" {
+		t.Errorf("PATCH past the end left %q", got)
+	}
+	expectStatus(t, do(fs, http.MethodPatch, "/new.txt?offset=2", testKey, "new"), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "new.txt"); got != "\x00\x00new" {
+		t.Errorf("PATCH of a new file left %q", got)
+	}
+
+	for _, offset := range []string{"", "-1", "x"} {
+		expectStatus(t, do(fs, http.MethodPatch, "/file.txt?offset="+offset, testKey, "bad"), http.StatusBadRequest)
+	}
+}
+
+func TestRangedPut(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "0123456789")
+
+	put := func(contentRange, body string) *http.Response {
+		req := newRequest(http.MethodPut, "/file.txt", testKey, strings.NewReader(body))
+		req.Header.Set("Content-Range", contentRange)
+		return serve(fs, req)
+	}
+	expectStatus(t, put("bytes 3-5/10", "abc"), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "012abc6789" {
+		t.Errorf("mid-file ranged PUT left %q", got)
+	}
+	for _, bad := range []string{"bytes 5-3/10", "bytes -1-2/10", "bytes 3-5/4", "bytes=3-5/10", "3-5/10", "bytes a-b/10"} {
+		expectStatus(t, put(bad, "abc"), http.StatusBadRequest)
+	}
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "012abc6789" {
+		t.Errorf("malformed ranges left %q", got)
+	}
+}
+
+func TestFailedRangedWriteTruncated(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys[testKey] = keyConfig{Dir: "sandbox", Perms: permAll, QuotaBytes: 14}
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "0123456789")
+
+	chunked := func(method, target string, body io.Reader) *http.Request {
+		req := newRequest(method, target, testKey, body)
+		req.ContentLength = -1
+		return req
+	}
+	failed := chunked(http.MethodPatch, "/file.txt?offset=8", &failingReader{content: strings.NewReader("abc"), err: io.ErrUnexpectedEOF})
+	serve(fs, failed)
+
+	mismatch := chunked(http.MethodPut, "/file.txt", strings.NewReader("abc"))
+	mismatch.Header.Set("Content-Range", "bytes 9-11/12")
+	mismatch.Header.Set("Content-MD5", "1B2M2Y8AsgTpgAmY7PhCfg==") // of ""
+	expectStatus(t, serve(fs, mismatch), http.StatusBadRequest)
+
+	overQuota := chunked(http.MethodPatch, "/file.txt?offset=8", strings.NewReader("abcdefgh"))
+	expectStatus(t, serve(fs, overQuota), http.StatusInsufficientStorage)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled := chunked(http.MethodPatch, "/file.txt?offset=12", strings.NewReader("abc"))
+	serve(fs, cancelled.WithContext(ctx))
+
+	// bytes written within the file are kept, but it isn't extended
+	if got := readSandboxFile(t, cfg, "file.txt"); len(got) != 10 || got[:8] != "01234567" {
+		t.Errorf("failed ranged writes left %q", got)
+	}
+	failed = chunked(http.MethodPatch, "/new.txt?offset=2", &failingReader{content: strings.NewReader("abc"), err: io.ErrUnexpectedEOF})
+	serve(fs, failed)
+	entries, err := os.ReadDir(sandboxFile(cfg, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("failed ranged writes left %d files in the sandbox", len(entries))
+	}
+}
+
+func TestRangedWriteInPlace(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "0123456789")
+	path := sandboxFile(cfg, "file.txt")
+	if err := os.Chmod(path, 0604); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectStatus(t, do(fs, http.MethodPatch, "/file.txt?offset=2", testKey, "ab"), http.StatusOK)
+	req := newRequest(http.MethodPut, "/file.txt", testKey, strings.NewReader("cd"))
+	req.Header.Set("Content-Range", "bytes 6-7/10")
+	expectStatus(t, serve(fs, req), http.StatusOK)
+
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("ranged writes replaced the file")
+	}
+	if after.Mode().Perm() != 0604 {
+		t.Errorf("ranged writes changed the mode to %v", after.Mode().Perm())
+	}
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "01ab45cd89" {
+		t.Errorf("ranged writes left %q", got)
+	}
+}
+
+func TestContentRangeLength(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "0123456789")
+
+	put := func(body string, gzipped bool) *http.Response {
+		var content io.Reader = strings.NewReader(body)
+		if gzipped {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write([]byte(body))
+			gz.Close()
+			content = &buf
+		}
+		req := newRequest(http.MethodPut, "/file.txt", testKey, content)
+		req.ContentLength = -1 // as if chunked
+		req.Header.Set("Content-Range", "bytes 2-4/10")
+		if gzipped {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		return serve(fs, req)
+	}
+	for _, gzipped := range []bool{false, true} {
+		expectStatus(t, put("ab", gzipped), http.StatusBadRequest)
+		expectStatus(t, put("abcd", gzipped), http.StatusBadRequest)
+		expectStatus(t, put("abc", gzipped), http.StatusOK)
+	}
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "01abc56789" {
+		t.Errorf("ranged PUTs left %q", got)
+	}
+}
+
+// blockingReader signals started on its first Read, then waits for release
+// before reading content.
+type blockingReader struct {
+	content io.Reader
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (b *blockingReader) Read(p []byte) (int, error) {
+	b.once.Do(func() {
+		close(b.started)
+		<-b.release
+	})
+	return b.content.Read(p)
+}
+
+func TestShutdownTwice(t *testing.T) {
+	fs := newTestServer(t, testConfig(t))
+	for i := 0; i < 2; i++ {
+		if err := fs.Shutdown(context.Background()); err != nil {
+			t.Errorf("shutdown %d failed: %s", i+1, err)
+		}
+	}
+	// net/http runs the shutdown functions in their own goroutines, where
+	// closing the channels twice would panic
+	for _, stop := range []chan struct{}{fs.stopFollowing, fs.stopTrash} {
+		select {
+		case <-stop:
+		case <-time.After(5 * time.Second):
+			t.Fatal("shutdown didn't close the stop channels")
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestShutdownDrainsWrites(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.DrainWrites = true
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+	content := strings.Repeat("slow upload ", 100000)
+
+	body := &blockingReader{
+		content: strings.NewReader(content),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	written := make(chan *http.Response)
+	go func() {
+		written <- serve(fs, newRequest(http.MethodPut, "/slow.txt", testKey, body))
+	}()
+	<-body.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		fs.Shutdown(ctx)
+		close(stopped)
+	}()
+	for {
+		fs.drainMu.Lock()
+		draining := fs.draining
+		fs.drainMu.Unlock()
+		if draining {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// writes begun after shutdown are refused, while reads carry on
+	expectStatus(t, do(fs, http.MethodPut, "/late.txt", testKey, "late"), http.StatusServiceUnavailable)
+	expectStatus(t, do(fs, http.MethodDelete, "/file.txt", testKey, ""), http.StatusServiceUnavailable)
+	expectStatus(t, do(fs, http.MethodGet, "/file.txt", testKey, ""), http.StatusOK)
+	if exists(sandboxFile(cfg, "late.txt")) {
+		t.Error("write begun after shutdown was made")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-stopped:
+		t.Fatal("shutdown finished before the write")
+	default:
+	}
+	close(body.release)
+	expectStatus(t, <-written, http.StatusOK)
+	<-stopped
+	if got := readSandboxFile(t, cfg, "slow.txt"); got != content {
+		t.Errorf("drained write left %d bytes, want %d", len(got), len(content))
+	}
+}
+
+func TestModifiedTime(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	modtime := time.Date(2020, 5, 17, 12, 30, 0, 0, time.UTC)
+
+	for _, method := range []string{http.MethodPut, http.MethodPost} {
+		req := newRequest(method, "/file.txt", testKey, strings.NewReader("content"))
+		req.Header.Set("X-Modified-Time", modtime.Format(time.RFC3339))
+		expectStatus(t, serve(fs, req), http.StatusOK)
+
+		info, err := os.Stat(sandboxFile(cfg, "file.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(modtime) {
+			t.Errorf("%s left modtime %v, want %v", method, info.ModTime(), modtime)
+		}
+		resp := do(fs, http.MethodGet, "/file.txt", testKey, "")
+		if got := resp.Header.Get("Last-Modified"); got != modtime.Format(http.TimeFormat) {
+			t.Errorf("GET after %s gave Last-Modified %q", method, got)
+		}
+	}
+
+	req := newRequest(http.MethodPut, "/file.txt", testKey, strings.NewReader("content"))
+	req.Header.Set("X-Modified-Time", "yesterday")
+	expectStatus(t, serve(fs, req), http.StatusBadRequest)
+}
+
+func TestDotfiles(t *testing.T) {
+	paths := []string{"/.htaccess", "/dir/.hidden/file.txt", "/.file.txt.tmp-0123456789abcdef"}
+	for _, allow := range []bool{true, false} {
+		cfg := testConfig(t)
+		cfg.AllowDotfiles = allow
+		fs := newTestServer(t, cfg)
+
+		want := http.StatusOK
+		if !allow {
+			want = http.StatusBadRequest
+		}
+		for _, path := range paths {
+			for _, method := range []string{http.MethodPut, http.MethodPost} {
+				resp := do(fs, method, path, testKey, "content")
+				if resp.StatusCode != want {
+					t.Errorf("AllowDotfiles %v: %s %s gave %d, want %d", allow, method, path, resp.StatusCode, want)
+				}
+			}
+			if written := exists(sandboxFile(cfg, path)); written != allow {
+				t.Errorf("AllowDotfiles %v: %s written is %v", allow, path, written)
+			}
+		}
+	}
+
+	// files already there may still be read
+	cfg := testConfig(t)
+	cfg.AllowDotfiles = false
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, ".existing", "content")
+	expectStatus(t, do(fs, http.MethodGet, "/.existing", testKey, ""), http.StatusOK)
+}
+
+func TestIfUnmodifiedSince(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	modtime := time.Date(2020, 5, 17, 12, 30, 0, 0, time.UTC)
+	setFile := func() {
+		writeSandboxFile(t, cfg, "file.txt", "original")
+		if err := os.Chtimes(sandboxFile(cfg, "file.txt"), modtime, modtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		method string
+		since  time.Time
+		status int
+	}{
+		{http.MethodPut, modtime.Add(-time.Hour), http.StatusPreconditionFailed},
+		{http.MethodDelete, modtime.Add(-time.Hour), http.StatusPreconditionFailed},
+		{http.MethodPut, modtime, http.StatusOK},
+		{http.MethodDelete, modtime.Add(time.Hour), http.StatusOK},
+	}
+	for _, test := range tests {
+		setFile()
+		req := newRequest(test.method, "/file.txt", testKey, strings.NewReader("changed"))
+		req.Header.Set("If-Unmodified-Since", test.since.Format(http.TimeFormat))
+		resp := serve(fs, req)
+		if resp.StatusCode != test.status {
+			t.Errorf("%s unmodified since %v gave %d, want %d", test.method, test.since, resp.StatusCode, test.status)
+		}
+		if test.status == http.StatusPreconditionFailed && readSandboxFile(t, cfg, "file.txt") != "original" {
+			t.Errorf("%s changed the file despite failing the precondition", test.method)
+		}
+	}
+
+	// a missing file hasn't been modified
+	req := newRequest(http.MethodPut, "/new.txt", testKey, strings.NewReader("new"))
+	req.Header.Set("If-Unmodified-Since", modtime.Format(http.TimeFormat))
+	expectStatus(t, serve(fs, req), http.StatusOK)
+}
+
+func TestConfiguredPermissions(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.FilePerm = 0664
+	cfg.DirPerm = 0775
+	fs := newTestServer(t, cfg)
+
+	for _, method := range []string{http.MethodPut, http.MethodPost} {
+		resource := "/" + method + "/dir/file.txt"
+		expectStatus(t, do(fs, method, resource, testKey, "content"), http.StatusOK)
+		info, err := os.Stat(sandboxFile(cfg, resource))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0664 {
+			t.Errorf("%s created a file with mode %v, want 0664", method, info.Mode().Perm())
+		}
+		for _, dir := range []string{"/" + method, "/" + method + "/dir"} {
+			info, err := os.Stat(sandboxFile(cfg, dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0775 {
+				t.Errorf("%s created directory %s with mode %v, want 0775", method, dir, info.Mode().Perm())
+			}
+		}
+	}
+
+	if perms := (Config{}).perms(); perms.File != filePerm || perms.Dir != dirPerm {
+		t.Errorf("unset permissions are %+v, want the defaults", perms)
+	}
+}
+
+func TestSetgidDirectories(t *testing.T) {
+	cfg := testConfig(t)
+	if err := json.Unmarshal([]byte(`"2775"`), &cfg.DirPerm); err != nil {
+		t.Fatal(err)
+	}
+	fs := newTestServer(t, cfg)
+
+	expectStatus(t, do(fs, http.MethodPut, "/a/b/file.txt", testKey, "content"), http.StatusOK)
+	for _, dir := range []string{"", "a", "a/b"} {
+		info, err := os.Stat(sandboxFile(cfg, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode()&os.ModeSetgid == 0 || info.Mode().Perm() != 0775 {
+			t.Errorf("created directory '%s' with mode %v, want setgid and 0775", dir, info.Mode())
+		}
+	}
+	info, err := os.Stat(sandboxFile(cfg, "a/b/file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSetgid != 0 {
+		t.Errorf("created file with mode %v, want no setgid", info.Mode())
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	content := strings.Repeat("0123456789", 10000)
+	for _, key := range []string{"", "secret"} {
+		cfg := testConfig(t)
+		cfg.EncryptionKey = key
+		fs := newTestServer(t, cfg)
+		expectStatus(t, do(fs, http.MethodPut, "/file.bin", testKey, content), http.StatusOK)
+
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			resp := do(fs, method, "/file.bin", testKey, "")
+			expectStatus(t, resp, http.StatusOK)
+			if got := resp.Header.Get("Content-Length"); got != strconv.Itoa(len(content)) {
+				t.Errorf("encryption key %q: %s gave Content-Length %q, want %d", key, method, got, len(content))
+			}
+		}
+	}
+}
+
+func TestGetDirectory(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "dir/file.txt", "content")
+
+	resp := do(fs, http.MethodGet, "/dir", testKey, "")
+	expectStatus(t, resp, http.StatusBadRequest)
+	if body := readBody(t, resp); !strings.Contains(body, errIsDir.Error()) {
+		t.Errorf("GET of a directory gave %q", body)
+	}
+	expectJSONError(t, do(fs, http.MethodGet, "/missing", testKey, ""), http.StatusNotFound)
+}
+
+func TestDeleteDirectory(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	if err := os.MkdirAll(sandboxFile(cfg, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeSandboxFile(t, cfg, "full/dir/file.txt", "content")
+	writeSandboxFile(t, cfg, "outside.txt", "kept")
+
+	expectStatus(t, do(fs, http.MethodDelete, "/empty", testKey, ""), http.StatusOK)
+	if exists(sandboxFile(cfg, "empty")) {
+		t.Error("empty directory wasn't deleted")
+	}
+
+	expectJSONError(t, do(fs, http.MethodDelete, "/full", testKey, ""), http.StatusConflict)
+	if got := readSandboxFile(t, cfg, "full/dir/file.txt"); got != "content" {
+		t.Errorf("refused DELETE left %q", got)
+	}
+
+	expectStatus(t, do(fs, http.MethodDelete, "/full?recursive=true", testKey, ""), http.StatusOK)
+	if exists(sandboxFile(cfg, "full")) {
+		t.Error("recursive DELETE left the directory")
+	}
+	if got := readSandboxFile(t, cfg, "outside.txt"); got != "kept" {
+		t.Errorf("recursive DELETE removed a neighbour: %q", got)
+	}
+
+	// the sandbox itself can't be deleted
+	expectStatus(t, do(fs, http.MethodDelete, "/?recursive=true", testKey, ""), http.StatusBadRequest)
+	if !exists(sandboxFile(cfg, "outside.txt")) {
+		t.Error("DELETE of the root removed the sandbox")
+	}
+}
+
+func TestPublicDir(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.PublicDir = "public"
+	fs := newTestServer(t, cfg)
+	public := filepath.Join(cfg.FileRoot, "public")
+	os.MkdirAll(public, 0755)
+	os.WriteFile(filepath.Join(public, "asset.css"), []byte("body {}"), filePerm)
+	writeSandboxFile(t, cfg, "private.txt", "private")
+
+	resp := do(fs, http.MethodGet, "/asset.css", "", "")
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); body != "body {}" {
+		t.Errorf("anonymous GET gave %q", body)
+	}
+	expectStatus(t, do(fs, http.MethodHead, "/asset.css", "", ""), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodGet, "/private.txt", "", ""), http.StatusNotFound)
+
+	for _, method := range []string{http.MethodPut, http.MethodPost, http.MethodPatch, http.MethodDelete} {
+		expectStatus(t, do(fs, method, "/asset.css", "", "changed"), http.StatusUnauthorized)
+	}
+	if content, _ := os.ReadFile(filepath.Join(public, "asset.css")); string(content) != "body {}" {
+		t.Errorf("anonymous writes left %q", content)
+	}
+
+	// a wrong key isn't anonymous
+	expectStatus(t, do(fs, http.MethodGet, "/asset.css", "wrong-key", ""), http.StatusUnauthorized)
+	// and the public directory is sandboxed too
+	if resp := serve(fs, newRequest(http.MethodGet, "/../sandbox/private.txt", "", nil)); resp.StatusCode == http.StatusOK {
+		t.Error("anonymous GET escaped the public directory")
+	}
+	rec := httptest.NewRecorder()
+	req := newRequest(http.MethodGet, "/x", "", nil)
+	req.URL.Path = "/../sandbox/private.txt"
+	fs.reqHandler(rec, req)
+	if rec.Code == http.StatusOK {
+		t.Error("anonymous GET escaped the public directory")
+	}
+}
+
+func TestUnsupportedMethodAllow(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+
+	resp := do(fs, http.MethodTrace, "/file.txt", testKey, "")
+	expectJSONError(t, resp, http.StatusMethodNotAllowed)
+	allow := resp.Header.Get("Allow")
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions} {
+		if !strings.Contains(allow, method) {
+			t.Errorf("Allow %q doesn't list %s", allow, method)
+		}
+	}
+	if strings.Contains(allow, http.MethodTrace) {
+		t.Errorf("Allow %q lists TRACE", allow)
+	}
+}
+
+func TestExtensionRestrictions(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys[testKey] = keyConfig{Dir: "sandbox", Perms: permAll, AllowedExtensions: []string{".txt", "json", "CSV"}}
+	cfg.APIKeys["denying-key"] = keyConfig{Dir: "other", Perms: permAll, DeniedExtensions: []string{"exe"}}
+	fs := newTestServer(t, cfg)
+
+	for _, name := range []string{"a.txt", "b.JSON", "c.csv"} {
+		expectStatus(t, do(fs, http.MethodPut, "/"+name, testKey, "allowed"), http.StatusOK)
+		if got := readSandboxFile(t, cfg, name); got != "allowed" {
+			t.Errorf("%s has %q", name, got)
+		}
+	}
+	for _, name := range []string{"d.exe", "e", "f.txt.sh"} {
+		expectJSONError(t, do(fs, http.MethodPut, "/"+name, testKey, "denied"), http.StatusUnsupportedMediaType)
+		expectStatus(t, do(fs, http.MethodPost, "/"+name, testKey, "denied"), http.StatusUnsupportedMediaType)
+		if exists(sandboxFile(cfg, name)) {
+			t.Errorf("%s was written", name)
+		}
+	}
+	// reads aren't restricted
+	writeSandboxFile(t, cfg, "g.exe", "existing")
+	expectStatus(t, do(fs, http.MethodGet, "/g.exe", testKey, ""), http.StatusOK)
+
+	// nor is a key denying others
+	expectStatus(t, do(fs, http.MethodPut, "/h.bin", "denying-key", "allowed"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPut, "/i.EXE", "denying-key", "denied"), http.StatusUnsupportedMediaType)
+
+	// each part of a multipart upload is checked
+	req := multipartRequest(t, "/uploads/", map[string]string{"ok.txt": "allowed", "bad.exe": "denied"})
+	expectStatus(t, serve(fs, req), http.StatusUnsupportedMediaType)
+	if exists(sandboxFile(cfg, "uploads/bad.exe")) {
+		t.Error("multipart part with a denied extension was written")
+	}
+}
+
+// h2cClient speaks HTTP/2 without TLS, with prior knowledge.
+var h2cClient = &http.Client{Transport: &http2.Transport{
+	AllowHTTP: true,
+	DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+		return net.Dial(network, addr)
+	},
+}}
+
+func TestH2C(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.H2CEnabled = true
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+	server := httptest.NewServer(fs.server.Handler)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/file.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("", testKey)
+	resp, err := h2cClient.Do(req)
+	if err != nil {
+		t.Fatalf("h2c GET failed: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 || string(body) != "content" {
+		t.Errorf("h2c GET gave %d over %s with %q", resp.StatusCode, resp.Proto, body)
+	}
+}
+
+func TestH2CDisabled(t *testing.T) {
+	for _, change := range []func(*Config){
+		func(c *Config) { c.H2CEnabled = false },
+		func(c *Config) { c.H2CEnabled, c.HTTP2Enabled = true, false },
+	} {
+		cfg := testConfig(t)
+		change(&cfg)
+		fs := newTestServer(t, cfg)
+		server := httptest.NewServer(fs.server.Handler)
+		resp, err := h2cClient.Get(server.URL + "/")
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("h2c GET succeeded with %+v", cfg)
+		}
+		server.Close()
+	}
+
+	// nor is HTTP/2 offered over TLS when disabled
+	cfg := testConfig(t)
+	cfg.HTTP2Enabled = false
+	if fs := newTestServer(t, cfg); fs.server.TLSNextProto == nil || len(fs.server.TLSNextProto) != 0 {
+		t.Error("HTTP/2 configured over TLS while disabled")
+	}
+}
+
+func TestPathLimits(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxPathDepth = 3
+	cfg.MaxNameLength = 10
+	fs := newTestServer(t, cfg)
+
+	expectStatus(t, do(fs, http.MethodPut, "/a/b/c.txt", testKey, "deep enough"), http.StatusOK)
+	expectJSONError(t, do(fs, http.MethodPut, "/a/b/c/d.txt", testKey, "too deep"), http.StatusBadRequest)
+	expectStatus(t, do(fs, http.MethodPost, "/a/b/c/d.txt", testKey, "too deep"), http.StatusBadRequest)
+	if exists(sandboxFile(cfg, "a/b/c")) {
+		t.Error("too deep a path was written")
+	}
+
+	expectStatus(t, do(fs, http.MethodPut, "/0123456789", testKey, "long enough"), http.StatusOK)
+	expectJSONError(t, do(fs, http.MethodPut, "/0123456789a", testKey, "too long"), http.StatusBadRequest)
+	expectJSONError(t, do(fs, http.MethodPut, "/0123456789a/b.txt", testKey, "too long"), http.StatusBadRequest)
+	if exists(sandboxFile(cfg, "0123456789a")) {
+		t.Error("too long a name was written")
+	}
+
+	// depth is counted once the path is resolved
+	rec := httptest.NewRecorder()
+	req := newRequest(http.MethodPut, "/x", testKey, strings.NewReader("resolved"))
+	req.URL.Path = "/a/b/c/../../d.txt"
+	fs.reqHandler(rec, req)
+	if rec.Code != http.StatusOK || readSandboxFile(t, cfg, "a/d.txt") != "resolved" {
+		t.Errorf("resolved path within the limits gave %d", rec.Code)
+	}
+
+	// only writes are limited
+	writeSandboxFile(t, cfg, "w/x/y/z.txt", "existing")
+	expectStatus(t, do(fs, http.MethodGet, "/w/x/y/z.txt", testKey, ""), http.StatusOK)
+}
+
+func TestControlCharsRejected(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+
+	for _, target := range []string{"/file%00.txt", "/line%0Abreak.txt", "/dir%1B/file.txt", "/del%7F.txt"} {
+		expectJSONError(t, do(fs, http.MethodPut, target, testKey, "content"), http.StatusBadRequest)
+		expectStatus(t, do(fs, http.MethodGet, target, testKey, ""), http.StatusBadRequest)
+	}
+	req := newRequest(http.MethodPut, "/x", testKey, strings.NewReader("content"))
+	req.URL.Path = "/literal\nnewline.txt"
+	expectJSONError(t, serve(fs, req), http.StatusBadRequest)
+
+	entries, _ := os.ReadDir(sandboxFile(cfg, ""))
+	if len(entries) != 0 {
+		t.Errorf("paths with control characters wrote %d files", len(entries))
+	}
+	if log, _ := os.ReadFile(cfg.LogFile); strings.Contains(string(log), "literal\nnewline") {
+		t.Error("a newline in a path was written to the log")
+	}
+
+	// other unicode is fine
+	expectStatus(t, do(fs, http.MethodPut, "/caf%C3%A9.txt", testKey, "content"), http.StatusOK)
+}
+
+func TestDeleteIfMatch(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+	etag := do(fs, http.MethodGet, "/file.txt", testKey, "").Header.Get("ETag")
+
+	deleteIfMatch := func(match string) *http.Response {
+		req := newRequest(http.MethodDelete, "/file.txt", testKey, nil)
+		req.Header.Set("If-Match", match)
+		return serve(fs, req)
+	}
+	expectJSONError(t, deleteIfMatch(`"something-else"`), http.StatusPreconditionFailed)
+	if readSandboxFile(t, cfg, "file.txt") != "content" {
+		t.Fatal("mismatched If-Match deleted the file")
+	}
+	expectStatus(t, deleteIfMatch(`"something-else", `+etag), http.StatusOK)
+	if exists(sandboxFile(cfg, "file.txt")) {
+		t.Error("matching If-Match didn't delete the file")
+	}
+
+	// the gzip ETag matches too, and "*" matches any file
+	writeSandboxFile(t, cfg, "file.txt", "content")
+	etag = do(fs, http.MethodGet, "/file.txt", testKey, "").Header.Get("ETag")
+	expectStatus(t, deleteIfMatch(gzipETag(etag)), http.StatusOK)
+	expectJSONError(t, deleteIfMatch("*"), http.StatusPreconditionFailed)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+	expectStatus(t, deleteIfMatch("*"), http.StatusOK)
+}
+
+func TestEnsureSandboxes(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys["nested-key"] = keyConfig{Dir: "a/b", Perms: permRead}
+	cfg.PublicDir = "public"
+	vroot := t.TempDir()
+	cfg.VirtualHosts = map[string]virtualHost{
+		"files.example.com": {FileRoot: vroot, APIKeys: map[apikey]keyConfig{testKey: {Dir: "vsandbox", Perms: permAll}}},
+	}
+	dirs := []string{
+		filepath.Join(cfg.FileRoot, "sandbox"),
+		filepath.Join(cfg.FileRoot, "a", "b"),
+		filepath.Join(cfg.FileRoot, "public"),
+		filepath.Join(vroot, "vsandbox"),
+	}
+
+	newTestServer(t, cfg)
+	for _, dir := range dirs {
+		if exists(dir) {
+			t.Errorf("%s created without EnsureSandboxes", dir)
+		}
+	}
+
+	cfg.EnsureSandboxes = true
+	newTestServer(t, cfg)
+	for _, dir := range dirs {
+		if !isDir(localStorage{}, dir) {
+			t.Errorf("%s wasn't created", dir)
+		}
+	}
+
+	// a sandbox which can't be created fails construction
+	if err := os.WriteFile(filepath.Join(cfg.FileRoot, "blocker"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.APIKeys["blocked-key"] = keyConfig{Dir: "blocker/sub", Perms: permAll}
+	if _, err := NewHTTPFSServer(cfg); err == nil {
+		t.Error("server created with a sandbox which can't be")
+	}
+}
+
+func TestCaseCollisions(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.CaseSensitivePaths = false
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "Dir/File.txt", "original")
+
+	for _, target := range []string{"/Dir/file.txt", "/dir/File.txt", "/DIR/new.txt"} {
+		expectJSONError(t, do(fs, http.MethodPut, target, testKey, "collision"), http.StatusConflict)
+		expectStatus(t, do(fs, http.MethodPost, target, testKey, "collision"), http.StatusConflict)
+	}
+	entries, _ := os.ReadDir(sandboxFile(cfg, ""))
+	if len(entries) != 1 {
+		t.Errorf("colliding writes left %d entries in the sandbox", len(entries))
+	}
+	// the same path, and new names, are fine
+	expectStatus(t, do(fs, http.MethodPut, "/Dir/File.txt", testKey, "replaced"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPut, "/Dir/other.txt", testKey, "new"), http.StatusOK)
+	req := newRequest(methodMove, "/Dir/other.txt", testKey, nil)
+	req.Header.Set("Destination", "/Dir/FILE.TXT")
+	expectStatus(t, serve(fs, req), http.StatusConflict)
+
+	// case sensitive paths don't collide
+	cfg = testConfig(t)
+	fs = newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "File.txt", "original")
+	expectStatus(t, do(fs, http.MethodPut, "/file.txt", testKey, "different"), http.StatusOK)
+}
+
+func TestSlashesCollapsed(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+
+	expectStatus(t, do(fs, http.MethodPut, "//dir///file.txt", testKey, "content"), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "dir/file.txt"); got != "content" {
+		t.Errorf("PUT with redundant slashes stored %q", got)
+	}
+	resp := do(fs, http.MethodGet, "/dir//file.txt", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); body != "content" {
+		t.Errorf("GET with redundant slashes gave %q", body)
+	}
+
+	var seen string
+	h := collapseSlashes(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { seen = req.URL.Path }))
+	for path, want := range map[string]string{"//a//b/": "/a/b/", "/a": "/a", "///": "/"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+		if seen != want {
+			t.Errorf("%q collapsed to %q, want %q", path, seen, want)
+		}
+	}
+}
+
+func TestIfRange(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "0123456789")
+	path := sandboxFile(cfg, "file.txt")
+	modtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, modtime, modtime); err != nil {
+		t.Fatal(err)
+	}
+
+	first := do(fs, http.MethodGet, "/file.txt", testKey, "")
+	etag, lastModified := first.Header.Get("ETag"), first.Header.Get("Last-Modified")
+	if again := do(fs, http.MethodGet, "/file.txt", testKey, ""); again.Header.Get("ETag") != etag {
+		t.Fatalf("ETag changed from %q to %q between requests", etag, again.Header.Get("ETag"))
+	}
+
+	resume := func(ifRange string) *http.Response {
+		req := newRequest(http.MethodGet, "/file.txt", testKey, nil)
+		req.Header.Set("Range", "bytes=5-")
+		req.Header.Set("If-Range", ifRange)
+		req.Header.Set("Accept-Encoding", "gzip")
+		return serve(fs, req)
+	}
+	for _, validator := range []string{etag, lastModified} {
+		resp := resume(validator)
+		expectStatus(t, resp, http.StatusPartialContent)
+		if body := readBody(t, resp); body != "56789" {
+			t.Errorf("If-Range %s resumed with %q", validator, body)
+		}
+	}
+	for _, validator := range []string{`"something-else"`, modtime.Add(-time.Hour).UTC().Format(http.TimeFormat)} {
+		resp := resume(validator)
+		expectStatus(t, resp, http.StatusOK)
+		if body := readBody(t, resp); body != "0123456789" {
+			t.Errorf("mismatched If-Range %s gave %q", validator, body)
+		}
+	}
+
+	// once the file changes the old validators give the whole file
+	writeSandboxFile(t, cfg, "file.txt", "abcdefghij")
+	for _, validator := range []string{etag, lastModified} {
+		resp := resume(validator)
+		expectStatus(t, resp, http.StatusOK)
+		if body := readBody(t, resp); body != "abcdefghij" {
+			t.Errorf("If-Range %s of a changed file gave %q", validator, body)
+		}
+	}
+}
+
+func TestUserAgents(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RequireUserAgent = true
+	cfg.BlockedUserAgents = []string{"BadBot", "scanner/"}
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+
+	withAgent := func(method, agent string) *http.Response {
+		req := newRequest(method, "/file.txt", testKey, strings.NewReader("changed"))
+		req.Header.Set("User-Agent", agent)
+		return serve(fs, req)
+	}
+	expectJSONError(t, withAgent(http.MethodGet, ""), http.StatusBadRequest)
+	expectJSONError(t, withAgent(http.MethodPut, ""), http.StatusBadRequest)
+	expectJSONError(t, withAgent(http.MethodGet, "Mozilla/5.0 (compatible; badbot/2.1)"), http.StatusForbidden)
+	expectJSONError(t, withAgent(http.MethodPut, "Scanner/1.0"), http.StatusForbidden)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "content" {
+		t.Errorf("refused user agents left %q", got)
+	}
+
+	expectStatus(t, withAgent(http.MethodGet, "curl/7.68.0"), http.StatusOK)
+	if !strings.Contains(strings.Join(readLog(t, cfg), "\n"), `"curl/7.68.0"`) {
+		t.Error("user agent wasn't logged")
+	}
+
+	// without RequireUserAgent an empty user agent is fine
+	cfg.RequireUserAgent = false
+	fs = newTestServer(t, cfg)
+	expectStatus(t, withAgent(http.MethodGet, ""), http.StatusOK)
+}
+
+func TestExpectContinue(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys["limited"] = keyConfig{Dir: "limited", Perms: permAll, QuotaBytes: 10}
+	cfg.APIKeys["reader"] = keyConfig{Dir: "sandbox", Perms: permRead}
+	fs := newTestServer(t, cfg)
+	server := httptest.NewServer(fs.server.Handler)
+	defer server.Close()
+
+	// expect sends the headers of a PUT expecting 100-continue, giving the
+	// status line first replied before any of the body is sent
+	expect := func(target, key string, length int) (net.Conn, *bufio.Reader, string) {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := newRequest(http.MethodPut, target, key, nil)
+		conn.Write([]byte("PUT " + target + " HTTP/1.1\r\nHost: example.com\r\n" +
+			"Authorization: " + req.Header.Get("Authorization") + "\r\n" +
+			"Content-Length: " + strconv.Itoa(length) + "\r\nExpect: 100-continue\r\n\r\n"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("no reply before the body: %s", err)
+		}
+		return conn, r, strings.TrimSpace(line)
+	}
+
+	for _, test := range []struct {
+		target, key string
+		status      string
+	}{
+		{"/file.txt", "wrong-key", "401 Unauthorized"},
+		{"/file.txt", "reader", "403 Forbidden"},
+		{"/big.txt", "limited", "507 Insufficient Storage"},
+	} {
+		conn, _, line := expect(test.target, test.key, 1000)
+		conn.Close()
+		if line != "HTTP/1.1 "+test.status {
+			t.Errorf("PUT of %s with %s got %q before the body, want %s", test.target, test.key, line, test.status)
+		}
+	}
+	if exists(sandboxFile(cfg, "file.txt")) || exists(filepath.Join(cfg.FileRoot, "limited", "big.txt")) {
+		t.Error("rejected upload was written")
+	}
+
+	// an accepted upload is told to continue
+	conn, r, line := expect("/file.txt", testKey, len("content"))
+	defer conn.Close()
+	if line != "HTTP/1.1 100 Continue" {
+		t.Fatalf("accepted PUT got %q, want 100 Continue", line)
+	}
+	if blank, _ := r.ReadString('\n'); blank != "\r\n" {
+		t.Fatalf("100 Continue followed by %q", blank)
+	}
+	conn.Write([]byte("content"))
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, resp, http.StatusOK)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "content" {
+		t.Errorf("continued PUT stored %q", got)
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ServerHeader = "files/1.0"
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+
+	for _, resp := range []*http.Response{
+		do(fs, http.MethodGet, "/file.txt", testKey, ""),
+		do(fs, http.MethodGet, "/missing.txt", testKey, ""),
+		do(fs, http.MethodGet, "/file.txt", "wrong-key", ""),
+		do(fs, http.MethodGet, "/healthz", "", ""),
+	} {
+		if got := resp.Header.Get("Server"); got != "files/1.0" {
+			t.Errorf("%d response has Server %q", resp.StatusCode, got)
+		}
+	}
+
+	cfg.ServerHeader = ""
+	fs = newTestServer(t, cfg)
+	server := httptest.NewServer(fs.server.Handler)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if values, found := resp.Header["Server"]; found {
+		t.Errorf("Server header %q given while configured empty", values)
+	}
+}
+
+func TestPruneEmptyDirs(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "a/b/c/file.txt", "content")
+	writeSandboxFile(t, cfg, "x/keep.txt", "content")
+	writeSandboxFile(t, cfg, "x/y/file.txt", "content")
+
+	// without prune the parents are left
+	expectStatus(t, do(fs, http.MethodDelete, "/x/y/file.txt", testKey, ""), http.StatusOK)
+	if !exists(sandboxFile(cfg, "x/y")) {
+		t.Error("delete without prune removed the parent directory")
+	}
+
+	expectStatus(t, do(fs, http.MethodDelete, "/a/b/c/file.txt?prune=true", testKey, ""), http.StatusOK)
+	for _, dir := range []string{"a/b/c", "a/b", "a"} {
+		if exists(sandboxFile(cfg, dir)) {
+			t.Errorf("empty directory %s wasn't pruned", dir)
+		}
+	}
+	if !exists(sandboxFile(cfg, "")) {
+		t.Error("pruning removed the sandbox")
+	}
+
+	// pruning stops at directories which aren't empty
+	expectStatus(t, do(fs, http.MethodDelete, "/x/y?prune=true", testKey, ""), http.StatusOK)
+	if exists(sandboxFile(cfg, "x/y")) || !exists(sandboxFile(cfg, "x/keep.txt")) {
+		t.Error("pruning didn't stop at the first non-empty directory")
+	}
+
+	// or can be configured, and never removes the sandbox
+	cfg.PruneEmptyDirs = true
+	fs = newTestServer(t, cfg)
+	expectStatus(t, do(fs, http.MethodDelete, "/x/keep.txt", testKey, ""), http.StatusOK)
+	if exists(sandboxFile(cfg, "x")) {
+		t.Error("PruneEmptyDirs didn't prune the empty directory")
+	}
+	if !exists(sandboxFile(cfg, "")) {
+		t.Error("pruning the last directory removed the sandbox")
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxConnections = 2
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Address = ln.Addr().String()
+	ln.Close()
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "content")
+	go fs.ListenAndServe()
+	defer fs.Shutdown(context.Background())
+
+	dial := func() net.Conn {
+		t.Helper()
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			conn, err := net.Dial("tcp", cfg.Address)
+			if err == nil {
+				return conn
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("error connecting: %s", err)
+			}
+		}
+	}
+	send := func(conn net.Conn) *bufio.Reader {
+		t.Helper()
+		if err := newRequest(http.MethodGet, "/file.txt", testKey, nil).Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		return bufio.NewReader(conn)
+	}
+	receive := func(conn net.Conn, r *bufio.Reader, timeout time.Duration) (*http.Response, error) {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		return http.ReadResponse(r, nil)
+	}
+
+	// two kept alive connections use up the limit
+	idle := []net.Conn{dial(), dial()}
+	for _, conn := range idle {
+		defer conn.Close()
+		resp, err := receive(conn, send(conn), 5*time.Second)
+		if err != nil {
+			t.Fatalf("connection within the limit wasn't served: %s", err)
+		}
+		expectStatus(t, resp, http.StatusOK)
+	}
+
+	waiting := dial()
+	defer waiting.Close()
+	r := send(waiting)
+	if resp, err := receive(waiting, r, 300*time.Millisecond); err == nil {
+		t.Fatalf("connection over the limit was served with status %d", resp.StatusCode)
+	}
+
+	// once one closes, the waiting connection is accepted
+	idle[1].Close()
+	resp, err := receive(waiting, r, 5*time.Second)
+	if err != nil {
+		t.Fatalf("connection wasn't served after another closed: %s", err)
+	}
+	expectStatus(t, resp, http.StatusOK)
+}
+
+func TestRootResponse(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RootResponse = &rootResponse{Body: "<h1>files</h1>", ContentType: "text/html; charset=utf-8"}
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "secret.txt", "secret")
+
+	resp := do(fs, http.MethodGet, "/", "", "")
+	expectStatus(t, resp, http.StatusOK)
+	if ctype := resp.Header.Get("Content-Type"); ctype != "text/html; charset=utf-8" {
+		t.Errorf("got Content-Type %q", ctype)
+	}
+	if body := readBody(t, resp); body != "<h1>files</h1>" {
+		t.Errorf("got root response %q", body)
+	}
+
+	// keys still list their sandbox, and nothing at / may be changed
+	if names := entryNames(listing(t, fs, "/")); len(names) != 1 || names[0] != "secret.txt" {
+		t.Errorf("root with a key lists %v", names)
+	}
+	for _, method := range []string{http.MethodPut, http.MethodPost, http.MethodDelete} {
+		expectJSONError(t, do(fs, method, "/", "", "content"), http.StatusUnauthorized)
+		expectJSONError(t, do(fs, method, "/", testKey, "content"), http.StatusBadRequest)
+	}
+	expectJSONError(t, do(fs, http.MethodGet, "/secret.txt", "", ""), http.StatusUnauthorized)
+
+	cfg.RootResponse = &rootResponse{Redirect: "https://example.com/"}
+	fs = newTestServer(t, cfg)
+	resp = do(fs, http.MethodGet, "/", "", "")
+	expectStatus(t, resp, http.StatusFound)
+	if loc := resp.Header.Get("Location"); loc != "https://example.com/" {
+		t.Errorf("redirected to %q", loc)
+	}
+	if body := readBody(t, resp); strings.Contains(body, "secret") {
+		t.Errorf("root redirect exposes a file: %s", body)
+	}
+}
+
+func TestRejectEmptyUploads(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RejectEmptyUploads = true
+	fs := newTestServer(t, cfg)
+
+	chunked := func(method, target string, body io.Reader) *http.Request {
+		req := newRequest(method, target, testKey, body)
+		req.ContentLength = -1
+		return req
+	}
+	for _, method := range []string{http.MethodPut, http.MethodPost} {
+		expectJSONError(t, do(fs, method, "/empty.txt", testKey, ""), http.StatusBadRequest)
+		expectJSONError(t, serve(fs, chunked(method, "/empty.txt", strings.NewReader(""))), http.StatusBadRequest)
+		if exists(sandboxFile(cfg, "empty.txt")) {
+			t.Fatalf("empty %s was stored", method)
+		}
+
+		// the first byte read to check a body of unknown length is kept
+		resource := "/" + method + ".txt"
+		expectStatus(t, serve(fs, chunked(method, resource, strings.NewReader("content"))), http.StatusOK)
+		if got := readSandboxFile(t, cfg, resource); got != "content" {
+			t.Errorf("%s of unknown length stored %q", method, got)
+		}
+		expectStatus(t, do(fs, method, resource, testKey, "more"), http.StatusOK)
+	}
+
+	// empty uploads are fine without the flag
+	cfg.RejectEmptyUploads = false
+	fs = newTestServer(t, cfg)
+	expectStatus(t, do(fs, http.MethodPut, "/empty.txt", testKey, ""), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "empty.txt"); got != "" {
+		t.Errorf("empty upload stored %q", got)
+	}
+}
+
+func TestSymlinksRefused(t *testing.T) {
+	cfg := testConfig(t)
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), filePerm); err != nil {
+		t.Fatal(err)
+	}
+	writeSandboxFile(t, cfg, "site/file.txt", "content")
+	for link, target := range map[string]string{
+		"link.txt":        filepath.Join(outside, "secret.txt"),
+		"linkdir":         outside,
+		"site/index.html": filepath.Join(outside, "secret.txt"),
+	} {
+		if err := os.Symlink(target, sandboxFile(cfg, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := newTestServer(t, cfg)
+
+	for _, target := range []string{"/link.txt", "/linkdir/secret.txt", "/linkdir/", "/site/"} {
+		expectJSONError(t, do(fs, http.MethodGet, target, testKey, ""), http.StatusForbidden)
+	}
+	expectJSONError(t, do(fs, http.MethodPut, "/link.txt", testKey, "overwritten"), http.StatusForbidden)
+	expectJSONError(t, do(fs, http.MethodPut, "/linkdir/new.txt", testKey, "escaped"), http.StatusForbidden)
+	expectJSONError(t, do(fs, http.MethodDelete, "/linkdir/secret.txt", testKey, ""), http.StatusForbidden)
+	req := newRequest(methodMove, "/site/file.txt", testKey, nil)
+	req.Header.Set("Destination", "/linkdir/moved.txt")
+	expectJSONError(t, serve(fs, req), http.StatusForbidden)
+
+	if data, err := os.ReadFile(filepath.Join(outside, "secret.txt")); err != nil || string(data) != "secret" {
+		t.Errorf("file outside the sandbox has %q, %v", data, err)
+	}
+	for _, name := range []string{"new.txt", "moved.txt"} {
+		if exists(filepath.Join(outside, name)) {
+			t.Errorf("%s was written outside the sandbox", name)
+		}
+	}
+
+	// followed when configured
+	cfg.FollowSymlinks = true
+	fs = newTestServer(t, cfg)
+	for _, target := range []string{"/link.txt", "/linkdir/secret.txt", "/site/"} {
+		resp := do(fs, http.MethodGet, target, testKey, "")
+		expectStatus(t, resp, http.StatusOK)
+		if body := readBody(t, resp); body != "secret" {
+			t.Errorf("%s gave %q through the followed symlink", target, body)
+		}
+	}
+}
+
+func TestMaxUploadBytes(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxUploadBytes = 10
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "original")
+
+	expectJSONError(t, do(fs, http.MethodPut, "/file.txt", testKey, "01234567890"), http.StatusRequestEntityTooLarge)
+	chunked := newRequest(http.MethodPut, "/file.txt", testKey, strings.NewReader("01234567890"))
+	chunked.ContentLength = -1
+	expectJSONError(t, serve(fs, chunked), http.StatusRequestEntityTooLarge)
+	expectJSONError(t, do(fs, http.MethodPost, "/new.txt", testKey, "01234567890"), http.StatusRequestEntityTooLarge)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "original" {
+		t.Errorf("uploads over the limit left %q", got)
+	}
+	if exists(sandboxFile(cfg, "new.txt")) {
+		t.Error("upload over the limit created a file")
+	}
+
+	expectStatus(t, do(fs, http.MethodPut, "/file.txt", testKey, "0123456789"), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "0123456789" {
+		t.Errorf("upload at the limit stored %q", got)
+	}
+
+	// 0 is unlimited
+	cfg.MaxUploadBytes = 0
+	fs = newTestServer(t, cfg)
+	expectStatus(t, do(fs, http.MethodPut, "/file.txt", testKey, strings.Repeat("x", 1000)), http.StatusOK)
+
+	if max := DefaultConfig().MaxUploadBytes; max != 100*mebibyte {
+		t.Errorf("default MaxUploadBytes is %d, want 100 MiB", max)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// prefix of paths used to request signed urls
+const signPrefix = "/_sign/"
+
+// lifetime of signed urls when not requested
+const defaultSignedTTL = time.Hour
+
+// signature computes the HMAC-SHA256, with secret, of a request using method
+// on the resource path with the query, which holds the expiry, and the
+// Destination header dest. The query's "sig" is left out.
+func signature(secret, method, path string, query url.Values, dest string) string {
+	signed := url.Values{}
+	for name, values := range query {
+		if name != "sig" {
+			signed[name] = values
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + path + "\n" + signed.Encode() + "\n" + dest))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// findSignedKey gets the api key, and its settings, whose signing secret
+// signed the request's url, query and Destination header. The url must not
+// have expired.
+func (s Config) findSignedKey(req *http.Request) (apikey, keyConfig, bool) {
+	query := req.URL.Query()
+	sig, err := hex.DecodeString(query.Get("sig"))
+	if err != nil || len(sig) == 0 {
+		return "", keyConfig{}, false
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", keyConfig{}, false
+	}
+
+	for stored, keycfg := range s.APIKeys {
+		if keycfg.SigningSecret == "" {
+			continue
+		}
+		want, _ := hex.DecodeString(signature(keycfg.SigningSecret, req.Method, req.URL.Path, query, req.Header.Get("Destination")))
+		if hmac.Equal(sig, want) {
+			return stored, keycfg, true
+		}
+	}
+	return "", keyConfig{}, false
+}
+
+// signedURL is the reply to a request for a signed url.
+type signedURL struct {
+	URL     string `json:"url"`
+	Expires int64  `json:"expires"`
+}
+
+// signHandler replies with a url for the path following signPrefix, signed
+// with the secret of the request's api key. The query may give the "method"
+// the url is for, GET by default, its "ttl" in seconds and the "destination"
+// of a MOVE or COPY. Any other parameters are kept in the url and signed
+// along with it.
+func (fs *httpfsServer) signHandler(w http.ResponseWriter, req *http.Request) {
+	settings := fs.configFor(req)
+
+	w.Header().Add("Cache-Control", "no-cache")
+
+	_, key, _ := req.BasicAuth()
+	_, keycfg, found := settings.findKey(key)
+	if !found {
+		writeJSONError(w, http.StatusUnauthorized, "unrecognized api key")
+		return
+	}
+	if keycfg.SigningSecret == "" {
+		writeJSONError(w, http.StatusForbidden, "api key has no signing secret")
+		return
+	}
+
+	query := req.URL.Query()
+	method := strings.ToUpper(query.Get("method"))
+	if method == "" {
+		method = http.MethodGet
+	}
+	need, known := methodPerms[method]
+	if !known {
+		writeJSONError(w, http.StatusBadRequest, "unsupported method")
+		return
+	}
+	if !keycfg.Perms.Has(need) {
+		writeJSONError(w, http.StatusForbidden, "operation not permitted")
+		return
+	}
+
+	ttl := defaultSignedTTL
+	if str := query.Get("ttl"); str != "" {
+		seconds, err := strconv.Atoi(str)
+		if err != nil || seconds <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid ttl")
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	dest := query.Get("destination")
+	if dest != "" && method != methodMove && method != methodCopy {
+		writeJSONError(w, http.StatusBadRequest, "destination is only for MOVE and COPY")
+		return
+	}
+
+	signedQuery := url.Values{}
+	for name, values := range query {
+		switch name {
+		case "method", "ttl", "destination", "sig":
+		default:
+			signedQuery[name] = values
+		}
+	}
+	path := "/" + strings.TrimPrefix(req.URL.Path, signPrefix)
+	expires := time.Now().Add(ttl).Unix()
+	signedQuery.Set("expires", strconv.FormatInt(expires, 10))
+	signedQuery.Set("sig", signature(keycfg.SigningSecret, method, path, signedQuery, dest))
+	signed := url.URL{Path: path, RawQuery: signedQuery.Encode()}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(signedURL{URL: signed.String(), Expires: expires})
+}
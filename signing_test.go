@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// signedTarget gives the path of resource with a query signing it for the
+// method until expires.
+func signedTarget(secret, method, resource string, expires time.Time) string {
+	query := url.Values{"expires": {strconv.FormatInt(expires.Unix(), 10)}}
+	query.Set("sig", signature(secret, method, resource, query, ""))
+	return resource + "?" + query.Encode()
+}
+
+// signURL gets a url signed by key from fs's signHandler for the query.
+func signURL(t *testing.T, fs *httpfsServer, key, resource, query string) string {
+	t.Helper()
+	resp := do(fs, http.MethodGet, signPrefix+resource[1:]+"?"+query, key, "")
+	expectStatus(t, resp, http.StatusOK)
+	var signed signedURL
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		t.Fatal(err)
+	}
+	return signed.URL
+}
+
+func TestSignedURLs(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys[testKey] = keyConfig{Dir: "sandbox", Perms: permAll, SigningSecret: "signing"}
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "shared")
+	writeSandboxFile(t, cfg, "other.txt", "private")
+	later := time.Now().Add(time.Hour)
+
+	resp := do(fs, http.MethodGet, signedTarget("signing", http.MethodGet, "/file.txt", later), "", "")
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); body != "shared" {
+		t.Errorf("signed GET gave %q", body)
+	}
+
+	tests := map[string]string{
+		"expired":       signedTarget("signing", http.MethodGet, "/file.txt", time.Now().Add(-time.Minute)),
+		"tampered path": "/other.txt" + signedTarget("signing", http.MethodGet, "/file.txt", later)[len("/file.txt"):],
+		"wrong secret":  signedTarget("other", http.MethodGet, "/file.txt", later),
+		"no signature":  "/file.txt?expires=" + strconv.FormatInt(later.Unix(), 10),
+	}
+	for name, target := range tests {
+		if resp := do(fs, http.MethodGet, target, "", ""); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s url gave %d, want 401", name, resp.StatusCode)
+		}
+	}
+	// signed for GET only
+	expectStatus(t, do(fs, http.MethodPut, signedTarget("signing", http.MethodGet, "/file.txt", later), "", "changed"), http.StatusUnauthorized)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "shared" {
+		t.Errorf("file has %q after a PUT signed for GET", got)
+	}
+}
+
+func TestSignHandler(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys[testKey] = keyConfig{Dir: "sandbox", Perms: permAll, SigningSecret: "signing"}
+	cfg.APIKeys["no-secret"] = keyConfig{Dir: "sandbox", Perms: permAll}
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "shared")
+
+	resp := do(fs, http.MethodGet, signPrefix+"file.txt?ttl=60", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	var signed signedURL
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(time.Unix(signed.Expires, 0)); until <= 0 || until > time.Minute {
+		t.Errorf("url expires in %v, want a minute", until)
+	}
+	resp = do(fs, http.MethodGet, signed.URL, "", "")
+	expectStatus(t, resp, http.StatusOK)
+	if body := readBody(t, resp); body != "shared" {
+		t.Errorf("GET of the signed url gave %q", body)
+	}
+
+	expectStatus(t, do(fs, http.MethodGet, signPrefix+"file.txt", "no-secret", ""), http.StatusForbidden)
+	expectStatus(t, do(fs, http.MethodGet, signPrefix+"file.txt", "wrong-key", ""), http.StatusUnauthorized)
+}
+
+func TestSignedQueryAndDestination(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.APIKeys[testKey] = keyConfig{Dir: "sandbox", Perms: permAll, SigningSecret: "signing"}
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "shared")
+	writeSandboxFile(t, cfg, "dir/inner.txt", "inner")
+
+	move := func(target, dest string) *http.Response {
+		req := newRequest(methodMove, target, "", nil)
+		req.Header.Set("Destination", dest)
+		return serve(fs, req)
+	}
+	moveURL := signURL(t, fs, testKey, "/file.txt", "method=MOVE&destination=/moved.txt")
+	expectStatus(t, move(moveURL, "/elsewhere.txt"), http.StatusUnauthorized)
+	expectStatus(t, serve(fs, newRequest(methodMove, moveURL, "", nil)), http.StatusUnauthorized)
+	if exists(sandboxFile(cfg, "elsewhere.txt")) || !exists(sandboxFile(cfg, "file.txt")) {
+		t.Error("file moved to a destination that wasn't signed")
+	}
+	if resp := move(moveURL, "/moved.txt"); resp.StatusCode >= 300 {
+		t.Errorf("signed MOVE gave %d", resp.StatusCode)
+	}
+	if got := readSandboxFile(t, cfg, "moved.txt"); got != "shared" {
+		t.Errorf("moved file has %q", got)
+	}
+
+	deleteURL := signURL(t, fs, testKey, "/dir", "method=DELETE")
+	expectStatus(t, do(fs, http.MethodDelete, deleteURL+"&recursive=true", "", ""), http.StatusUnauthorized)
+	if !exists(sandboxFile(cfg, "dir/inner.txt")) {
+		t.Error("directory deleted with a query that wasn't signed")
+	}
+	deleteURL = signURL(t, fs, testKey, "/dir", "method=DELETE&recursive=true")
+	if resp := do(fs, http.MethodDelete, deleteURL, "", ""); resp.StatusCode >= 300 {
+		t.Errorf("signed recursive DELETE gave %d", resp.StatusCode)
+	}
+
+	expectStatus(t, do(fs, http.MethodGet, signPrefix+"file.txt?destination=/x.txt", testKey, ""), http.StatusBadRequest)
+}
+
+func TestSignedURLsShareKeyLimits(t *testing.T) {
+	hashed, err := hashAPIKey("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t)
+	cfg.APIKeys = map[apikey]keyConfig{hashed: {Dir: "sandbox", Perms: permAll, SigningSecret: "signing"}}
+	cfg.RateLimitPerSecond = 0.001
+	cfg.RateLimitBurst = 2
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "shared")
+	target := signedTarget("signing", http.MethodGet, "/file.txt", time.Now().Add(time.Hour))
+
+	expectStatus(t, do(fs, http.MethodGet, "/file.txt", "secret", ""), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodGet, target, "", ""), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodGet, target, "", ""), http.StatusTooManyRequests)
+	expectStatus(t, do(fs, http.MethodGet, "/file.txt", "secret", ""), http.StatusTooManyRequests)
+
+	if times := fs.access.Snapshot(); len(times) != 1 {
+		t.Errorf("access times are kept for %d keys, want the one configured", len(times))
+	}
+}
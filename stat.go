@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// fileStat is the metadata of a file given by GET ?stat=1.
+type fileStat struct {
+	Size    int64     `json:"size"` // of the plaintext if encrypted
+	ModTime time.Time `json:"modtime"`
+	Mode    fileMode  `json:"mode"`
+	IsDir   bool      `json:"dir"`
+	SHA256  string    `json:"sha256,omitempty"` // hex, only if requested
+}
+
+// statFile writes the metadata of the file at path into w as JSON. The
+// SHA-256 of the file's content is included if withHash is true.
+func statFile(store Storage, path string, w http.ResponseWriter, aead cipher.AEAD, withHash bool) error {
+	file, err := store.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening file '%s': %w", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error stating file '%s': %w", path, err)
+	}
+	stat := fileStat{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC(),
+		Mode:    fileMode(info.Mode().Perm()),
+		IsDir:   info.IsDir(),
+	}
+
+	if !info.IsDir() {
+		content, size, err := plaintext(file, aead)
+		if err != nil {
+			return fmt.Errorf("error decrypting file '%s': %w", path, err)
+		}
+		stat.Size = size
+		if withHash {
+			h := sha256.New()
+			if _, err := io.Copy(h, content); err != nil {
+				return fmt.Errorf("error hashing file '%s': %w", path, err)
+			}
+			stat.SHA256 = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stat); err != nil {
+		return fmt.Errorf("error writing metadata of '%s': %w", path, err)
+	}
+	return nil
+}
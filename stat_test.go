@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// getStat GETs the metadata of the file at target.
+func getStat(t *testing.T, fs *httpfsServer, target string) fileStat {
+	t.Helper()
+	resp := do(fs, http.MethodGet, target, testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	if ctype := resp.Header.Get("Content-Type"); ctype != "application/json" {
+		t.Errorf("metadata has Content-Type %q", ctype)
+	}
+	var stat fileStat
+	if err := json.NewDecoder(resp.Body).Decode(&stat); err != nil {
+		t.Fatalf("metadata isn't JSON: %s", err)
+	}
+	return stat
+}
+
+func TestStat(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "dir/file.txt", "known content")
+	path := sandboxFile(cfg, "dir/file.txt")
+	modtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(path, modtime, modtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	stat := getStat(t, fs, "/dir/file.txt?stat=1")
+	if stat.Size != int64(len("known content")) {
+		t.Errorf("size is %d", stat.Size)
+	}
+	if !stat.ModTime.Equal(modtime) {
+		t.Errorf("modtime is %s, want %s", stat.ModTime, modtime)
+	}
+	if stat.Mode != 0640 {
+		t.Errorf("mode is %o", stat.Mode)
+	}
+	if stat.IsDir || stat.SHA256 != "" {
+		t.Errorf("got %+v for a file without the hash requested", stat)
+	}
+
+	sum := sha256.Sum256([]byte("known content"))
+	if stat := getStat(t, fs, "/dir/file.txt?stat=1&sha256=1"); stat.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("sha256 is %q", stat.SHA256)
+	}
+	if stat := getStat(t, fs, "/dir/?stat=1"); !stat.IsDir {
+		t.Errorf("directory has %+v", stat)
+	}
+
+	expectJSONError(t, do(fs, http.MethodGet, "/missing.txt?stat=1", testKey, ""), http.StatusNotFound)
+
+	if err := os.WriteFile(filepath.Join(cfg.FileRoot, "outside.txt"), []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	req := newRequest(http.MethodGet, "/x?stat=1", testKey, nil)
+	req.URL.Path = "/../outside.txt"
+	fs.reqHandler(rec, req)
+	if rec.Code == http.StatusOK {
+		t.Error("stat escaped the sandbox")
+	}
+}
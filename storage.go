@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File is a file opened from a Storage.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// Storage holds the files being served. Paths are host paths within
+// FileRoot, as given by sandboxPath.
+type Storage interface {
+	// Open opens the file at path for reading.
+	Open(path string) (File, error)
+
+	// Create opens the file at path for writing, with flag such as
+	// os.O_APPEND or os.O_EXCL, creating it and any missing directories
+	// with perms.
+	Create(path string, flag int, perms filePerms) (File, error)
+
+	// MakeDirs creates the directory at path and any missing parents with
+	// perms.
+	MakeDirs(path string, perms filePerms) error
+
+	// Rename moves the file or directory at oldpath to newpath, replacing
+	// any file there.
+	Rename(oldpath, newpath string) error
+
+	// Remove deletes the file or empty directory at path.
+	Remove(path string) error
+
+	// Chtimes sets the access and modification times of the file at path.
+	Chtimes(path string, atime, mtime time.Time) error
+
+	// Stat describes the file or directory at path, following symlinks.
+	Stat(path string) (os.FileInfo, error)
+
+	// Lstat describes the file or directory at path, or the symlink itself
+	// if it is one. Storage without symlinks may describe path as Stat does.
+	Lstat(path string) (os.FileInfo, error)
+
+	// ReadDir lists the entries of the directory at path, sorted by name.
+	ReadDir(path string) ([]os.DirEntry, error)
+}
+
+// localStorage keeps files in the local filesystem.
+type localStorage struct{}
+
+func (localStorage) Open(path string) (File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (localStorage) Create(path string, flag int, perms filePerms) (File, error) {
+	if err := makeDirs(filepath.Dir(path), perms); err != nil {
+		return nil, err
+	}
+	file, err := openFile(path, flag|os.O_WRONLY, perms)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (localStorage) MakeDirs(path string, perms filePerms) error {
+	return makeDirs(path, perms)
+}
+
+func (localStorage) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (localStorage) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (localStorage) Chtimes(path string, atime, mtime time.Time) error {
+	return os.Chtimes(path, atime, mtime)
+}
+
+func (localStorage) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (localStorage) Lstat(path string) (os.FileInfo, error) {
+	return os.Lstat(path)
+}
+
+func (localStorage) ReadDir(path string) ([]os.DirEntry, error) {
+	return os.ReadDir(path)
+}
+
+// removeAll deletes the file or directory at path and everything within it.
+func removeAll(store Storage, path string) error {
+	entries, err := store.ReadDir(path)
+	if err == nil {
+		for _, e := range entries {
+			if err := removeAll(store, filepath.Join(path, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return store.Remove(path)
+}
+
+// tempPath gives a path for a temporary file beside path, hidden by a
+// leading '.'.
+func tempPath(path string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp-"+hex.EncodeToString(b)), nil
+}
+
+// contextReader reads from Reader until ctx is done, after which reads fail
+// with the context's error.
+type contextReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+// copyContext copies from src to dst like io.Copy, but stops early with the
+// context's error once ctx is done, such as when a client disconnects. A
+// buffer of bufSize bytes is used, or io.Copy's if bufSize is 0.
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader, bufSize int) (int64, error) {
+	if bufSize <= 0 {
+		return io.Copy(dst, contextReader{ctx, src})
+	}
+	// hide any ReadFrom of dst, which would use its own buffer
+	return io.CopyBuffer(struct{ io.Writer }{dst}, contextReader{ctx, src}, make([]byte, bufSize))
+}
+
+// contentReader gives content for http.ServeContent which stops being read
+// once ctx is done. The content is read bufSize bytes at a time if bufSize
+// isn't 0, rather than in the size of the reads made by ServeContent.
+func contentReader(ctx context.Context, content io.ReadSeeker, bufSize int) io.ReadSeeker {
+	if bufSize <= 0 {
+		return struct {
+			io.Reader
+			io.Seeker
+		}{contextReader{ctx, content}, content}
+	}
+	return &bufferedReader{ctx: ctx, src: content, buf: make([]byte, bufSize)}
+}
+
+// bufferedReader reads from src into buf, a whole buffer at a time, until
+// ctx is done. Seeking discards what is buffered.
+type bufferedReader struct {
+	ctx       context.Context
+	src       io.ReadSeeker
+	buf       []byte
+	next, end int // unread part of buf
+	err       error
+}
+
+func (r *bufferedReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if r.next == r.end {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.next = 0
+		r.end, r.err = r.src.Read(r.buf)
+		if r.end == 0 {
+			return 0, r.err
+		}
+	}
+	n := copy(p, r.buf[r.next:r.end])
+	r.next += n
+	return n, nil
+}
+
+func (r *bufferedReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent {
+		offset -= int64(r.end - r.next)
+	}
+	r.next, r.end, r.err = 0, 0, nil
+	return r.src.Seek(offset, whence)
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// memStorage keeps files in memory, so the handler can be tested without
+// touching disk.
+type memStorage struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode // path -> file or directory
+}
+
+// memNode is a file or directory in a memStorage.
+type memNode struct {
+	data    []byte
+	mode    os.FileMode
+	modtime time.Time
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{nodes: map[string]*memNode{
+		string(filepath.Separator): {mode: os.ModeDir | dirPerm, modtime: time.Now()},
+	}}
+}
+
+func (m *memStorage) Open(path string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, found := m.nodes[path]
+	if !found {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return &memFile{store: m, path: path, node: node}, nil
+}
+
+func (m *memStorage) Create(path string, flag int, perms filePerms) (File, error) {
+	if err := m.MakeDirs(filepath.Dir(path), perms); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, found := m.nodes[path]
+	switch {
+	case found && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrExist}
+	case found && node.mode.IsDir():
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EISDIR}
+	case !found:
+		node = &memNode{mode: perms.File, modtime: time.Now()}
+		m.nodes[path] = node
+	}
+	if flag&os.O_TRUNC != 0 {
+		node.data = nil
+	}
+	return &memFile{store: m, path: path, node: node, append: flag&os.O_APPEND != 0}, nil
+}
+
+func (m *memStorage) MakeDirs(path string, perms filePerms) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if node, found := m.nodes[dir]; found {
+			if !node.mode.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+			}
+			break
+		}
+		m.nodes[dir] = &memNode{mode: os.ModeDir | perms.Dir, modtime: time.Now()}
+	}
+	return nil
+}
+
+func (m *memStorage) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.nodes[oldpath]; !found {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	prefix := oldpath + string(filepath.Separator)
+	for path, node := range m.nodes {
+		if path == oldpath {
+			m.nodes[newpath] = node
+			delete(m.nodes, path)
+		} else if strings.HasPrefix(path, prefix) {
+			m.nodes[newpath+path[len(oldpath):]] = node
+			delete(m.nodes, path)
+		}
+	}
+	return nil
+}
+
+func (m *memStorage) Remove(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.nodes[path]; !found {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	if len(m.children(path)) > 0 {
+		return &os.PathError{Op: "remove", Path: path, Err: syscall.ENOTEMPTY}
+	}
+	delete(m.nodes, path)
+	return nil
+}
+
+func (m *memStorage) Chtimes(path string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, found := m.nodes[path]
+	if !found {
+		return &os.PathError{Op: "chtimes", Path: path, Err: os.ErrNotExist}
+	}
+	node.modtime = mtime
+	return nil
+}
+
+func (m *memStorage) Stat(path string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, found := m.nodes[path]
+	if !found {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	return node.info(path), nil
+}
+
+// Lstat is Stat, there being no symlinks in memory.
+func (m *memStorage) Lstat(path string) (os.FileInfo, error) {
+	return m.Stat(path)
+}
+
+func (m *memStorage) ReadDir(path string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, found := m.nodes[path]
+	if !found {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: os.ErrNotExist}
+	}
+	if !node.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: syscall.ENOTDIR}
+	}
+	children := m.children(path)
+	sort.Strings(children)
+	entries := make([]os.DirEntry, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, m.nodes[child].info(child))
+	}
+	return entries, nil
+}
+
+// children gives the paths directly within the directory at path. m.mu must
+// be held.
+func (m *memStorage) children(path string) []string {
+	var paths []string
+	for p := range m.nodes {
+		if p != path && filepath.Dir(p) == path {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// contents gives the content of the file at path, or false if there is none.
+func (m *memStorage) contents(path string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, found := m.nodes[path]
+	if !found || node.mode.IsDir() {
+		return "", false
+	}
+	return string(node.data), true
+}
+
+func (n *memNode) info(path string) memInfo {
+	return memInfo{name: filepath.Base(path), size: int64(len(n.data)), mode: n.mode, modtime: n.modtime}
+}
+
+// memInfo describes a memNode, as both an os.FileInfo and os.DirEntry.
+type memInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modtime time.Time
+}
+
+func (i memInfo) Name() string               { return i.name }
+func (i memInfo) Size() int64                { return i.size }
+func (i memInfo) Mode() os.FileMode          { return i.mode }
+func (i memInfo) ModTime() time.Time         { return i.modtime }
+func (i memInfo) IsDir() bool                { return i.mode.IsDir() }
+func (i memInfo) Sys() interface{}           { return nil }
+func (i memInfo) Type() os.FileMode          { return i.mode.Type() }
+func (i memInfo) Info() (os.FileInfo, error) { return i, nil }
+
+// memFile is an open memNode.
+type memFile struct {
+	store  *memStorage
+	path   string
+	node   *memNode
+	offset int64
+	append bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.store.mu.Lock()
+	defer f.store.mu.Unlock()
+	if f.node.mode.IsDir() {
+		return 0, &os.PathError{Op: "read", Path: f.path, Err: syscall.EISDIR}
+	}
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.store.mu.Lock()
+	defer f.store.mu.Unlock()
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+	if end := f.offset + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset += int64(len(p))
+	f.node.modtime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.store.mu.Lock()
+	defer f.store.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.store.mu.Lock()
+	defer f.store.mu.Unlock()
+	if size < int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modtime = time.Now()
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.store.mu.Lock()
+	defer f.store.mu.Unlock()
+	return f.node.info(f.path), nil
+}
+
+func (f *memFile) Close() error { return nil }
+
+func TestMemoryStorage(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.TrashEnabled = true
+	cfg.APIKeys[testKey] = keyConfig{Dir: "sandbox", Perms: permAll, QuotaBytes: 100}
+	store := newMemStorage()
+	fs, err := newServer(cfg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := func(resource string) (string, bool) {
+		return store.contents(sandboxFile(cfg, resource))
+	}
+
+	expectStatus(t, do(fs, http.MethodPut, "/dir/file.txt", testKey, "content"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPost, "/dir/file.txt", testKey, " appended"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPatch, "/dir/file.txt?offset=0", testKey, "C"), http.StatusOK)
+	if got, _ := stored("dir/file.txt"); got != "Content appended" {
+		t.Errorf("writes stored %q", got)
+	}
+	resp := do(fs, http.MethodGet, "/dir/file.txt", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	if got := readBody(t, resp); got != "Content appended" {
+		t.Errorf("GET gave %q", got)
+	}
+	if got := resp.Header.Get("X-Storage-Used"); got != "16" {
+		t.Errorf("usage from memory is %q", got)
+	}
+	if names := entryNames(listing(t, fs, "/dir/")); len(names) != 1 || names[0] != "file.txt" {
+		t.Errorf("listing from memory gave %v", names)
+	}
+
+	// conditional requests stat the stored file
+	req := newRequest(http.MethodDelete, "/dir/file.txt", testKey, nil)
+	req.Header.Set("If-Match", `"something-else"`)
+	expectStatus(t, serve(fs, req), http.StatusPreconditionFailed)
+	req = newRequest(http.MethodPut, "/dir/file.txt", testKey, strings.NewReader("changed"))
+	req.Header.Set("If-Unmodified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	expectStatus(t, serve(fs, req), http.StatusPreconditionFailed)
+
+	req = newRequest(methodCopy, "/dir/file.txt", testKey, nil)
+	req.Header.Set("Destination", "/copy.txt")
+	expectStatus(t, serve(fs, req), http.StatusOK)
+	req = newRequest(methodMove, "/copy.txt", testKey, nil)
+	req.Header.Set("Destination", "/moved/copy.txt")
+	expectStatus(t, serve(fs, req), http.StatusOK)
+	if got, _ := stored("moved/copy.txt"); got != "Content appended" {
+		t.Errorf("copy and move stored %q", got)
+	}
+	if _, found := stored("copy.txt"); found {
+		t.Error("moved file left behind")
+	}
+
+	modtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	req = newRequest(http.MethodPut, "/dated.txt", testKey, strings.NewReader("dated"))
+	req.Header.Set("X-Modified-Time", modtime.Format(time.RFC3339))
+	expectStatus(t, serve(fs, req), http.StatusOK)
+	if info, err := store.Stat(sandboxFile(cfg, "dated.txt")); err != nil || !info.ModTime().Equal(modtime) {
+		t.Errorf("modification time wasn't set in memory: %v", err)
+	}
+
+	id := startTestUpload(t, fs, "/upload.txt")
+	expectStatus(t, do(fs, http.MethodPatch, "/upload.txt?upload="+id+"&offset=0", testKey, "uploaded"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPost, "/upload.txt?upload=finish&id="+id, testKey, ""), http.StatusOK)
+	if got, _ := stored("upload.txt"); got != "uploaded" {
+		t.Errorf("upload session stored %q", got)
+	}
+
+	doPropfind(t, fs, "/dir/", "1")
+
+	// deleting moves to the trash in memory, still counted toward the quota
+	expectStatus(t, do(fs, http.MethodDelete, "/dir?recursive=true", testKey, ""), http.StatusOK)
+	if _, found := stored("dir/file.txt"); found {
+		t.Error("deleted file still stored")
+	}
+	entries, err := store.ReadDir(sandboxFile(cfg, trashDir))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("trash in memory has %d entries: %v", len(entries), err)
+	}
+	if used, _ := fs.usage.Used(sandboxFile(cfg, "")); used != 16+16+5+8 {
+		t.Errorf("usage is %d", used)
+	}
+	fs.settings.TrashRetentionHours = 1
+	store.Rename(filepath.Join(sandboxFile(cfg, trashDir), entries[0].Name()),
+		filepath.Join(sandboxFile(cfg, trashDir), time.Now().Add(-2*time.Hour).UTC().Format(trashStampFormat)))
+	fs.purgeOldTrash()
+	if entries, _ := store.ReadDir(sandboxFile(cfg, trashDir)); len(entries) != 0 {
+		t.Errorf("old trash in memory wasn't purged, %d entries left", len(entries))
+	}
+
+	// and nothing was written to disk
+	if entries, _ := os.ReadDir(cfg.FileRoot); len(entries) != 0 {
+		t.Errorf("FileRoot on disk has %d entries", len(entries))
+	}
+}
+
+// cancellingReader gives endless content, calling cancel after reads
+// number of reads.
+type cancellingReader struct {
+	reads  int
+	cancel func()
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	r.reads--
+	if r.reads == 0 {
+		r.cancel()
+	}
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+// cancellingWriter records a response, calling cancel on the first write.
+type cancellingWriter struct {
+	*httptest.ResponseRecorder
+	cancel func()
+}
+
+func (w cancellingWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestCopyContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var dst bytes.Buffer
+	n, err := copyContext(ctx, &dst, &cancellingReader{reads: 3, cancel: cancel}, 0)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if n == 0 || n != int64(dst.Len()) || n > 3*32*1024 {
+		t.Errorf("copied %d bytes, wrote %d, want to stop after 3 reads", n, dst.Len())
+	}
+
+	// uploads stop once the client goes away, leaving no file
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	body := &cancellingReader{reads: 3, cancel: cancel}
+	req := newRequest(http.MethodPut, "/endless.txt", testKey, body).WithContext(ctx)
+	req.ContentLength = -1
+	serve(fs, req)
+	if body.reads < -1 {
+		t.Errorf("upload read %d more times after being cancelled", -body.reads)
+	}
+	if exists(sandboxFile(cfg, "endless.txt")) {
+		t.Error("cancelled upload left a file")
+	}
+
+	// and so do downloads
+	content := strings.Repeat("x", 1<<20)
+	writeSandboxFile(t, cfg, "big.txt", content)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	rec := httptest.NewRecorder()
+	fs.server.Handler.ServeHTTP(cancellingWriter{rec, cancel}, newRequest(http.MethodGet, "/big.txt", testKey, nil).WithContext(ctx))
+	if rec.Body.Len() == 0 || rec.Body.Len() >= len(content) {
+		t.Errorf("cancelled download sent %d of %d bytes", rec.Body.Len(), len(content))
+	}
+}
+
+// readSizes records the size of each read from a ReadSeeker.
+type readSizes struct {
+	io.ReadSeeker
+	sizes []int
+}
+
+func (r *readSizes) Read(p []byte) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return r.ReadSeeker.Read(p)
+}
+
+func TestContentReader(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	src := &readSizes{ReadSeeker: strings.NewReader(content)}
+	r := contentReader(context.Background(), src, 4096)
+
+	p := make([]byte, 32*1024) // as ServeContent reads
+	var got []byte
+	for {
+		n, err := r.Read(p)
+		got = append(got, p[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(got) != content {
+		t.Fatalf("read %d bytes, want %d", len(got), len(content))
+	}
+	for _, size := range src.sizes {
+		if size != 4096 {
+			t.Fatalf("file read in sizes %v, want 4096", src.sizes)
+		}
+	}
+
+	// seeking discards the buffer, and is from the position read to
+	if _, err := r.Seek(15, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := io.ReadFull(r, p[:3]); string(p[:n]) != "567" {
+		t.Errorf("read %q after seeking", p[:n])
+	}
+	if pos, err := r.Seek(2, io.SeekCurrent); err != nil || pos != 20 {
+		t.Errorf("seeked to %d, %v, want 20", pos, err)
+	}
+	if n, _ := io.ReadFull(r, p[:3]); string(p[:n]) != "012" {
+		t.Errorf("read %q after seeking from the current position", p[:n])
+	}
+}
+
+func TestCopyBufferBytes(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.CopyBufferBytes = 7
+	fs := newTestServer(t, cfg)
+	content := strings.Repeat("0123456789", 10000)
+
+	expectStatus(t, do(fs, http.MethodPut, "/file.txt", testKey, content), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != content {
+		t.Fatalf("stored %d bytes, want %d", len(got), len(content))
+	}
+	expectStatus(t, do(fs, http.MethodPost, "/file.txt", testKey, "appended"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPatch, "/file.txt?offset=5", testKey, "ab"), http.StatusOK)
+	want := content[:5] + "ab" + content[7:] + "appended"
+	if got := readSandboxFile(t, cfg, "file.txt"); got != want {
+		t.Fatal("appended and ranged writes stored the wrong content")
+	}
+
+	resp := do(fs, http.MethodGet, "/file.txt", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	if got := readBody(t, resp); got != want {
+		t.Errorf("got %d bytes, want %d", len(got), len(want))
+	}
+	req := newRequest(http.MethodGet, "/file.txt", testKey, nil)
+	req.Header.Set("Range", "bytes=3-12")
+	resp = serve(fs, req)
+	expectStatus(t, resp, http.StatusPartialContent)
+	if got := readBody(t, resp); got != want[3:13] {
+		t.Errorf("got range %q, want %q", got, want[3:13])
+	}
+	req = newRequest(http.MethodGet, "/file.txt", testKey, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp = serve(fs, req)
+	expectStatus(t, resp, http.StatusOK)
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(gz); err != nil || string(got) != want {
+		t.Errorf("got %d gzipped bytes, %v, want %d", len(got), err, len(want))
+	}
+}
+
+func BenchmarkCopyBufferBytes(b *testing.B) {
+	content := strings.Repeat("x", 8<<20)
+	for _, size := range []int{0, 4 << 10, 256 << 10, 1 << 20} {
+		cfg := testConfig(b)
+		cfg.CopyBufferBytes = size
+		fs, err := NewHTTPFSServer(cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run("put/"+strconv.Itoa(size), func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				resp := do(fs, http.MethodPut, "/file.bin", testKey, content)
+				if resp.StatusCode != http.StatusOK {
+					b.Fatalf("got status %d", resp.StatusCode)
+				}
+			}
+		})
+		b.Run("get/"+strconv.Itoa(size), func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				rec := httptest.NewRecorder()
+				rec.Body = nil // discard the response
+				fs.server.Handler.ServeHTTP(rec, newRequest(http.MethodGet, "/file.bin", testKey, nil))
+				if rec.Code != http.StatusOK {
+					b.Fatalf("got status %d", rec.Code)
+				}
+			}
+		})
+	}
+}
+
+// linkedStorage is a memStorage in which the paths in links are symlinks.
+type linkedStorage struct {
+	*memStorage
+	links map[string]bool
+}
+
+func (l linkedStorage) Lstat(path string) (os.FileInfo, error) {
+	info, err := l.memStorage.Lstat(path)
+	if err == nil && l.links[path] {
+		info = linkInfo{info}
+	}
+	return info, err
+}
+
+// linkInfo describes a symlink to the file described by the FileInfo.
+type linkInfo struct {
+	os.FileInfo
+}
+
+func (i linkInfo) Mode() os.FileMode {
+	return i.FileInfo.Mode() | os.ModeSymlink
+}
+
+func TestSymlinksFoundInStorage(t *testing.T) {
+	cfg := testConfig(t)
+	store := linkedStorage{memStorage: newMemStorage(), links: map[string]bool{sandboxFile(cfg, "link"): true}}
+	fs, err := newServer(cfg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MakeDirs(sandboxFile(cfg, "link"), cfg.perms()); err != nil {
+		t.Fatal(err)
+	}
+
+	expectStatus(t, do(fs, http.MethodPut, "/link/file.txt", testKey, "content"), http.StatusForbidden)
+	expectStatus(t, do(fs, http.MethodPut, "/dir/file.txt", testKey, "content"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodGet, "/dir/file.txt", testKey, ""), http.StatusOK)
+	if _, found := store.contents(sandboxFile(cfg, "link/file.txt")); found {
+		t.Error("file written through a symlink in storage")
+	}
+
+	// an actual symlink on disk isn't the storage's concern
+	if err := os.MkdirAll(sandboxFile(cfg, ""), dirPerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(t.TempDir(), sandboxFile(cfg, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, do(fs, http.MethodGet, "/dir/file.txt", testKey, ""), http.StatusOK)
+}
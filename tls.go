@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// minimum TLS version used if none is configured
+const defaultTLSMinVersion = "1.2"
+
+// tlsVersions maps the names of TLS versions in the config to their ids.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig creates the TLS settings for the server from the configured
+// minimum version and cipher suites. Suites are given by their standard
+// names, eg "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", and only apply to
+// TLS 1.2 and earlier. Go's default suites are used if none are given.
+func (s Config) tlsConfig() (*tls.Config, error) {
+	name := s.TLSMinVersion
+	if name == "" {
+		name = defaultTLSMinVersion
+	}
+	version, found := tlsVersions[name]
+	if !found {
+		return nil, fmt.Errorf("unknown TLS version '%s'", name)
+	}
+
+	cfg := &tls.Config{MinVersion: version}
+	if len(s.TLSCipherSuites) == 0 {
+		return cfg, nil
+	}
+
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range s.TLSCipherSuites {
+		id, found := suites[name]
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite '%s'", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	return cfg, nil
+}
+
+// usesTLS reports if the server uses https, with either certificate files
+// or ACME.
+func (s Config) usesTLS() bool {
+	return (s.TLSCertPath != "" && s.TLSKeyPath != "") || s.usesACME()
+}
+
+// usesACME reports if certificates are obtained with ACME, which is only done
+// if certificate files aren't given.
+func (s Config) usesACME() bool {
+	return len(s.ACMEDomains) > 0 && (s.TLSCertPath == "" || s.TLSKeyPath == "")
+}
+
+// acmeManager creates the manager obtaining and renewing certificates for
+// the ACME domains, or nil if ACME isn't used.
+func (s Config) acmeManager() *autocert.Manager {
+	if !s.usesACME() {
+		return nil
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(s.ACMEDomains...),
+		Cache:      autocert.DirCache(s.ACMECacheDir),
+	}
+}
+
+// useACME makes cfg get certificates from m and answer tls-alpn-01
+// challenges. the protocols served over http are added by net/http.
+func useACME(cfg *tls.Config, m *autocert.Manager) {
+	cfg.GetCertificate = m.GetCertificate
+	cfg.NextProtos = append(cfg.NextProtos, acme.ALPNProto)
+}
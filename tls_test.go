@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// startTLS serves fs over https with its TLS settings and a test certificate.
+func startTLS(t *testing.T, fs *httpfsServer) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(fs.server.Handler)
+	server.TLS = fs.server.TLSConfig
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// handshake reports the error of a TLS handshake with server using only the
+// TLS version.
+func handshake(server *httptest.Server, version uint16) error {
+	addr := strings.TrimPrefix(server.URL, "https://")
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         version,
+		MaxVersion:         version,
+	})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	if fs.server.TLSConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("default minimum version is %x", fs.server.TLSConfig.MinVersion)
+	}
+	server := startTLS(t, fs)
+	if err := handshake(server, tls.VersionTLS10); err == nil {
+		t.Error("TLS 1.0 handshake accepted")
+	}
+	if err := handshake(server, tls.VersionTLS12); err != nil {
+		t.Errorf("TLS 1.2 handshake failed: %s", err)
+	}
+
+	cfg.TLSMinVersion = "1.3"
+	server = startTLS(t, newTestServer(t, cfg))
+	if err := handshake(server, tls.VersionTLS12); err == nil {
+		t.Error("TLS 1.2 handshake accepted with 1.3 the minimum")
+	}
+	if err := handshake(server, tls.VersionTLS13); err != nil {
+		t.Errorf("TLS 1.3 handshake failed: %s", err)
+	}
+
+	cfg.TLSMinVersion = "1.0"
+	server = startTLS(t, newTestServer(t, cfg))
+	if err := handshake(server, tls.VersionTLS10); err != nil {
+		t.Errorf("TLS 1.0 handshake failed with 1.0 the minimum: %s", err)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	cfg := Config{TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}
+	tlsCfg, err := cfg.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tlsCfg.CipherSuites) != 1 || tlsCfg.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("got cipher suites %v", tlsCfg.CipherSuites)
+	}
+
+	bad := []Config{
+		{TLSMinVersion: "1.4"},
+		{TLSMinVersion: "TLS1.2"},
+		{TLSCipherSuites: []string{"TLS_NO_SUCH_SUITE"}},
+		{TLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, // insecure
+	}
+	for _, cfg := range bad {
+		if _, err := cfg.tlsConfig(); err == nil {
+			t.Errorf("no error for %+v", cfg)
+		}
+	}
+}
+
+func TestACMEManager(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ACMEDomains = []string{"example.com", "www.example.com"}
+	cfg.ACMECacheDir = filepath.Join(t.TempDir(), "acme")
+	cfg.HTTPRedirectAddress = "127.0.0.1:0"
+	fs := newTestServer(t, cfg)
+
+	m := cfg.acmeManager()
+	if m == nil {
+		t.Fatal("no manager with ACME domains configured")
+	}
+	for _, host := range cfg.ACMEDomains {
+		if err := m.HostPolicy(context.Background(), host); err != nil {
+			t.Errorf("configured domain %s refused: %s", host, err)
+		}
+	}
+	if err := m.HostPolicy(context.Background(), "other.example.com"); err == nil {
+		t.Error("unconfigured domain accepted")
+	}
+	if cache, ok := m.Cache.(autocert.DirCache); !ok || string(cache) != cfg.ACMECacheDir {
+		t.Errorf("manager cache is %#v", m.Cache)
+	}
+
+	// the server gets its certificates from the manager
+	tlsCfg := fs.server.TLSConfig
+	if tlsCfg.GetCertificate == nil {
+		t.Error("server doesn't get certificates with ACME")
+	}
+	alpn := false
+	for _, proto := range tlsCfg.NextProtos {
+		alpn = alpn || proto == acme.ALPNProto
+	}
+	if !alpn {
+		t.Errorf("server doesn't answer tls-alpn-01 challenges, protocols %v", tlsCfg.NextProtos)
+	}
+	if fs.redirectServer == nil {
+		t.Error("no redirect server for http-01 challenges")
+	}
+}
+
+func TestStaticCertsOverACME(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ACMEDomains = []string{"example.com"}
+	cfg.TLSCertPath, cfg.TLSKeyPath = writeTestCert(t)
+	if cfg.usesACME() || cfg.acmeManager() != nil {
+		t.Error("ACME used with certificate files given")
+	}
+	if !cfg.usesTLS() {
+		t.Error("certificate files don't use TLS")
+	}
+	if fs := newTestServer(t, cfg); fs.server.TLSConfig.GetCertificate != nil {
+		t.Error("server gets certificates from ACME")
+	}
+
+	cfg = testConfig(t)
+	if cfg.usesACME() || cfg.usesTLS() {
+		t.Error("TLS used without certificates or ACME")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/quillaja/sysdlog"
+)
+
+// name of the directory within each sandbox holding deleted files
+const trashDir = ".trash"
+
+// layout of the timestamped directories within the trash
+const trashStampFormat = "20060102T150405.000000000Z"
+
+// time between purges of files in the trash older than TrashRetentionHours
+const trashPurgeInterval = time.Hour
+
+// errTrash is returned when writing into the trash, other than by deleting.
+var errTrash = errors.New("the trash is read only")
+
+// inTrash reports if rel, a slash separated path relative to a sandbox, is
+// the trash or within it. The name is matched in any case since it may be
+// on a case insensitive filesystem.
+func inTrash(rel string) bool {
+	first := strings.SplitN(rel, "/", 2)[0]
+	return strings.EqualFold(first, trashDir)
+}
+
+// trashFile moves the file at path into a timestamped directory in the trash
+// of sandbox, keeping its path relative to the sandbox. Empty directories
+// are simply deleted, and directories with contents are only moved to the
+// trash if recursive is true.
+func trashFile(store Storage, sandbox, path string, perms filePerms, recursive bool) error {
+	info, err := store.Stat(path)
+	if err != nil {
+		return fmt.Errorf("error stating file '%s': %w", path, err)
+	}
+	if info.IsDir() && !recursive {
+		return deleteFile(store, path, false)
+	}
+
+	rel, err := filepath.Rel(sandbox, path)
+	if err != nil {
+		return fmt.Errorf("error finding '%s' in sandbox '%s': %w", path, sandbox, err)
+	}
+	stamp := time.Now().UTC().Format(trashStampFormat)
+
+	return moveFile(store, path, filepath.Join(sandbox, trashDir, stamp, rel), perms)
+}
+
+// collectTrash purges old files from the trash of every sandbox right away
+// and then every trashPurgeInterval, until stop is closed.
+func (fs *httpfsServer) collectTrash(stop <-chan struct{}) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		fs.purgeOldTrash()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeOldTrash removes the files trashed more than TrashRetentionHours ago
+// from every sandbox, if a retention is configured.
+func (fs *httpfsServer) purgeOldTrash() {
+	settings := fs.config()
+	if settings.TrashRetentionHours <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-time.Duration(settings.TrashRetentionHours) * time.Hour)
+
+	for _, sandbox := range settings.sandboxes() {
+		purged, err := purgeTrash(fs.storage, sandbox, cutoff)
+		if err != nil {
+			fs.logf(sysdlog.Err, "%s\n", err)
+		}
+		if purged > 0 {
+			fs.usage.Forget(sandbox) // walked again when next needed
+			fs.logf(sysdlog.Info, "purged %d old deletions from the trash of '%s'\n", purged, sandbox)
+		}
+	}
+}
+
+// purgeTrash removes the timestamped directories in the trash of sandbox in
+// store made before cutoff, giving how many were removed. Anything else in
+// the trash is left alone.
+func purgeTrash(store Storage, sandbox string, cutoff time.Time) (int, error) {
+	trash := filepath.Join(sandbox, trashDir)
+	entries, err := store.ReadDir(trash)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading trash '%s': %w", trash, err)
+	}
+
+	purged := 0
+	for _, entry := range entries {
+		stamp, err := time.Parse(trashStampFormat, entry.Name())
+		if !entry.IsDir() || err != nil || !stamp.Before(cutoff) {
+			continue
+		}
+		path := filepath.Join(trash, entry.Name())
+		if err := removeAll(store, path); err != nil {
+			return purged, fmt.Errorf("error purging '%s': %w", path, err)
+		}
+		purged++
+	}
+	return purged, nil
+}
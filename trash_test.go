@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPurgeOldTrash(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.TrashEnabled = true
+	cfg.TrashRetentionHours = 2
+	fs := newTestServer(t, cfg)
+
+	writeSandboxFile(t, cfg, "new.txt", "new")
+	expectStatus(t, do(fs, http.MethodDelete, "/new.txt", testKey, ""), http.StatusOK)
+	trashed, _ := filepath.Glob(sandboxFile(cfg, trashDir+"/*/new.txt"))
+	if len(trashed) != 1 {
+		t.Fatalf("found %v in the trash, want the deleted file", trashed)
+	}
+	old := trashDir + "/" + time.Now().Add(-3*time.Hour).UTC().Format(trashStampFormat)
+	writeSandboxFile(t, cfg, old+"/old.txt", "old")
+	writeSandboxFile(t, cfg, trashDir+"/not-a-stamp/other.txt", "other")
+
+	// nothing is purged without a retention
+	cfg.TrashRetentionHours = 0
+	newTestServer(t, cfg).purgeOldTrash()
+	if !exists(sandboxFile(cfg, old)) {
+		t.Fatal("trash purged without a retention")
+	}
+
+	fs.purgeOldTrash()
+	if exists(sandboxFile(cfg, old)) {
+		t.Error("old trash wasn't purged")
+	}
+	if !exists(trashed[0]) || !exists(sandboxFile(cfg, trashDir+"/not-a-stamp/other.txt")) {
+		t.Error("trash newer than the retention, or not made by deleting, was purged")
+	}
+
+	// the collector purges right away, and stops on shutdown
+	writeSandboxFile(t, cfg, old+"/old.txt", "old")
+	done := make(chan struct{})
+	go func() {
+		fs.collectTrash(fs.stopTrash)
+		close(done)
+	}()
+	for start := time.Now(); exists(sandboxFile(cfg, old)); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("collector didn't purge old trash")
+		}
+	}
+	fs.Shutdown(context.Background())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("collector didn't stop")
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// values of the "upload" query parameter which start and finish a
+// resumable upload. Any other value is the id of the session to write to.
+const (
+	uploadInit   = "init"
+	uploadFinish = "finish"
+)
+
+// time after which an untouched upload session is abandoned
+const uploadSessionTTL = 24 * time.Hour
+
+// furthest past the end of a partial upload a chunk may start, so sparse
+// chunks can't claim space the upload will never fill
+const maxUploadChunkGap = 64 << 20
+
+// errUploadNotFound is returned for requests to an unknown upload session.
+var errUploadNotFound = errors.New("upload session not found")
+
+// errInvalidUploadSize is returned when starting an upload session with a
+// size that isn't a number of bytes.
+var errInvalidUploadSize = errors.New("invalid upload size")
+
+// errChunkOutOfRange is returned for chunks starting before the upload or
+// extending past its declared size.
+var errChunkOutOfRange = errors.New("chunk outside of the upload")
+
+// errUploadTooLarge is returned for chunks starting too far past the end of
+// the partial upload or making it larger than the maximum upload size.
+var errUploadTooLarge = errors.New("upload too large")
+
+// uploadSession is a resumable upload in progress. Chunks are written to a
+// temporary file beside the target which replaces the target when the
+// upload is finished.
+type uploadSession struct {
+	target  string // path the upload is for
+	temp    string // path of the partial upload
+	size    int64  // declared size of the upload, or -1 if not given
+	touched time.Time
+}
+
+// uploadSessions tracks the resumable uploads in progress, whose partial
+// uploads are kept in store.
+type uploadSessions struct {
+	mu       sync.Mutex
+	store    Storage
+	sessions map[string]*uploadSession // id -> session
+}
+
+// newUploadSessions creates an empty uploadSessions keeping partial uploads
+// in store.
+func newUploadSessions(store Storage) *uploadSessions {
+	return &uploadSessions{store: store, sessions: make(map[string]*uploadSession)}
+}
+
+// Start creates a session for an upload to target of size bytes, or of any
+// size if negative, returning its id.
+func (u *uploadSessions) Start(target string, size int64, perms filePerms) (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", fmt.Errorf("error generating upload id: %w", err)
+	}
+	id := hex.EncodeToString(idBytes)
+
+	name := filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".upload-"+id)
+	temp, err := u.store.Create(name, os.O_EXCL, perms)
+	if err != nil {
+		return "", fmt.Errorf("error creating upload file for '%s': %w", target, err)
+	}
+	if err := temp.Close(); err != nil {
+		u.store.Remove(name)
+		return "", fmt.Errorf("error closing upload file '%s': %w", name, err)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire(time.Now())
+	u.sessions[id] = &uploadSession{target: target, temp: name, size: size, touched: time.Now()}
+	return id, nil
+}
+
+// Get finds the session with the id for an upload to target.
+func (u *uploadSessions) Get(id, target string) (*uploadSession, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire(time.Now())
+
+	session, found := u.sessions[id]
+	if !found || session.target != target {
+		return nil, fmt.Errorf("error finding upload '%s' for '%s': %w", id, target, errUploadNotFound)
+	}
+	session.touched = time.Now()
+	return session, nil
+}
+
+// End forgets the session with the id.
+func (u *uploadSessions) End(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.sessions, id)
+}
+
+// Close abandons all sessions, removing their partial uploads.
+func (u *uploadSessions) Close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for id, session := range u.sessions {
+		u.store.Remove(session.temp)
+		delete(u.sessions, id)
+	}
+}
+
+// expire abandons sessions untouched since before uploadSessionTTL, removing
+// their partial uploads. u.mu must be held.
+func (u *uploadSessions) expire(now time.Time) {
+	for id, session := range u.sessions {
+		if now.Sub(session.touched) > uploadSessionTTL {
+			u.store.Remove(session.temp)
+			delete(u.sessions, id)
+		}
+	}
+}
+
+// uploadStarted is the reply to a request starting an upload session.
+type uploadStarted struct {
+	ID string `json:"id"`
+}
+
+// startUpload creates an upload session for localpath and replies with its
+// id. The query may declare the "size" of the upload, which must not exceed
+// max if it is positive.
+func (fs *httpfsServer) startUpload(w http.ResponseWriter, req *http.Request, localpath string, max int64, perms filePerms) error {
+	size := int64(-1)
+	if str := req.URL.Query().Get("size"); str != "" {
+		var err error
+		size, err = strconv.ParseInt(str, 10, 64)
+		if err != nil || size < 0 {
+			return errInvalidUploadSize
+		}
+		if max > 0 && size > max {
+			return errUploadTooLarge
+		}
+	}
+
+	id, err := fs.uploads.Start(localpath, size, perms)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(uploadStarted{ID: id}); err != nil {
+		return fmt.Errorf("error writing upload id: %w", err)
+	}
+	return nil
+}
+
+// writeUploadChunk writes the request body into the partial upload of the
+// session with the id at offset. The chunk must lie within the upload's
+// declared size, start at most maxUploadChunkGap past the end of the partial
+// upload and, if max is positive, not take the upload past max bytes.
+func (fs *httpfsServer) writeUploadChunk(req *http.Request, id, localpath string, offset, max int64, perms filePerms) error {
+	session, err := fs.uploads.Get(id, localpath)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case offset < 0 || (session.size >= 0 && offset > session.size):
+		return fmt.Errorf("error writing chunk at %d of '%s': %w", offset, localpath, errChunkOutOfRange)
+	case offset > fileSize(fs.storage, session.temp)+maxUploadChunkGap || (max > 0 && offset > max):
+		return fmt.Errorf("error writing chunk at %d of '%s': %w", offset, localpath, errUploadTooLarge)
+	}
+
+	// limit the chunk to the rest of the upload, refusing it outright if it
+	// is known to be too long
+	src := &chunkReader{r: req.Body, remaining: -1}
+	if max > 0 {
+		src.remaining, src.err = max-offset, errUploadTooLarge
+	}
+	if session.size >= 0 && (src.remaining < 0 || session.size-offset <= src.remaining) {
+		src.remaining, src.err = session.size-offset, errChunkOutOfRange
+	}
+	if src.remaining >= 0 && req.ContentLength > src.remaining {
+		return fmt.Errorf("error writing chunk at %d of '%s': %w", offset, localpath, src.err)
+	}
+	return writeChunkAt(req.Context(), fs.storage, session.temp, offset, src, perms, fs.config().CopyBufferBytes)
+}
+
+// chunkReader reads from r, failing with err if there are more than
+// remaining bytes. A negative remaining reads all of r.
+type chunkReader struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.remaining < 0 {
+		return c.r.Read(p)
+	}
+	if c.remaining == 0 {
+		var extra [1]byte
+		_, err := io.ReadFull(c.r, extra[:])
+		if err == nil {
+			return 0, c.err
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// finishUpload replaces localpath with the partial upload of the session
+// with the id, encrypting it if aead is not nil. The session is kept if the
+// upload would exceed the key's quota.
+func (fs *httpfsServer) finishUpload(ctx context.Context, id, sandbox, localpath string, keycfg keyConfig, aead cipher.AEAD, perms filePerms) error {
+	session, err := fs.uploads.Get(id, localpath)
+	if err != nil {
+		return err
+	}
+
+	if quota := keycfg.QuotaBytes; quota > 0 {
+		used, err := fs.usage.Used(sandbox)
+		if err != nil {
+			return err
+		}
+		if used-fileSize(fs.storage, localpath)+fileSize(fs.storage, session.temp) > quota {
+			return errQuotaExceeded
+		}
+	}
+
+	if aead == nil {
+		if err := fs.storage.Rename(session.temp, localpath); err != nil {
+			return fmt.Errorf("error replacing file '%s': %w", localpath, err)
+		}
+	} else {
+		temp, err := fs.storage.Open(session.temp)
+		if err != nil {
+			return fmt.Errorf("error opening upload file '%s': %w", session.temp, err)
+		}
+		defer temp.Close()
+		if err := writeFile(ctx, fs.storage, os.O_TRUNC, localpath, temp, aead, perms, fs.config().CopyBufferBytes); err != nil {
+			return err
+		}
+		fs.storage.Remove(session.temp)
+	}
+
+	fs.uploads.End(id)
+	return nil
+}
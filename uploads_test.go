@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestUpload starts an upload session for the resource, giving its id.
+func startTestUpload(t *testing.T, fs *httpfsServer, resource string) string {
+	t.Helper()
+	resp := do(fs, http.MethodPost, resource+"?upload=init", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	var started uploadStarted
+	if err := json.NewDecoder(resp.Body).Decode(&started); err != nil || started.ID == "" {
+		t.Fatalf("upload wasn't started: %v", err)
+	}
+	return started.ID
+}
+
+func TestResumableUpload(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "file.txt", "original")
+	id := startTestUpload(t, fs, "/file.txt")
+
+	chunks := []struct {
+		offset string
+		data   string
+	}{{"10", "third"}, {"0", "first"}, {"5", "secnd"}}
+	for _, chunk := range chunks {
+		expectStatus(t, do(fs, http.MethodPatch, "/file.txt?upload="+id+"&offset="+chunk.offset, testKey, chunk.data), http.StatusOK)
+	}
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "original" {
+		t.Errorf("file has %q before the upload is finished", got)
+	}
+
+	expectStatus(t, do(fs, http.MethodPost, "/file.txt?upload=finish&id="+id, testKey, ""), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "firstsecndthird" {
+		t.Errorf("finished upload left %q", got)
+	}
+	if partial, _ := filepath.Glob(sandboxFile(cfg, ".file.txt.upload-*")); len(partial) != 0 {
+		t.Errorf("partial uploads %v left behind", partial)
+	}
+
+	// the session is over
+	expectStatus(t, do(fs, http.MethodPatch, "/file.txt?upload="+id+"&offset=0", testKey, "more"), http.StatusNotFound)
+	expectStatus(t, do(fs, http.MethodPost, "/file.txt?upload=finish&id="+id, testKey, ""), http.StatusNotFound)
+}
+
+func TestUploadSessionForItsPathOnly(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	id := startTestUpload(t, fs, "/file.txt")
+
+	expectStatus(t, do(fs, http.MethodPatch, "/other.txt?upload="+id+"&offset=0", testKey, "data"), http.StatusNotFound)
+	expectStatus(t, do(fs, http.MethodPost, "/other.txt?upload=finish&id="+id, testKey, ""), http.StatusNotFound)
+	if exists(sandboxFile(cfg, "other.txt")) {
+		t.Error("session wrote to another path")
+	}
+}
+
+func TestUnfinishedUploadsRemoved(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	startTestUpload(t, fs, "/expired.txt")
+	partial, _ := filepath.Glob(sandboxFile(cfg, ".expired.txt.upload-*"))
+	if len(partial) != 1 {
+		t.Fatalf("found partial uploads %v, want one", partial)
+	}
+
+	fs.uploads.mu.Lock()
+	fs.uploads.expire(time.Now().Add(uploadSessionTTL + time.Minute))
+	fs.uploads.mu.Unlock()
+	if exists(partial[0]) {
+		t.Error("expired session's partial upload wasn't removed")
+	}
+
+	startTestUpload(t, fs, "/closed.txt")
+	fs.uploads.Close()
+	if partial, _ := filepath.Glob(sandboxFile(cfg, ".closed.txt.upload-*")); len(partial) != 0 {
+		t.Errorf("partial uploads %v left after closing", partial)
+	}
+}
+
+func TestUploadChunkOffsets(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxUploadBytes = 2 * maxUploadChunkGap
+	fs := newTestServer(t, cfg)
+
+	resp := do(fs, http.MethodPost, "/sized.txt?upload=init&size=10", testKey, "")
+	expectStatus(t, resp, http.StatusOK)
+	var started uploadStarted
+	if err := json.NewDecoder(resp.Body).Decode(&started); err != nil {
+		t.Fatal(err)
+	}
+	sized := "/sized.txt?upload=" + started.ID + "&offset="
+	expectJSONError(t, do(fs, http.MethodPatch, sized+"-1", testKey, "data"), http.StatusRequestedRangeNotSatisfiable)
+	expectJSONError(t, do(fs, http.MethodPatch, sized+"11", testKey, "data"), http.StatusRequestedRangeNotSatisfiable)
+	expectJSONError(t, do(fs, http.MethodPatch, sized+"8", testKey, "data"), http.StatusRequestedRangeNotSatisfiable)
+	// bodies of unknown length are cut off at the declared size
+	req := newRequest(http.MethodPatch, sized+"8", testKey, strings.NewReader("data"))
+	req.ContentLength = -1
+	expectJSONError(t, serve(fs, req), http.StatusRequestedRangeNotSatisfiable)
+	expectStatus(t, do(fs, http.MethodPatch, sized+"6", testKey, "data"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPatch, sized+"0", testKey, "sized-"), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodPost, "/sized.txt?upload=finish&id="+started.ID, testKey, ""), http.StatusOK)
+	if got := readSandboxFile(t, cfg, "sized.txt"); got != "sized-data" {
+		t.Errorf("finished upload left %q", got)
+	}
+
+	id := startTestUpload(t, fs, "/file.txt")
+	chunk := "/file.txt?upload=" + id + "&offset="
+	expectJSONError(t, do(fs, http.MethodPatch, chunk+strconv.Itoa(maxUploadChunkGap+1), testKey, "data"), http.StatusRequestEntityTooLarge)
+	expectJSONError(t, do(fs, http.MethodPatch, chunk+strconv.Itoa(2*maxUploadChunkGap-2), testKey, "data"), http.StatusRequestEntityTooLarge)
+	expectStatus(t, do(fs, http.MethodPatch, chunk+strconv.Itoa(maxUploadChunkGap), testKey, "data"), http.StatusOK)
+	if info, err := os.Stat(sandboxFile(cfg, ".file.txt.upload-"+id)); err != nil || info.Size() != maxUploadChunkGap+4 {
+		t.Errorf("partial upload is %v, %v, want %d bytes", info, err, maxUploadChunkGap+4)
+	}
+
+	expectJSONError(t, do(fs, http.MethodPost, "/big.txt?upload=init&size="+strconv.Itoa(2*maxUploadChunkGap+1), testKey, ""), http.StatusRequestEntityTooLarge)
+	expectJSONError(t, do(fs, http.MethodPost, "/big.txt?upload=init&size=many", testKey, ""), http.StatusBadRequest)
+}
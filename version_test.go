@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	fs := newTestServer(t, testConfig(t))
+	defer func(v, c, b string) { version, commit, buildTime = v, c, b }(version, commit, buildTime)
+	version, commit, buildTime = "v1.2.0", "abc123", "2021-01-02T03:04:05Z"
+
+	resp := do(fs, http.MethodGet, versionPath, "", "")
+	expectStatus(t, resp, http.StatusOK)
+	if ctype := resp.Header.Get("Content-Type"); ctype != "application/json" {
+		t.Errorf("got Content-Type %q", ctype)
+	}
+	var info map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("version isn't a JSON object of strings: %s", err)
+	}
+	want := map[string]string{"version": "v1.2.0", "commit": "abc123", "build_time": "2021-01-02T03:04:05Z"}
+	if len(info) != len(want) {
+		t.Errorf("got fields %v, want %v", info, want)
+	}
+	for field, value := range want {
+		if info[field] != value {
+			t.Errorf("got %s %q, want %q", field, info[field], value)
+		}
+	}
+}
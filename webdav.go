@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+)
+
+// errInvalidDepth is returned for PROPFIND requests with an unknown Depth.
+var errInvalidDepth = errors.New("invalid Depth")
+
+// davMultistatus is the body of a PROPFIND response.
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+// davResponse gives the properties of a single file or directory.
+type davResponse struct {
+	Href   string  `xml:"D:href"`
+	Prop   davProp `xml:"D:propstat>D:prop"`
+	Status string  `xml:"D:propstat>D:status"`
+}
+
+// davProp holds the properties reported by PROPFIND.
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ContentLength string          `xml:"D:getcontentlength,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+}
+
+// davResourceType marks directories as collections.
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// newDavResponse describes entry, found at the resource path href.
+func newDavResponse(href string, entry dirEntry) davResponse {
+	r := davResponse{
+		Href: (&url.URL{Path: href}).EscapedPath(),
+		Prop: davProp{
+			DisplayName:  entry.Name,
+			LastModified: entry.ModTime.UTC().Format(http.TimeFormat),
+		},
+		Status: "HTTP/1.1 200 OK",
+	}
+	if entry.IsDir {
+		r.Prop.ResourceType.Collection = &struct{}{}
+	} else {
+		r.Prop.ContentLength = strconv.FormatInt(entry.Size, 10)
+	}
+	return r
+}
+
+// propfind writes a WebDAV multistatus document describing the file or
+// directory at localpath, found at the resource path, into w. A directory's
+// children are also described unless depth is "0".
+func propfind(store Storage, localpath, resource, depth string, w http.ResponseWriter) error {
+	switch depth {
+	case "0", "1", "infinity", "":
+	default:
+		return fmt.Errorf("error finding properties of '%s': %w", localpath, errInvalidDepth)
+	}
+
+	info, err := store.Stat(localpath)
+	if err != nil {
+		return fmt.Errorf("error stating file '%s': %w", localpath, err)
+	}
+	target := dirEntry{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+	}
+
+	if target.IsDir && resource[len(resource)-1] != '/' {
+		resource += "/"
+	}
+	status := davMultistatus{
+		Namespace: "DAV:",
+		Responses: []davResponse{newDavResponse(resource, target)},
+	}
+
+	// "infinity" is treated as 1 to avoid walking whole sandboxes
+	if target.IsDir && depth != "0" {
+		children, err := readDirEntries(store, localpath, resource == "/")
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			href := path.Join(resource, child.Name)
+			if child.IsDir {
+				href += "/"
+			}
+			status.Responses = append(status.Responses, newDavResponse(href, child))
+		}
+	}
+
+	data, err := xml.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("error encoding properties of '%s': %w", localpath, err)
+	}
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"testing"
+)
+
+// propfindResult is the part of a PROPFIND response checked by tests.
+type propfindResult struct {
+	Responses []struct {
+		Href string `xml:"href"`
+		Prop struct {
+			DisplayName   string    `xml:"displayname"`
+			ContentLength string    `xml:"getcontentlength"`
+			LastModified  string    `xml:"getlastmodified"`
+			Collection    *struct{} `xml:"resourcetype>collection"`
+		} `xml:"propstat>prop"`
+	} `xml:"response"`
+}
+
+// doPropfind issues a PROPFIND with the Depth and parses the response.
+func doPropfind(t *testing.T, fs *httpfsServer, target, depth string) propfindResult {
+	t.Helper()
+	req := newRequest(methodPropfind, target, testKey, nil)
+	req.Header.Set("Depth", depth)
+	resp := serve(fs, req)
+	expectStatus(t, resp, http.StatusMultiStatus)
+	var result propfindResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("PROPFIND response isn't XML: %s", err)
+	}
+	return result
+}
+
+func TestPropfind(t *testing.T) {
+	cfg := testConfig(t)
+	fs := newTestServer(t, cfg)
+	writeSandboxFile(t, cfg, "dir/a.txt", "12345")
+	writeSandboxFile(t, cfg, "dir/sub/b.txt", "1")
+
+	result := doPropfind(t, fs, "/dir", "1")
+	var hrefs []string
+	for _, r := range result.Responses {
+		hrefs = append(hrefs, r.Href)
+		switch r.Prop.DisplayName {
+		case "a.txt":
+			if r.Prop.ContentLength != "5" || r.Prop.Collection != nil || r.Prop.LastModified == "" {
+				t.Errorf("a.txt has %+v", r.Prop)
+			}
+		case "dir", "sub":
+			if r.Prop.Collection == nil {
+				t.Errorf("%s isn't a collection", r.Prop.DisplayName)
+			}
+		default:
+			t.Errorf("unexpected response for %q", r.Prop.DisplayName)
+		}
+	}
+	sort.Strings(hrefs)
+	if len(hrefs) != 3 || hrefs[0] != "/dir/" || hrefs[1] != "/dir/a.txt" || hrefs[2] != "/dir/sub/" {
+		t.Errorf("Depth 1 listed %v, want the directory and its children", hrefs)
+	}
+
+	if result := doPropfind(t, fs, "/dir", "0"); len(result.Responses) != 1 {
+		t.Errorf("Depth 0 listed %d responses, want only the directory", len(result.Responses))
+	}
+
+	req := newRequest(methodPropfind, "/missing", testKey, nil)
+	expectStatus(t, serve(fs, req), http.StatusNotFound)
+}
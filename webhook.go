@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/quillaja/sysdlog"
+)
+
+// time allowed for the webhook to respond to an event
+const webhookTimeout = 5 * time.Second
+
+// changeEvent is sent to the webhook after a request changes a file.
+type changeEvent struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Sandbox     directory `json:"sandbox"`
+	Path        string    `json:"path"` // relative to the sandbox
+	Destination string    `json:"destination,omitempty"`
+	Bytes       int64     `json:"bytes"` // received in the request body
+}
+
+// isChange reports if requests with the method change files.
+func isChange(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, methodMove, methodCopy:
+		return true
+	}
+	return false
+}
+
+// notifyWebhook posts the event to the webhook at url in the background.
+// Events are sent at most once and failures are only logged.
+func (fs *httpfsServer) notifyWebhook(url string, event changeEvent) {
+	go func() {
+		if err := postEvent(url, event); err != nil {
+			fs.logf(sysdlog.Warning, "error notifying webhook:%s\n", err)
+		}
+	}()
+}
+
+// postEvent sends the event as JSON to the webhook at url.
+func postEvent(url string, event changeEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error encoding event: %w", err)
+	}
+
+	client := http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error posting event to '%s': %w", url, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook '%s' responded with %s", url, resp.Status)
+	}
+	return nil
+}
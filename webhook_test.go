@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// webhookServer starts a webhook receiving events into the channel.
+func webhookServer(t *testing.T, status int) (string, <-chan changeEvent) {
+	t.Helper()
+	events := make(chan changeEvent, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var event changeEvent
+		if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+			t.Errorf("webhook got invalid event: %s", err)
+		}
+		events <- event
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(hook.Close)
+	return hook.URL, events
+}
+
+// nextEvent waits for the webhook to receive an event.
+func nextEvent(t *testing.T, events <-chan changeEvent) changeEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook received no event")
+	}
+	return changeEvent{}
+}
+
+func TestWebhook(t *testing.T) {
+	url, events := webhookServer(t, http.StatusOK)
+	cfg := testConfig(t)
+	cfg.WebhookURL = url
+	fs := newTestServer(t, cfg)
+
+	expectStatus(t, do(fs, http.MethodPut, "/dir/file.txt", testKey, "content"), http.StatusOK)
+	event := nextEvent(t, events)
+	if event.Method != http.MethodPut || event.Sandbox != "sandbox" || event.Path != "/dir/file.txt" || event.Bytes != 7 {
+		t.Errorf("got event %+v", event)
+	}
+	if time.Since(event.Time) > time.Minute {
+		t.Errorf("event has time %v", event.Time)
+	}
+
+	// reads and failed changes aren't sent
+	expectStatus(t, do(fs, http.MethodGet, "/dir/file.txt", testKey, ""), http.StatusOK)
+	expectStatus(t, do(fs, http.MethodDelete, "/missing.txt", testKey, ""), http.StatusNotFound)
+	expectStatus(t, do(fs, http.MethodDelete, "/dir/file.txt", testKey, ""), http.StatusOK)
+	if event := nextEvent(t, events); event.Method != http.MethodDelete || event.Path != "/dir/file.txt" {
+		t.Errorf("got event %+v, want the DELETE", event)
+	}
+}
+
+func TestFailingWebhook(t *testing.T) {
+	url, events := webhookServer(t, http.StatusInternalServerError)
+	cfg := testConfig(t)
+	cfg.WebhookURL = url
+	fs := newTestServer(t, cfg)
+
+	expectStatus(t, do(fs, http.MethodPut, "/file.txt", testKey, "content"), http.StatusOK)
+	nextEvent(t, events)
+	if got := readSandboxFile(t, cfg, "file.txt"); got != "content" {
+		t.Errorf("file has %q", got)
+	}
+	if err := postEvent(url, changeEvent{}); err == nil {
+		t.Error("error from the webhook wasn't reported")
+	}
+}